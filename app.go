@@ -1,35 +1,93 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
+	"github.com/zjxpcyc/wechat-scheduler/database"
 	"github.com/zjxpcyc/wechat-scheduler/jobs"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
 
 // App is a http.Handler
-type App struct{}
+type App struct {
+	// Jobs 所有注册的 Job
+	Jobs *jobs.Registry
+
+	// Auth 访问校验, 为 nil 时不校验
+	Auth *lib.Authenticator
+
+	// closing 系统正在关闭或者重启, 只接受查询
+	closing int32
+
+	router *Router
+}
+
+// NewApp 实例化 App, 并注册所有路由
+func NewApp(reg *jobs.Registry) *App {
+	t := &App{
+		Jobs:   reg,
+		router: NewRouter(),
+	}
+
+	t.router.Handle(http.MethodPost, "/registe", lib.PERM_REGISTE, (*Controller).RegisteTasks)
+	t.router.Handle(http.MethodDelete, "/registe/:appid", lib.PERM_REGISTE, (*Controller).UnregisteJob)
+	t.router.Handle(http.MethodGet, "/task/:appid/:type", lib.PERM_READ, (*Controller).GetTaskValue)
+	t.router.Handle(http.MethodDelete, "/task/:appid/:type", lib.PERM_REGISTE, (*Controller).UnregisteTask)
+	t.router.Handle(http.MethodPost, "/task/:appid/:type/refresh", lib.PERM_REGISTE, (*Controller).RefreshTask)
+	t.router.Handle(http.MethodPost, "/task/:appid/:type/invalid", lib.PERM_READ, (*Controller).InvalidateTask)
+	t.router.Handle(http.MethodPost, "/task/:appid/:type/notify", lib.PERM_REGISTE, (*Controller).AddNotify)
+	t.router.Handle(http.MethodDelete, "/task/:appid/:type/notify", lib.PERM_REGISTE, (*Controller).RemoveNotify)
+	t.router.Handle(http.MethodGet, "/jobs", lib.PERM_READ, (*Controller).ListJobs)
+	t.router.Handle(http.MethodGet, "/jobs/:appid", lib.PERM_READ, (*Controller).GetJob)
+
+	return t
+}
+
+// Close 不再接受注册, 删除, 刷新等修改数据的请求, 查询不受影响
+// 之后存储会被关闭, 任务也不再运行
+func (t *App) Close() {
+	atomic.StoreInt32(&t.closing, 1)
+}
 
 // ServeHTTP 实现接口
 func (t *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctrl := new(Controller)
+
+	ctrl.Jobs = t.Jobs
+	ctrl.Input = r
+	ctrl.Output = w
+
 	defer func() {
 		if p := recover(); p != nil {
-			return
+			logger.Error("处理请求出错: ", fmt.Sprintf("%v", p))
+			ctrl.ResponseJSON(errors.New("内部错误"), http.StatusInternalServerError)
 		}
 	}()
 
-	r.ParseForm()
-
-	ctrl := new(Controller)
+	route, params, status, allowed := t.router.Match(r.Method, r.URL.Path)
+	switch status {
+	case http.StatusNotFound:
+		ctrl.ResponseJSON(errors.New("请求地址不存在"), status)
+		return
+	case http.StatusMethodNotAllowed:
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		ctrl.ResponseJSON(errors.New("不支持的请求方式"), status)
+		return
+	}
 
-	ctrl.Get = r.FormValue
-	ctrl.Input = r
-	ctrl.Output = w
+	if r.Method != http.MethodGet && atomic.LoadInt32(&t.closing) == 1 {
+		ctrl.ResponseJSON(errors.New("系统正在重启或者关闭, 请稍后重试"), http.StatusServiceUnavailable)
+		return
+	}
 
 	defer r.Body.Close()
 	body, err := ioutil.ReadAll(r.Body)
@@ -37,36 +95,85 @@ func (t *App) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		logger.Error("获取请求内容失败: " + err.Error())
 	}
 
-	logger.Info("获取到 body 参数: " + string(body))
+	// body 中有 appsecret, 上报失效的 token 等, 不记录
+	logger.Info("收到请求: " + r.Method + " " + r.URL.Path)
 	ctrl.Body = body
 
-	if strings.Index(r.URL.Path, "/registe") > -1 {
-		ctrl.RegisteTasks()
+	// ParseForm 会读取 body, 这里放回去
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+	r.ParseForm()
+	ctrl.Get = r.FormValue
+	ctrl.Params = params
+
+	if t.Auth != nil {
+		if code, err := t.authorize(ctrl, route); err != nil {
+			ctrl.ResponseJSON(err, code)
+			return
+		}
+	}
+
+	route.Handler(ctrl)
+}
+
+// authorize 校验请求的凭证, 以及凭证对请求的 appid 是否有路由所需的权限
+func (t *App) authorize(ctrl *Controller, route *Route) (int, error) {
+	cred, err := t.Auth.Verify(ctrl.Input, ctrl.Body)
+	if err != nil {
+		return http.StatusUnauthorized, err
+	}
+
+	ctrl.Credential = cred
+
+	// 列表类的接口, 由处理函数依据凭证过滤
+	if route.Pattern == "/jobs" {
+		return http.StatusOK, nil
+	}
+
+	// 注册时 appid 在 body 中
+	appid, ok := ctrl.Params["appid"]
+	if !ok {
+		params := RegisteParam{}
+		json.Unmarshal(ctrl.Body, &params)
+		appid = params.AppID
 	}
 
-	if strings.Index(r.URL.Path, "/task") > -1 {
-		ctrl.GetTaskValue()
+	if !cred.Allow(appid, route.Permission) {
+		logger.Error("凭证 " + cred.Key + " 没有 " + appid + " 的 " + route.Permission + " 权限")
+		return http.StatusForbidden, lib.ErrForbidden
 	}
+
+	return http.StatusOK, nil
 }
 
 type Controller struct {
-	Get  func(string) string
-	Body []byte
+	Jobs *jobs.Registry
+
+	// Credential 请求的凭证, 未开启访问校验时为 nil
+	Credential *lib.Credential
+
+	Get    func(string) string
+	Params map[string]string
+	Body   []byte
 
 	Input  *http.Request
 	Output http.ResponseWriter
 }
 
 type RegisteTask struct {
-	Typ    int    `json:"type"`
-	Notify string `json:"notify"`
-	Params string `json:"params"`
+	Typ    int              `json:"type"`
+	Notify string           `json:"notify"`
+	Params string           `json:"params"`
+	Retry  *jobs.RetryParam `json:"retry"`
 }
 
 type RegisteParam struct {
 	AppID     string        `json:"appid"`
 	AppSecret string        `json:"appsecret"`
 	Tasks     []RegisteTask `json:"tasks"`
+
+	// NotifySecret tasks 中回调地址签名使用的密钥, 每个回调地址单独保存
+	// 为空时保留回调地址原有的密钥, 新的回调地址不签名
+	NotifySecret string `json:"notify_secret"`
 }
 
 // RegisteTasks 注册
@@ -74,11 +181,13 @@ type RegisteParam struct {
 // {
 // 	"appid": "",
 // 	"appsecret": "",
+// 	"notify_secret": "",
 // 	"tasks": [
 // 		{
 // 			"type": 0,
 // 			"notify": "",
 // 			"params": "",
+// 			"retry": {},
 // 		},
 // 		...
 // 	]
@@ -87,37 +196,73 @@ func (t *Controller) RegisteTasks() {
 	// 解析传入参数
 	if t.Body == nil || len(t.Body) == 0 {
 		t.ResponseJSON(errors.New("注册失败: 注册参数不能为空"), http.StatusBadRequest)
+		return
 	}
 
 	params := RegisteParam{}
 	if err := json.Unmarshal(t.Body, &params); err != nil {
 		logger.Error("读取注册参数失败: " + err.Error())
 		t.ResponseJSON(errors.New("注册失败: 读取参数失败"), http.StatusBadRequest)
+		return
 	}
 
 	if params.AppID == "" || params.AppSecret == "" {
 		t.ResponseJSON(errors.New("注册失败: appid 或者 appsecret 不能为空"), http.StatusBadRequest)
+		return
+	}
+
+	if params.NotifySecret != "" && len(params.NotifySecret) < jobs.NOTIFY_SECRET_MIN_LEN {
+		t.ResponseJSON(errors.New("注册失败: notify_secret 长度不能少于 "+strconv.Itoa(jobs.NOTIFY_SECRET_MIN_LEN)+" 位"), http.StatusBadRequest)
+		return
 	}
 
 	tasks := params.Tasks
 	if tasks == nil || len(tasks) == 0 {
 		t.ResponseJSON("")
+		return
+	}
+
+	types := make(map[int]bool)
+	for _, tk := range tasks {
+		if tk.Typ < 0 || tk.Typ >= jobs.JOB_MAX_LIMIT {
+			t.ResponseJSON(errors.New("注册失败: 不支持的任务类型"), http.StatusBadRequest)
+			return
+		}
+
+		if _, err := tk.Retry.Policy(tk.Typ); err != nil {
+			t.ResponseJSON(errors.New("注册失败: 重试策略不正确, "+err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		types[tk.Typ] = types[tk.Typ] || tk.Params != ""
+	}
+
+	if err := t.Jobs.CheckDependencies(params.AppID, types); err != nil {
+		t.ResponseJSON(errors.New("注册失败: "+err.Error()), http.StatusBadRequest)
+		return
 	}
 
 	// 注册 Job
-	job, err := jobs.NewJob(params.AppID, params.AppSecret)
+	job, err := t.Jobs.NewJob(params.AppID, params.AppSecret)
 	if err != nil {
-		logger.Error("注册任务失败: (appid: " + params.AppID + ", appsecret: " + params.AppSecret + ") : " + err.Error())
-		t.ResponseJSON(errors.New("注册任务失败, 请重试"), http.StatusBadRequest)
+		logger.Error("注册任务失败: (appid: " + params.AppID + ") : " + err.Error())
+		t.ResponseJSON(errors.New("注册任务失败, 请重试"), http.StatusInternalServerError)
+		return
 	}
 
-	// 添加任务
+	// 添加任务, 失败时不再运行
 	for _, tk := range tasks {
-		if tk.Typ < 0 || tk.Typ >= jobs.JOB_MAX_LIMIT {
-			t.ResponseJSON(errors.New("注册失败: 不支持的任务类型"), http.StatusBadRequest)
-		}
+		if _, err := job.NewTask(tk.Typ, tk.Params, tk.Notify, params.NotifySecret, tk.Retry); err != nil {
+			logger.Error("注册任务失败: (appid: " + params.AppID + ") : " + err.Error())
+
+			if err == database.ErrDropped {
+				t.ResponseJSON(errors.New("注册失败: AppID 已被删除, 请重试"), http.StatusConflict)
+				return
+			}
 
-		job.NewTask(tk.Typ, tk.Params, tk.Notify)
+			t.ResponseJSON(errors.New("注册任务失败, 请重试"), http.StatusInternalServerError)
+			return
+		}
 	}
 
 	// 运行任务
@@ -126,41 +271,285 @@ func (t *Controller) RegisteTasks() {
 	t.ResponseJSON("success")
 }
 
-// GetTaskValue 获取当前任务的值
-func (t *Controller) GetTaskValue() {
-	ps := strings.Split(t.Input.URL.Path, "/")
+// UnregisteJob 删除 appid 下所有的任务及数据
+// DELETE /registe/:appid
+func (t *Controller) UnregisteJob() {
+	appid := t.Params["appid"]
+	if _, ok := t.Jobs.Job(appid); !ok {
+		t.ResponseJSON(errors.New("非法的 AppID"), http.StatusNotFound)
+		return
+	}
+
+	if err := t.Jobs.Remove(appid); err != nil {
+		logger.Error("删除 Job-"+appid+" 失败: ", err.Error())
+		t.ResponseJSON(errors.New("删除失败, 请重试"), http.StatusInternalServerError)
+		return
+	}
+
+	t.ResponseJSON("success")
+}
+
+// UnregisteTask 删除指定类型的任务, 没有剩余任务时删除 appid 的所有数据
+// 其他任务依赖于此任务时返回 409
+// DELETE /task/:appid/:type
+func (t *Controller) UnregisteTask() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
+	}
+
+	appid := t.Params["appid"]
+	if _, err := t.Jobs.State(appid, typ); err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
+	}
+
+	err = t.Jobs.RemoveTask(appid, typ)
+
+	var de *jobs.DependencyError
+	if errors.As(err, &de) {
+		t.ResponseJSON(errors.New("删除失败: "+err.Error()), http.StatusConflict)
+		return
+	}
+
+	if err != nil {
+		logger.Error("删除 Job-"+appid+" 任务 "+t.Params["type"]+" 失败: ", err.Error())
+		t.ResponseJSON(errors.New("删除失败, 请重试"), http.StatusInternalServerError)
+		return
+	}
+
+	t.ResponseJSON("success")
+}
+
+// RefreshTask 立即刷新任务, 返回刷新之后的结果
+// 依赖于此任务的任务也会随后刷新
+// POST /task/:appid/:type/refresh
+func (t *Controller) RefreshTask() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
+	}
+
+	appid := t.Params["appid"]
+	if _, err := t.Jobs.State(appid, typ); err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
+	}
+
+	st, err := t.Jobs.Refresh(appid, typ)
+	if err == jobs.ErrNotLeader {
+		t.ResponseJSON(err, http.StatusServiceUnavailable)
+		return
+	}
+
+	if err != nil {
+		logger.Error("刷新 Job-"+appid+" 任务 "+t.Params["type"]+" 失败: ", err.Error())
+		t.ResponseJSON(errors.New("刷新失败: "+err.Error()), http.StatusBadGateway)
+		return
+	}
+
+	t.ResponseJSON(st.Value)
+}
+
+// InvalidParam 上报 token 失效的参数
+type InvalidParam struct {
+	// Value 业务系统使用的, 被微信判定为失效的值
+	Value string `json:"value"`
+
+	// ErrCode 微信返回的错误码
+	ErrCode int `json:"errcode"`
+}
+
+// InvalidateTask 业务系统上报 token 失效, 刷新之后返回新的值
+// 只读凭证也可以上报
+// POST /task/:appid/:type/invalid
+func (t *Controller) InvalidateTask() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
+	}
+
+	params := InvalidParam{}
+	if len(t.Body) > 0 {
+		if err := json.Unmarshal(t.Body, &params); err != nil {
+			t.ResponseJSON(errors.New("读取参数失败"), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if params.ErrCode != 0 && !jobs.InvalidCodes[params.ErrCode] {
+		t.ResponseJSON(errors.New("错误码 "+strconv.Itoa(params.ErrCode)+" 不代表 token 失效"), http.StatusBadRequest)
+		return
+	}
+
+	appid := t.Params["appid"]
+	if _, err := t.Jobs.State(appid, typ); err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
+	}
+
+	st, err := t.Jobs.Invalidate(appid, typ, params.Value)
+	switch {
+	case err == nil:
+		t.ResponseJSON(st.Value)
+	case err == jobs.ErrInvalidTooFrequent:
+		t.ResponseJSON(err, http.StatusTooManyRequests)
+	case err == jobs.ErrNotLeader:
+		t.ResponseJSON(err, http.StatusServiceUnavailable)
+	default:
+		logger.Error("刷新 Job-"+appid+" 任务 "+t.Params["type"]+" 失败: ", err.Error())
+		t.ResponseJSON(errors.New("刷新失败: "+err.Error()), http.StatusBadGateway)
+	}
+}
+
+// NotifyParam 添加或者删除回调地址的参数
+type NotifyParam struct {
+	// URL 回调地址
+	URL string `json:"url"`
+
+	// Secret 该回调地址签名使用的密钥, 为空时保留原有的密钥
+	Secret string `json:"secret"`
+}
+
+// notifyParam 读取回调地址, body 中没有时读取 url 参数
+func (t *Controller) notifyParam() (NotifyParam, error) {
+	params := NotifyParam{}
+	if len(t.Body) > 0 {
+		if err := json.Unmarshal(t.Body, &params); err != nil {
+			return params, errors.New("读取参数失败")
+		}
+	}
+
+	if params.URL == "" {
+		params.URL = t.Get("url")
+	}
+
+	u, err := url.Parse(params.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return params, errors.New("回调地址不正确")
+	}
+
+	if params.Secret != "" && len(params.Secret) < jobs.NOTIFY_SECRET_MIN_LEN {
+		return params, errors.New("secret 长度不能少于 " + strconv.Itoa(jobs.NOTIFY_SECRET_MIN_LEN) + " 位")
+	}
+
+	return params, nil
+}
 
-	if len(ps) < 3 {
-		t.ResponseJSON(errors.New("请求地址不存在"), http.StatusNotFound)
+// AddNotify 为任务添加回调地址, 不影响其他业务系统注册的回调地址
+// 新增的回调地址立即收到当前有效的结果
+// POST /task/:appid/:type/notify
+func (t *Controller) AddNotify() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
 	}
 
-	psLen := len(ps)
-	typ, err := strconv.Atoi(ps[psLen-1])
+	params, err := t.notifyParam()
 	if err != nil {
-		logger.Error("获取任务值出错: ", err.Error())
-		t.ResponseJSON(errors.New("请求地址格式不正确"))
+		t.ResponseJSON(err, http.StatusBadRequest)
+		return
 	}
 
-	if typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
-		t.ResponseJSON(errors.New("非法的任务类型"))
+	appid := t.Params["appid"]
+	if _, err := t.Jobs.State(appid, typ); err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
 	}
 
-	logger.Info(jobs.AllJob)
+	if err := t.Jobs.AddNotify(appid, typ, params.URL, params.Secret); err != nil {
+		logger.Error("添加 Job-"+appid+" 任务 "+t.Params["type"]+" 回调地址失败: ", err.Error())
+		t.ResponseJSON(errors.New("添加失败, 请重试"), http.StatusInternalServerError)
+		return
+	}
+
+	t.ResponseJSON("success")
+}
+
+// RemoveNotify 删除任务的回调地址, 其他回调地址不受影响
+// DELETE /task/:appid/:type/notify
+func (t *Controller) RemoveNotify() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
+	}
 
-	appid := ps[psLen-2]
-	if job, ok := jobs.AllJob[appid]; !ok {
-		t.ResponseJSON(errors.New("非法的 AppID"))
-	} else {
-		tk, has := job.Tasks[typ]
-		if !has {
-			t.ResponseJSON(errors.New("当前 AppID 并未注册指定类型的 任务"))
+	params, err := t.notifyParam()
+	if err != nil {
+		t.ResponseJSON(err, http.StatusBadRequest)
+		return
+	}
+
+	appid := t.Params["appid"]
+	if _, err := t.Jobs.State(appid, typ); err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
+	}
+
+	err = t.Jobs.RemoveNotify(appid, typ, params.URL)
+	switch {
+	case err == nil:
+		t.ResponseJSON("success")
+	case err == jobs.ErrNotifyNotFound:
+		t.ResponseJSON(err, http.StatusNotFound)
+	default:
+		logger.Error("删除 Job-"+appid+" 任务 "+t.Params["type"]+" 回调地址失败: ", err.Error())
+		t.ResponseJSON(errors.New("删除失败, 请重试"), http.StatusInternalServerError)
+	}
+}
+
+// ListJobs 所有 Job 及其任务的状态
+// GET /jobs
+func (t *Controller) ListJobs() {
+	all := make([]jobs.JobStatus, 0)
+	for _, j := range t.Jobs.Jobs() {
+		if t.Credential != nil && !t.Credential.Allow(j.AppID, lib.PERM_READ) {
+			continue
 		}
 
-		t.ResponseJSON(tk.Value)
+		all = append(all, j.Status())
 	}
+
+	t.ResponseJSON(all)
+}
+
+// GetJob 指定 Job 及其任务的状态
+// GET /jobs/:appid
+func (t *Controller) GetJob() {
+	j, ok := t.Jobs.Job(t.Params["appid"])
+	if !ok {
+		t.ResponseJSON(errors.New("非法的 AppID"), http.StatusNotFound)
+		return
+	}
+
+	t.ResponseJSON(j.Status())
+}
+
+// GetTaskValue 获取当前任务的值
+// GET /task/:appid/:type
+func (t *Controller) GetTaskValue() {
+	typ, err := strconv.Atoi(t.Params["type"])
+	if err != nil || typ < 0 || typ >= jobs.JOB_MAX_LIMIT {
+		t.ResponseJSON(errors.New("非法的任务类型"), http.StatusBadRequest)
+		return
+	}
+
+	st, err := t.Jobs.State(t.Params["appid"], typ)
+	if err != nil {
+		t.ResponseJSON(err, http.StatusNotFound)
+		return
+	}
+
+	t.ResponseJSON(st.Value)
 }
 
 // ResponseJSON 统一约定返回 json
+// http 状态码与返回内容中的 code 一致
 func (t *Controller) ResponseJSON(data interface{}, code ...int) {
 	status := http.StatusOK
 	if code != nil && len(code) > 0 {
@@ -186,19 +575,17 @@ func (t *Controller) ResponseJSON(data interface{}, code ...int) {
 		"result":  result,
 	}
 
-	logger.Info("请求反馈: ", fmt.Sprintf("%v", mapData))
+	// result 可能是 token 等敏感内容, 不记录
+	logger.Info("请求反馈: ", strconv.Itoa(status)+" "+message)
 
 	rtn, err := json.Marshal(mapData)
 	if err != nil {
 		logger.Error("转换待返回数据失败: " + err.Error())
-		// t.Output.Write([]byte("内部错误"))
-		// t.Output.WriteHeader(http.StatusInternalServerError)
 		http.Error(t.Output, "转换待返回数据失败", http.StatusInternalServerError)
-	} else {
-		t.Output.Header().Set("Content-Type", "application/json")
-		t.Output.WriteHeader(http.StatusOK)
-		t.Output.Write(rtn)
+		return
 	}
 
-	panic("")
+	t.Output.Header().Set("Content-Type", "application/json")
+	t.Output.WriteHeader(status)
+	t.Output.Write(rtn)
 }
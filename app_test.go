@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/tinylogger"
+	"github.com/zjxpcyc/wechat-scheduler/database"
+	"github.com/zjxpcyc/wechat-scheduler/jobs"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+	"github.com/zjxpcyc/wechat-scheduler/wechattest"
+)
+
+func TestMain(m *testing.M) {
+	if err := database.Init(database.NewMemoryStore()); err != nil {
+		panic(err)
+	}
+
+	// 与 main 一样初始化任务列表, 存储为空, 只是为了初始化 jobs 的日志
+	jobs.Init(jobs.NewRegistry())
+
+	os.Exit(m.Run())
+}
+
+// logSink 记录所有日志, 用于检查日志内容
+type logSink struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *logSink) write(level string, v []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, level+" "+fmt.Sprint(v...))
+}
+
+func (l *logSink) Info(v ...interface{})    { l.write("INFO", v) }
+func (l *logSink) Warning(v ...interface{}) { l.write("WARN", v) }
+func (l *logSink) Error(v ...interface{})   { l.write("ERROR", v) }
+func (l *logSink) Debug(v ...interface{})   { l.write("DEBUG", v) }
+
+func (l *logSink) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return strings.Join(l.lines, "\n")
+}
+
+// captureLog 测试期间的日志写入 logSink
+func captureLog(t *testing.T) *logSink {
+	sink := &logSink{}
+	lib.SetOutput(sink)
+	t.Cleanup(func() { lib.SetOutput(new(tinylogger.Logger)) })
+
+	return sink
+}
+
+// serve 请求 app, body 不为 nil 时编码为 json
+func serve(t *testing.T, app *App, method, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	app.ServeHTTP(w, httptest.NewRequest(method, path, &buf))
+
+	return w
+}
+
+// call 请求 app, 返回状态码及响应内容
+func call(t *testing.T, app *App, method, path string, body interface{}) (int, string) {
+	t.Helper()
+
+	w := serve(t, app, method, path, body)
+	return w.Code, w.Body.String()
+}
+
+// response 响应内容
+type response struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Result  json.RawMessage `json:"result"`
+}
+
+// decode 解析响应内容, 并检查 code 与 http 状态码一致
+func decode(t *testing.T, w *httptest.ResponseRecorder) response {
+	t.Helper()
+
+	res := response{}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("响应内容不是 json: %s", w.Body.String())
+	}
+
+	if res.Code != w.Code {
+		t.Fatalf("响应内容中的 code 与状态码不一致: %d %s", w.Code, w.Body.String())
+	}
+
+	return res
+}
+
+// newWechat 启动模拟的微信接口, 之后创建的任务都请求模拟服务
+func newWechat(t *testing.T) *wechattest.Server {
+	srv := wechattest.NewServer()
+	jobs.BaseURL = srv.URL
+	t.Cleanup(func() {
+		jobs.BaseURL = jobs.DEFAULT_BASE_URL
+		srv.Close()
+	})
+
+	return srv
+}
+
+// TestNoSecretsInLog 注册, 查询, 上报失效, 刷新及添加回调时, 日志中没有任何密钥及 token
+func TestNoSecretsInLog(t *testing.T) {
+	srv := newWechat(t)
+
+	const (
+		appid        = "wx-no-secrets-in-log"
+		appsecret    = "APPSECRET-0123456789abcdef"
+		notifySecret = "NOTIFY-SECRET-0123456789"
+		addSecret    = "ADD-NOTIFY-SECRET-0123456789"
+	)
+	srv.AddApp(appid, appsecret)
+
+	// 连续上报失效
+	interval := jobs.InvalidInterval
+	jobs.InvalidInterval = 0
+	t.Cleanup(func() { jobs.InvalidInterval = interval })
+
+	notified := make(chan struct{}, 1)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case notified <- struct{}{}:
+		default:
+		}
+	}))
+	t.Cleanup(sub.Close)
+
+	sink := captureLog(t)
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	code, res := call(t, app, http.MethodPost, "/registe", RegisteParam{
+		AppID:        appid,
+		AppSecret:    appsecret,
+		NotifySecret: notifySecret,
+		Tasks:        []RegisteTask{{Typ: jobs.JOB_ACCESS_TOKEN, Notify: sub.URL + "/a"}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("注册失败: %d %s\n%s", code, res, sink)
+	}
+
+	path := "/task/" + appid + "/0"
+	deadline := time.Now().Add(5 * time.Second)
+	for st, _ := reg.State(appid, jobs.JOB_ACCESS_TOKEN); st.Value == ""; st, _ = reg.State(appid, jobs.JOB_ACCESS_TOKEN) {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时: 获取 access_token")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	tokens := []string{}
+	for i := 0; i < 2; i++ {
+		st, err := reg.State(appid, jobs.JOB_ACCESS_TOKEN)
+		if err != nil || st.Value == "" {
+			t.Fatalf("查询失败: %v", err)
+		}
+		tokens = append(tokens, st.Value)
+
+		if code, res := call(t, app, http.MethodGet, path, nil); code != http.StatusOK {
+			t.Fatalf("查询失败: %d %s", code, res)
+		}
+
+		// 上报的 token 由业务系统通过 body 传入
+		srv.Invalidate(appid)
+		if code, res := call(t, app, http.MethodPost, path+"/invalid", InvalidParam{Value: st.Value, ErrCode: 40001}); code != http.StatusOK {
+			t.Fatalf("上报失效失败: %d %s", code, res)
+		}
+	}
+
+	if code, res := call(t, app, http.MethodPost, path+"/refresh", nil); code != http.StatusOK {
+		t.Fatalf("刷新失败: %d %s", code, res)
+	}
+
+	if code, res := call(t, app, http.MethodPost, path+"/notify", NotifyParam{URL: sub.URL + "/b", Secret: addSecret}); code != http.StatusOK {
+		t.Fatalf("添加回调失败: %d %s", code, res)
+	}
+
+	select {
+	case <-notified:
+	case <-time.After(5 * time.Second):
+		t.Fatal("等待超时: 回调")
+	}
+
+	st, _ := reg.State(appid, jobs.JOB_ACCESS_TOKEN)
+	tokens = append(tokens, st.Value)
+
+	log := sink.String()
+	if !strings.Contains(log, "收到请求") {
+		t.Fatalf("没有记录请求: %s", log)
+	}
+
+	for _, secret := range append([]string{appsecret, notifySecret, addSecret}, tokens...) {
+		if strings.Contains(log, secret) {
+			t.Fatalf("日志中出现了 %s:\n%s", secret, log)
+		}
+	}
+}
+
+// TestClosing 关闭期间所有修改数据的请求返回 503, 查询不受影响
+func TestClosing(t *testing.T) {
+	srv := wechattest.NewServer()
+	jobs.BaseURL = srv.URL
+	t.Cleanup(func() {
+		jobs.BaseURL = jobs.DEFAULT_BASE_URL
+		srv.Close()
+	})
+
+	appid := "wx-closing"
+	srv.AddApp(appid, "secret-"+appid)
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	code, res := call(t, app, http.MethodPost, "/registe", RegisteParam{
+		AppID:     appid,
+		AppSecret: "secret-" + appid,
+		Tasks:     []RegisteTask{{Typ: jobs.JOB_ACCESS_TOKEN}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("注册失败: %d %s", code, res)
+	}
+
+	app.Close()
+
+	path := "/task/" + appid + "/0"
+	for _, req := range [][2]string{
+		{http.MethodPost, "/registe"},
+		{http.MethodDelete, "/registe/" + appid},
+		{http.MethodDelete, path},
+		{http.MethodPost, path + "/refresh"},
+		{http.MethodPost, path + "/invalid"},
+		{http.MethodPost, path + "/notify"},
+		{http.MethodDelete, path + "/notify?url=http://127.0.0.1/cb"},
+	} {
+		if code, res := call(t, app, req[0], req[1], nil); code != http.StatusServiceUnavailable {
+			t.Fatalf("关闭期间 %s %s 应当返回 503: %d %s", req[0], req[1], code, res)
+		}
+	}
+
+	if _, ok := reg.Job(appid); !ok {
+		t.Fatal("关闭期间的删除请求不应当生效")
+	}
+
+	for _, p := range []string{path, "/jobs", "/jobs/" + appid} {
+		if code, res := call(t, app, http.MethodGet, p, nil); code != http.StatusOK {
+			t.Fatalf("关闭期间查询 %s 应当成功: %d %s", p, code, res)
+		}
+	}
+}
+
+// TestUnregisteDependency 其他任务依赖于要删除的任务时返回 409
+func TestUnregisteDependency(t *testing.T) {
+	appid := "wx-unregiste-dependency"
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	j, err := reg.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, typ := range []int{jobs.JOB_ACCESS_TOKEN, jobs.JOB_JSAPI_TICKET} {
+		if _, err := j.NewTask(typ, "", "", "", nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code, res := call(t, app, http.MethodDelete, "/task/"+appid+"/0", nil); code != http.StatusConflict {
+		t.Fatalf("删除被依赖的任务应当返回 409: %d %s", code, res)
+	}
+
+	if code, res := call(t, app, http.MethodDelete, "/task/"+appid+"/2", nil); code != http.StatusOK {
+		t.Fatalf("删除失败: %d %s", code, res)
+	}
+
+	if code, res := call(t, app, http.MethodDelete, "/task/"+appid+"/0", nil); code != http.StatusOK {
+		t.Fatalf("删除失败: %d %s", code, res)
+	}
+
+	if _, ok := reg.Job(appid); ok {
+		t.Fatal("没有剩余任务时应当删除 appid")
+	}
+}
+
+// TestRouting 依据请求方式及路径匹配路由, 不存在的地址返回 404, 请求方式不对返回 405 及允许的方式
+func TestRouting(t *testing.T) {
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+
+	notFound := [][2]string{
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/unknown"},
+		{http.MethodPost, "/foo/task/registe"},
+		{http.MethodGet, "/task/wx123"},
+		{http.MethodGet, "/task/wx123/0/unknown"},
+		{http.MethodGet, "/jobs/wx123/0"},
+	}
+
+	for _, req := range notFound {
+		w := serve(t, app, req[0], req[1], nil)
+		if w.Code != http.StatusNotFound {
+			t.Fatalf("%s %s 应当返回 404: %d %s", req[0], req[1], w.Code, w.Body.String())
+		}
+		decode(t, w)
+	}
+
+	notAllowed := []struct {
+		method string
+		path   string
+		allow  string
+	}{
+		{http.MethodGet, "/registe", "POST"},
+		{http.MethodPut, "/registe", "POST"},
+		{http.MethodPost, "/registe/wx123", "DELETE"},
+		{http.MethodPut, "/task/wx123/0", "GET, DELETE"},
+		{http.MethodGet, "/task/wx123/0/refresh", "POST"},
+		{http.MethodGet, "/task/wx123/0/notify", "POST, DELETE"},
+		{http.MethodDelete, "/jobs", "GET"},
+	}
+
+	for _, c := range notAllowed {
+		w := serve(t, app, c.method, c.path, nil)
+		if w.Code != http.StatusMethodNotAllowed {
+			t.Fatalf("%s %s 应当返回 405: %d %s", c.method, c.path, w.Code, w.Body.String())
+		}
+
+		if got := w.Header().Get("Allow"); got != c.allow {
+			t.Fatalf("%s %s 的 Allow: 期望 %s, 实际 %s", c.method, c.path, c.allow, got)
+		}
+		decode(t, w)
+	}
+}
+
+// TestLegacyRoutes 原有的 /registe 及 /task/:appid/:type 地址继续可用, 错误响应的 code 与状态码一致
+func TestLegacyRoutes(t *testing.T) {
+	appid := "wx-legacy-routes"
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	// 没有任务时只校验参数
+	w := serve(t, app, http.MethodPost, "/registe", RegisteParam{AppID: appid, AppSecret: "secret-" + appid})
+	if w.Code != http.StatusOK {
+		t.Fatalf("注册失败: %d %s", w.Code, w.Body.String())
+	}
+	decode(t, w)
+
+	for _, body := range []interface{}{nil, RegisteParam{AppID: appid}} {
+		w := serve(t, app, http.MethodPost, "/registe", body)
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("注册参数不正确时应当返回 400: %d %s", w.Code, w.Body.String())
+		}
+
+		if res := decode(t, w); res.Message == "" {
+			t.Fatalf("错误响应应当带有原因: %s", w.Body.String())
+		}
+	}
+
+	j, err := reg.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk, err := j.NewTask(jobs.JOB_ACCESS_TOKEN, "", "", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tk.Refreshed(nil, map[string]interface{}{"access_token": "TOKEN", "expires_in": float64(7200)}, "TOKEN")
+
+	for _, path := range []string{"/task/" + appid + "/0", "/task/" + appid + "/0/"} {
+		w := serve(t, app, http.MethodGet, path, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("查询失败: %d %s", w.Code, w.Body.String())
+		}
+
+		if res := decode(t, w); string(res.Result) != `"TOKEN"` {
+			t.Fatalf("查询结果: 期望 TOKEN, 实际 %s", res.Result)
+		}
+	}
+
+	errs := map[string]int{
+		"/task/" + appid + "/x":  http.StatusBadRequest,
+		"/task/" + appid + "/9":  http.StatusBadRequest,
+		"/task/" + appid + "/2":  http.StatusNotFound,
+		"/task/wx-not-registe/0": http.StatusNotFound,
+	}
+
+	for path, code := range errs {
+		w := serve(t, app, http.MethodGet, path, nil)
+		if w.Code != code {
+			t.Fatalf("%s: 期望 %d, 实际 %d %s", path, code, w.Code, w.Body.String())
+		}
+		decode(t, w)
+	}
+}
+
+// TestInvalidateTask 上报失效返回刷新之后的值, 过于频繁时返回 429
+func TestInvalidateTask(t *testing.T) {
+	srv := newWechat(t)
+	api := wechattest.API_ACCESS_TOKEN
+
+	appid := "wx-invalidate-task"
+	srv.AddApp(appid, "secret-"+appid)
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	code, res := call(t, app, http.MethodPost, "/registe", RegisteParam{
+		AppID:     appid,
+		AppSecret: "secret-" + appid,
+		Tasks:     []RegisteTask{{Typ: jobs.JOB_ACCESS_TOKEN}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("注册失败: %d %s", code, res)
+	}
+
+	value := func() string {
+		st, _ := reg.State(appid, jobs.JOB_ACCESS_TOKEN)
+		return st.Value
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for value() == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时: 获取 access_token")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	path := "/task/" + appid + "/0/invalid"
+	old := value()
+
+	// 上报的值已经不是当前值, 直接返回当前值
+	w := serve(t, app, http.MethodPost, path, InvalidParam{Value: "EXPIRED", ErrCode: 40001})
+	if res := decode(t, w); w.Code != http.StatusOK || string(res.Result) != `"`+old+`"` || srv.Calls(api) != 1 {
+		t.Fatalf("上报的值不是当前值时应当直接返回当前值: %d %s, %d 次请求", w.Code, w.Body.String(), srv.Calls(api))
+	}
+
+	srv.Invalidate(appid)
+	w = serve(t, app, http.MethodPost, path, InvalidParam{Value: old, ErrCode: 40001})
+	if res := decode(t, w); w.Code != http.StatusOK || string(res.Result) != `"`+srv.AccessToken(appid)+`"` || srv.Calls(api) != 2 {
+		t.Fatalf("上报失效应当返回刷新之后的值: %d %s, %d 次请求", w.Code, w.Body.String(), srv.Calls(api))
+	}
+
+	// InvalidInterval 内再次上报当前值
+	w = serve(t, app, http.MethodPost, path, InvalidParam{Value: value(), ErrCode: 40001})
+	if w.Code != http.StatusTooManyRequests || srv.Calls(api) != 2 {
+		t.Fatalf("上报过于频繁应当返回 429: %d %s, %d 次请求", w.Code, w.Body.String(), srv.Calls(api))
+	}
+	decode(t, w)
+
+	errs := []struct {
+		path  string
+		param InvalidParam
+		code  int
+	}{
+		{path, InvalidParam{Value: value(), ErrCode: 45009}, http.StatusBadRequest},
+		{"/task/" + appid + "/x/invalid", InvalidParam{}, http.StatusBadRequest},
+		{"/task/" + appid + "/2/invalid", InvalidParam{}, http.StatusNotFound},
+		{"/task/wx-not-registe/0/invalid", InvalidParam{}, http.StatusNotFound},
+	}
+
+	for _, c := range errs {
+		w := serve(t, app, http.MethodPost, c.path, c.param)
+		if w.Code != c.code {
+			t.Fatalf("%s %v: 期望 %d, 实际 %d %s", c.path, c.param, c.code, w.Code, w.Body.String())
+		}
+		decode(t, w)
+	}
+
+	if got := srv.Calls(api); got != 2 {
+		t.Fatalf("参数不正确时不应当刷新: %d 次请求", got)
+	}
+}
+
+// TestRegisteInvalidRetry 重试策略不正确时返回 400, 不注册任何任务
+func TestRegisteInvalidRetry(t *testing.T) {
+	appid := "wx-registe-invalid-retry"
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	zero, small, negative := 0, 1, -2
+	lessThanOne := 0.5
+
+	for _, retry := range []jobs.RetryParam{
+		{Initial: &zero},
+		{Multiplier: &lessThanOne},
+		{Max: &small},
+		{Attempts: &negative},
+	} {
+		retry := retry
+		w := serve(t, app, http.MethodPost, "/registe", RegisteParam{
+			AppID:     appid,
+			AppSecret: "secret-" + appid,
+			Tasks:     []RegisteTask{{Typ: jobs.JOB_ACCESS_TOKEN}, {Typ: jobs.JOB_JSAPI_TICKET, Retry: &retry}},
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("重试策略 %s 应当返回 400: %d %s", retry.String(), w.Code, w.Body.String())
+		}
+
+		if res := decode(t, w); !strings.Contains(res.Message, "重试策略不正确") {
+			t.Fatalf("错误响应应当说明原因: %s", w.Body.String())
+		}
+
+		if _, ok := reg.Job(appid); ok {
+			t.Fatal("重试策略不正确时不应当注册")
+		}
+	}
+}
+
+// TestJobsNoSecrets 运维查询的结果中没有 appsecret, token 以及回调签名密钥, 回调地址中的敏感参数被隐去
+func TestJobsNoSecrets(t *testing.T) {
+	srv := newWechat(t)
+
+	const (
+		appid        = "wx-jobs-no-secrets"
+		appsecret    = "APPSECRET-0123456789abcdef"
+		notifySecret = "NOTIFY-SECRET-0123456789"
+		addSecret    = "ADD-NOTIFY-SECRET-0123456789"
+		urlSecret    = "URL-SECRET-0123456789"
+	)
+	srv.AddApp(appid, appsecret)
+
+	notified := make(chan struct{}, 2)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		notified <- struct{}{}
+	}))
+	t.Cleanup(sub.Close)
+
+	reg := jobs.NewRegistry()
+	app := NewApp(reg)
+	t.Cleanup(func() { reg.Remove(appid) })
+
+	code, res := call(t, app, http.MethodPost, "/registe", RegisteParam{
+		AppID:        appid,
+		AppSecret:    appsecret,
+		NotifySecret: notifySecret,
+		Tasks:        []RegisteTask{{Typ: jobs.JOB_ACCESS_TOKEN, Notify: sub.URL + "/a?secret=" + urlSecret}},
+	})
+	if code != http.StatusOK {
+		t.Fatalf("注册失败: %d %s", code, res)
+	}
+
+	path := "/task/" + appid + "/0/notify"
+	if code, res := call(t, app, http.MethodPost, path, NotifyParam{URL: sub.URL + "/b", Secret: addSecret}); code != http.StatusOK {
+		t.Fatalf("添加回调失败: %d %s", code, res)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatal("等待超时: 回调")
+		}
+	}
+
+	st, err := reg.State(appid, jobs.JOB_ACCESS_TOKEN)
+	if err != nil || st.Value == "" {
+		t.Fatalf("查询失败: %v", err)
+	}
+
+	for _, path := range []string{"/jobs", "/jobs/" + appid} {
+		code, res := call(t, app, http.MethodGet, path, nil)
+		if code != http.StatusOK {
+			t.Fatalf("查询失败: %d %s", code, res)
+		}
+
+		if !strings.Contains(res, appid) || !strings.Contains(res, "secret="+lib.REDACTED) {
+			t.Fatalf("%s 应当包含回调地址: %s", path, res)
+		}
+
+		for _, secret := range []string{appsecret, notifySecret, addSecret, urlSecret, st.Value} {
+			if strings.Contains(res, secret) {
+				t.Fatalf("%s 中出现了 %s:\n%s", path, secret, res)
+			}
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Package callback 校验本系统回调业务系统时的签名
+// 回调地址设置了密钥时, 回调的请求头中会带上 X-Timestamp, X-Nonce 及 X-Signature,
+// 业务系统可以据此确认回调来自本系统, 并且内容没有被篡改. 只依赖标准库, 可以直接在业务系统中使用
+//
+//	v := callback.NewVerifier("notify secret")
+//
+//	http.HandleFunc("/foo/bar", func(w http.ResponseWriter, r *http.Request) {
+//		body, err := v.Verify(r)
+//		if err != nil {
+//			w.WriteHeader(http.StatusUnauthorized)
+//			return
+//		}
+//		...
+//	})
+package callback
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 回调的签名请求头
+// X-Signature 为 hex(HMAC-SHA256(secret, TIMESTAMP\nNONCE\nAPPID\nTYPE\nBODY))
+// 其中 APPID 及 TYPE 为回调地址中的 appid, type 参数
+const (
+	HEADER_TIMESTAMP = "X-Timestamp"
+	HEADER_NONCE     = "X-Nonce"
+	HEADER_SIGNATURE = "X-Signature"
+)
+
+// WINDOW 回调的时间戳与业务系统时间允许的最大误差
+// 同时也是 nonce 的保存时间
+const WINDOW = 5 * time.Minute
+
+// ErrSignature 签名校验失败
+var ErrSignature = errors.New("回调签名校验失败")
+
+// Sign 计算回调签名
+func Sign(secret, timestamp, nonce, appid, typ string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n" + nonce + "\n" + appid + "\n" + typ + "\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest 为回调请求设置签名请求头
+// body 为请求的原始内容
+func SignRequest(h http.Header, secret, appid, typ string, body []byte) error {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce := hex.EncodeToString(b)
+
+	h.Set(HEADER_TIMESTAMP, ts)
+	h.Set(HEADER_NONCE, nonce)
+	h.Set(HEADER_SIGNATURE, Sign(secret, ts, nonce, appid, typ, body))
+	return nil
+}
+
+// Verifier 校验回调签名, 可以被多个协程同时使用
+type Verifier struct {
+	secret string
+
+	// Window 时间戳允许的最大误差, 默认 WINDOW
+	Window time.Duration
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+
+	// nextSweep 下次清理过期 nonce 的时间, 不必每次校验都遍历所有的 nonce
+	nextSweep time.Time
+}
+
+// NewVerifier 实例化签名校验, secret 为注册时指定的 notify_secret
+func NewVerifier(secret string) *Verifier {
+	return &Verifier{
+		secret: secret,
+		Window: WINDOW,
+		nonces: make(map[string]time.Time),
+	}
+}
+
+// Verify 校验回调请求, 返回请求的原始内容
+// 读取之后 r.Body 仍然可以再次读取
+func (v *Verifier) Verify(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Body.Close()
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	ts := r.Header.Get(HEADER_TIMESTAMP)
+	nonce := r.Header.Get(HEADER_NONCE)
+	sign := r.Header.Get(HEADER_SIGNATURE)
+	if ts == "" || nonce == "" || sign == "" {
+		return nil, ErrSignature
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrSignature
+	}
+
+	now := time.Now()
+	diff := now.Sub(time.Unix(sec, 0))
+	if diff > v.Window || diff < -v.Window {
+		return nil, ErrSignature
+	}
+
+	q := r.URL.Query()
+	expect := Sign(v.secret, ts, nonce, q.Get("appid"), q.Get("type"), body)
+	if !hmac.Equal([]byte(sign), []byte(expect)) {
+		return nil, ErrSignature
+	}
+
+	// 防止重放
+	if !v.useNonce(nonce, now) {
+		return nil, ErrSignature
+	}
+
+	return body, nil
+}
+
+// Handler 校验通过之后才交给 next 处理, 否则返回 401
+func (v *Verifier) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, err := v.Verify(r); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// useNonce nonce 在有效期内未被使用过时返回 true
+// 过期的 nonce 每隔 Window 清理一次
+func (v *Verifier) useNonce(nonce string, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if !now.Before(v.nextSweep) {
+		v.sweep(now)
+		v.nextSweep = now.Add(v.Window)
+	}
+
+	if t, ok := v.nonces[nonce]; ok && now.Sub(t) <= 2*v.Window {
+		return false
+	}
+
+	v.nonces[nonce] = now
+	return true
+}
+
+// sweep 清理已经过期的 nonce
+// 调用方需持有 v.mu
+func (v *Verifier) sweep(now time.Time) {
+	for k, t := range v.nonces {
+		if now.Sub(t) > 2*v.Window {
+			delete(v.nonces, k)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package callback
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const SECRET = "notify-secret-0123456789"
+
+// newRequest 使用 secret 签名的回调请求
+func newRequest(t *testing.T, secret string, body []byte) *http.Request {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodPost, "/foo/bar?appid=wx123&type=0", bytes.NewReader(body))
+	if err := SignRequest(r.Header, secret, "wx123", "0", body); err != nil {
+		t.Fatal(err)
+	}
+
+	return r
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"access_token":"TOKEN"}`)
+
+	cases := []struct {
+		name   string
+		modify func(r *http.Request)
+		secret string
+		ok     bool
+	}{
+		{"正确的签名", nil, SECRET, true},
+		{"密钥不正确", nil, SECRET + "-other", false},
+		{"内容被篡改", func(r *http.Request) {
+			r.Body = httptest.NewRequest(http.MethodPost, "/", bytes.NewReader([]byte(`{}`))).Body
+		}, SECRET, false},
+		{"appid 被篡改", func(r *http.Request) { r.URL.RawQuery = "appid=wx456&type=0" }, SECRET, false},
+		{"没有签名", func(r *http.Request) { r.Header.Del(HEADER_SIGNATURE) }, SECRET, false},
+		{"时间戳过期", func(r *http.Request) {
+			ts := strconv.FormatInt(time.Now().Add(-2*WINDOW).Unix(), 10)
+			r.Header.Set(HEADER_TIMESTAMP, ts)
+			r.Header.Set(HEADER_SIGNATURE, Sign(SECRET, ts, r.Header.Get(HEADER_NONCE), "wx123", "0", body))
+		}, SECRET, false},
+	}
+
+	for _, c := range cases {
+		v := NewVerifier(SECRET)
+
+		r := newRequest(t, c.secret, body)
+		if c.modify != nil {
+			c.modify(r)
+		}
+
+		got, err := v.Verify(r)
+		if c.ok != (err == nil) {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		if c.ok && !bytes.Equal(got, body) {
+			t.Fatalf("%s: 返回的内容 %s", c.name, got)
+		}
+	}
+}
+
+// TestVerifyReplay 同一个回调请求只能校验通过一次
+func TestVerifyReplay(t *testing.T) {
+	v := NewVerifier(SECRET)
+	body := []byte(`{"access_token":"TOKEN"}`)
+
+	r := newRequest(t, SECRET, body)
+	if _, err := v.Verify(r); err != nil {
+		t.Fatal(err)
+	}
+
+	replay := httptest.NewRequest(http.MethodPost, r.URL.String(), bytes.NewReader(body))
+	replay.Header = r.Header
+	if _, err := v.Verify(replay); err != ErrSignature {
+		t.Fatalf("重放的回调应当校验失败: %v", err)
+	}
+}
+
+// TestNonceSweep 过期的 nonce 每隔 Window 清理一次, 不会在每次校验时清理
+func TestNonceSweep(t *testing.T) {
+	v := NewVerifier(SECRET)
+	v.Window = time.Minute
+
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		if !v.useNonce(strconv.Itoa(i), now) {
+			t.Fatalf("nonce %d 未被使用过", i)
+		}
+	}
+
+	if v.useNonce("0", now.Add(time.Second)) {
+		t.Fatal("nonce 在有效期内不能重复使用")
+	}
+
+	// 已经过期, 但是还没有到下次清理的时间
+	later := now.Add(2*v.Window + time.Second)
+	v.nextSweep = later.Add(time.Second)
+
+	v.useNonce("a", later)
+	if len(v.nonces) != 101 {
+		t.Fatalf("没有到清理时间时不应当清理: %d", len(v.nonces))
+	}
+
+	// 过期的 nonce 可以再次使用, 对应的请求会因为时间戳过期而校验失败
+	if !v.useNonce("0", later) {
+		t.Fatal("过期的 nonce 应当可以再次使用")
+	}
+
+	v.useNonce("b", later.Add(time.Second))
+	if len(v.nonces) != 3 {
+		t.Fatalf("到了清理时间应当清理过期的 nonce: %d", len(v.nonces))
+	}
+
+	if v.useNonce("a", later.Add(time.Second)) {
+		t.Fatal("清理之后未过期的 nonce 仍然不能重复使用")
+	}
+
+	if want := later.Add(time.Second + v.Window); !v.nextSweep.Equal(want) {
+		t.Fatalf("下次清理时间: 期望 %s, 实际 %s", want, v.nextSweep)
+	}
+}
@@ -0,0 +1,220 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/tidwall/buntdb"
+)
+
+// BuntStore buntdb 存储
+// 每个 appid 对应目录下的一个 <appid>.db 文件
+type BuntStore struct {
+	dir string
+
+	mu  sync.Mutex
+	dbs map[string]*buntdb.DB
+}
+
+// NewBuntStore 初始化 buntdb 存储, 目录不存在则创建
+func NewBuntStore(dir string) (*BuntStore, error) {
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(dir, 0700); err != nil {
+				return nil, err
+			}
+		} else {
+			return nil, err
+		}
+	}
+
+	return &BuntStore{
+		dir: dir,
+		dbs: make(map[string]*buntdb.DB),
+	}, nil
+}
+
+// db 获取 appid 对应的数据库, 未打开时打开
+// create 为 false 时, 文件不存在则返回 ErrNotFound, 避免查询时创建出空文件
+func (s *BuntStore) db(appid string, create bool) (*buntdb.DB, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if db, ok := s.dbs[appid]; ok {
+		return db, nil
+	}
+
+	p := filepath.Join(s.dir, appid+".db")
+	if !create {
+		if _, err := os.Stat(p); os.IsNotExist(err) {
+			return nil, ErrNotFound
+		}
+	}
+
+	db, err := buntdb.Open(p)
+	if err != nil {
+		return nil, err
+	}
+
+	s.dbs[appid] = db
+	return db, nil
+}
+
+// Get 实现 Store
+func (s *BuntStore) Get(appid, key string) (result string, err error) {
+	db, err := s.db(appid, false)
+	if err != nil {
+		return "", err
+	}
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		result, err = buntTx{tx}.Get(key)
+		return err
+	})
+
+	return
+}
+
+// Set 实现 Store
+func (s *BuntStore) Set(appid, key, val string) error {
+	return s.Update(appid, func(tx Tx) error {
+		return tx.Set(key, val)
+	})
+}
+
+// Delete 实现 Store
+func (s *BuntStore) Delete(appid, key string) error {
+	return s.Update(appid, func(tx Tx) error {
+		return tx.Delete(key)
+	})
+}
+
+// List 实现 Store
+func (s *BuntStore) List(appid, prefix string) (map[string]string, error) {
+	res := make(map[string]string)
+
+	db, err := s.db(appid, false)
+	if err == ErrNotFound {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(k, v string) bool {
+			if strings.HasPrefix(k, prefix) {
+				res[k] = v
+			}
+			return true
+		})
+	})
+
+	return res, err
+}
+
+// Update 实现 Store
+func (s *BuntStore) Update(appid string, fn func(tx Tx) error) error {
+	db, err := s.db(appid, true)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *buntdb.Tx) error {
+		return fn(buntTx{tx})
+	})
+}
+
+// AppIDs 实现 Store
+// 遍历目录下所有 .db 结尾的文件
+func (s *BuntStore) AppIDs() ([]string, error) {
+	appids := make([]string, 0)
+
+	err := filepath.Walk(s.dir, func(f string, info os.FileInfo, err error) error {
+		if err != nil || info == nil {
+			return err
+		}
+
+		if info.IsDir() {
+			if f != s.dir {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		ext := filepath.Ext(f)
+		if ext == ".db" {
+			appids = append(appids, strings.TrimSuffix(info.Name(), ext))
+		}
+
+		return nil
+	})
+
+	return appids, err
+}
+
+// Drop 实现 Store
+// 关闭并删除 appid 对应的 .db 文件
+func (s *BuntStore) Drop(appid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if db, ok := s.dbs[appid]; ok {
+		if err := db.Close(); err != nil {
+			return err
+		}
+		delete(s.dbs, appid)
+	}
+
+	err := os.Remove(filepath.Join(s.dir, appid+".db"))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
+
+// Close 实现 Store
+func (s *BuntStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	for appid, db := range s.dbs {
+		if e := db.Close(); e != nil {
+			err = e
+		}
+		delete(s.dbs, appid)
+	}
+
+	return err
+}
+
+type buntTx struct {
+	tx *buntdb.Tx
+}
+
+func (t buntTx) Get(key string) (string, error) {
+	v, err := t.tx.Get(key)
+	if err == buntdb.ErrNotFound {
+		return "", ErrNotFound
+	}
+
+	return v, err
+}
+
+func (t buntTx) Set(key, val string) error {
+	_, _, err := t.tx.Set(key, val, nil)
+	return err
+}
+
+func (t buntTx) Delete(key string) error {
+	_, err := t.tx.Delete(key)
+	if err == buntdb.ErrNotFound {
+		return nil
+	}
+
+	return err
+}
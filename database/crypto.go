@@ -0,0 +1,341 @@
+package database
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// 加密存储
+// 每条记录使用随机生成的数据密钥进行 AES-GCM 加密, 数据密钥再使用 master key 加密之后与密文一起保存(信封加密)
+// 保存的格式为 enc:v2:<master key 标识>:<加密之后的数据密钥>:<密文>
+// 两次加密都以 appid 及 key 作为附加数据, 密文不能被复制到其他 key 或者 appid 下使用
+const (
+	// ENC_PREFIX 加密之后的值的前缀, 没有此前缀的值视为明文
+	ENC_PREFIX = "enc:"
+
+	// ENC_VERSION 当前的加密格式
+	ENC_VERSION = "v2"
+
+	// MASTER_KEY_ENV 读取 master key 的环境变量
+	MASTER_KEY_ENV = "WECHAT_SCHEDULER_MASTER_KEY"
+
+	// OLD_MASTER_KEY_ENV 轮换 master key 时, 读取旧 master key 的环境变量
+	OLD_MASTER_KEY_ENV = "WECHAT_SCHEDULER_OLD_MASTER_KEY"
+)
+
+// ErrEncrypted 数据已经加密, 但是没有指定对应的 master key
+var ErrEncrypted = errors.New("数据已加密, 请指定对应的 master key")
+
+// crypter 当前使用的加解密, nil 代表不加密
+var crypter *Cipher
+
+// SetCipher 设置加解密, 需要在 Init 之前调用
+// 设置之后敏感字段加密保存, Init 时已有的明文以及使用旧 master key 加密的数据会被重新加密
+func SetCipher(c *Cipher) {
+	crypter = c
+}
+
+// IsSensitiveKey key 对应的值是否需要加密保存
+// 包括 appsecret, 回调签名密钥, 任务的结果(token, ticket, refresh_token 等), 以及待投递的回调
+func IsSensitiveKey(key string) bool {
+	if key == "appsecret" {
+		return true
+	}
+
+	if !strings.HasPrefix(key, "task-") {
+		return false
+	}
+
+	switch {
+	case strings.HasSuffix(key, "-value"), strings.HasSuffix(key, "-result"):
+		return true
+	case strings.Contains(key, "-notify"):
+		// 待投递的回调, 不包括投递记录
+		return !strings.HasSuffix(key, "-history")
+	}
+
+	return false
+}
+
+// Cipher 对敏感字段进行加解密
+type Cipher struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// NewCipher 实例化加解密
+// current 为当前的 master key, 用于加密; old 为之前使用过的 master key, 仅用于解密, 以便轮换
+// master key 必须是 32 字节
+func NewCipher(current []byte, old ...[]byte) (*Cipher, error) {
+	c := &Cipher{keys: make(map[string]cipher.AEAD)}
+
+	for i, key := range append([][]byte{current}, old...) {
+		id, aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+
+		if i == 0 {
+			c.current = id
+		}
+
+		if _, ok := c.keys[id]; !ok {
+			c.keys[id] = aead
+		}
+	}
+
+	return c, nil
+}
+
+func newAEAD(key []byte) (string, cipher.AEAD, error) {
+	if len(key) != 32 {
+		return "", nil, errors.New("master key 必须是 32 字节")
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return "", nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", nil, err
+	}
+
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:4]), aead, nil
+}
+
+// LoadMasterKey 读取 base64 编码的 master key
+// file 不为空时从文件读取, 否则从环境变量 env 读取; 都没有时返回 nil
+func LoadMasterKey(file, env string) ([]byte, error) {
+	var encoded string
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		encoded = string(data)
+	} else {
+		encoded = os.Getenv(env)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("master key 必须是 base64 编码: " + err.Error())
+	}
+
+	return key, nil
+}
+
+// Encrypt 使用当前的 master key 加密 appid 下 key 对应的值
+func (c *Cipher) Encrypt(appid, key, plain string) (string, error) {
+	kek := c.keys[c.current]
+	ad := additionalData(appid, key)
+
+	// 数据密钥
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+
+	wrapped, err := seal(kek, dek, ad)
+	if err != nil {
+		return "", err
+	}
+
+	_, aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := seal(aead, []byte(plain), ad)
+	if err != nil {
+		return "", err
+	}
+
+	return ENC_PREFIX + ENC_VERSION + ":" + c.current + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// Decrypt 解密 appid 下 key 对应的值, 明文原样返回
+// 从其他 key 或者 appid 复制过来的密文解密失败
+func (c *Cipher) Decrypt(appid, key, s string) (string, error) {
+	if !IsEncrypted(s) {
+		return s, nil
+	}
+
+	parts := strings.Split(strings.TrimPrefix(s, ENC_PREFIX), ":")
+	if len(parts) != 4 {
+		return "", errors.New("加密数据格式不正确")
+	}
+
+	if parts[0] != ENC_VERSION {
+		return "", errors.New("不支持的加密格式: " + parts[0])
+	}
+
+	ad := additionalData(appid, key)
+
+	kek, ok := c.keys[parts[1]]
+	if !ok {
+		return "", ErrEncrypted
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", err
+	}
+
+	data, err := base64.StdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", err
+	}
+
+	dek, err := open(kek, wrapped, ad)
+	if err != nil {
+		return "", err
+	}
+
+	_, aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := open(aead, data, ad)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+// Stale s 是否需要使用当前的 master key 重新加密
+// 明文, 以及使用旧 master key 加密的值都需要
+func (c *Cipher) Stale(s string) bool {
+	return !strings.HasPrefix(s, ENC_PREFIX+ENC_VERSION+":"+c.current+":")
+}
+
+// IsEncrypted s 是否为加密之后的值
+func IsEncrypted(s string) bool {
+	return strings.HasPrefix(s, ENC_PREFIX)
+}
+
+// additionalData 加密时的附加数据, 将密文与 appid 及 key 绑定
+func additionalData(appid, key string) []byte {
+	return []byte(appid + "\x00" + key)
+}
+
+// seal 加密, 返回 nonce + 密文
+func seal(aead cipher.AEAD, plain, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+// open 解密 seal 的结果, ad 需要与加密时一致
+func open(aead cipher.AEAD, data, ad []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("加密数据格式不正确")
+	}
+
+	nonce, ct := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ct, ad)
+}
+
+// encrypt 敏感字段使用当前的 master key 加密, 未设置加解密时原样返回
+func encrypt(appid, key, val string) (string, error) {
+	if crypter == nil || val == "" || !IsSensitiveKey(key) {
+		return val, nil
+	}
+
+	return crypter.Encrypt(appid, key, val)
+}
+
+// decrypt 解密, 明文原样返回
+func decrypt(appid, key, val string) (string, error) {
+	if !IsEncrypted(val) {
+		return val, nil
+	}
+
+	if crypter == nil {
+		return "", ErrEncrypted
+	}
+
+	return crypter.Decrypt(appid, key, val)
+}
+
+// migrate 将 appid 下的敏感字段使用当前的 master key 重新加密
+// 包括旧版本的明文数据, 以及使用旧 master key 加密的数据
+// 未设置加解密时, 如果存在加密的数据则返回 ErrEncrypted
+func migrate(s Store, appid string) (int, error) {
+	all, err := s.List(appid, "")
+	if err != nil {
+		return 0, err
+	}
+
+	stale := make([]string, 0)
+	for k, v := range all {
+		if crypter == nil {
+			if IsEncrypted(v) {
+				return 0, ErrEncrypted
+			}
+
+			continue
+		}
+
+		if v != "" && IsSensitiveKey(k) && crypter.Stale(v) {
+			stale = append(stale, k)
+		}
+	}
+
+	if len(stale) == 0 {
+		return 0, nil
+	}
+
+	err = s.Update(appid, func(tx Tx) error {
+		for _, k := range stale {
+			v, err := tx.Get(k)
+			if err != nil {
+				return err
+			}
+
+			plain, err := decrypt(appid, k, v)
+			if err != nil {
+				return err
+			}
+
+			enc, err := crypter.Encrypt(appid, k, plain)
+			if err != nil {
+				return err
+			}
+
+			if err := tx.Set(k, enc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return len(stale), nil
+}
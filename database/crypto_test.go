@@ -0,0 +1,104 @@
+package database
+
+import (
+	"crypto/rand"
+	"io"
+	"strings"
+	"testing"
+)
+
+// newCipher 随机生成 master key 的加解密
+func newCipher(t *testing.T) *Cipher {
+	t.Helper()
+
+	key := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// TestCipherBinding 密文与 appid 及 key 绑定, 复制到其他位置之后解密失败
+func TestCipherBinding(t *testing.T) {
+	c := newCipher(t)
+
+	enc, err := c.Encrypt("wx-a", "appsecret", "SECRET")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(enc, ENC_PREFIX+ENC_VERSION+":") || c.Stale(enc) {
+		t.Fatalf("加密格式不正确: %s", enc)
+	}
+
+	if plain, err := c.Decrypt("wx-a", "appsecret", enc); err != nil || plain != "SECRET" {
+		t.Fatalf("解密失败: %s %v", plain, err)
+	}
+
+	for _, at := range [][2]string{
+		{"wx-b", "appsecret"},
+		{"wx-a", "task-0-value"},
+		{"wx-a\x00appsecret", ""},
+	} {
+		if _, err := c.Decrypt(at[0], at[1], enc); err == nil {
+			t.Fatalf("复制到 %q %q 的密文不应当解密成功", at[0], at[1])
+		}
+	}
+}
+
+// TestCipherSwap 在存储中交换两个 appid 的密文, 读取时失败而不是返回对方的值
+func TestCipherSwap(t *testing.T) {
+	s := NewMemoryStore()
+	if err := Init(s); err != nil {
+		t.Fatal(err)
+	}
+
+	SetCipher(newCipher(t))
+	defer func() {
+		SetCipher(nil)
+		store = nil
+	}()
+
+	a, err := NewModel("wx-swap-a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveModel(a.AppID)
+
+	b, err := NewModel("wx-swap-b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveModel(b.AppID)
+
+	a.Update("appsecret", "SECRET-A")
+	b.Update("appsecret", "SECRET-B")
+	a.Update("task-0-value", "TOKEN-A")
+
+	encA, _ := s.Get(a.AppID, "appsecret")
+	encB, _ := s.Get(b.AppID, "appsecret")
+
+	s.Set(a.AppID, "appsecret", encB)
+	if v, err := a.Query("appsecret"); err == nil {
+		t.Fatalf("其他 appid 的密文不应当解密成功: %s", v)
+	}
+
+	s.Set(a.AppID, "task-0-value", encA)
+	if v, err := a.Query("task-0-value"); err == nil {
+		t.Fatalf("其他 key 的密文不应当解密成功: %s", v)
+	}
+
+	err = a.Tx(func(tx Tx) error {
+		_, err := tx.Get("task-0-value")
+		return err
+	})
+	if err == nil {
+		t.Fatal("事务中读取其他 key 的密文不应当成功")
+	}
+}
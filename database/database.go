@@ -1,69 +1,55 @@
 package database
 
 import (
-	"os"
-	"path/filepath"
-	"strings"
+	"errors"
+	"strconv"
 
 	"github.com/zjxpcyc/tinylogger"
 	"github.com/zjxpcyc/wechat-scheduler/lib"
-
-	"github.com/tidwall/buntdb"
 )
 
-// DBDir 存放数据库文件
+// DBDir 默认的数据存放目录
 const DBDir = "./database"
 
 var logger tinylogger.LogService
 
-// NewDB 初始化数据库引擎
-func NewDB(appid string) (*buntdb.DB, error) {
-	if m, ok := AllModel[appid]; ok {
-		return m.GetDB(), nil
-	}
+// store 当前系统使用的存储
+var store Store
 
-	p := DBDir + "/" + appid + ".db"
-	return buntdb.Open(p)
+// GetStore 获取当前系统使用的存储
+func GetStore() Store {
+	return store
 }
 
 // Init 初始启动
-// 遍历当前 database 目录下面所有 .db 结尾的文件
-func Init() error {
+// 使用 s 作为系统存储, 并为其中所有的 appid 初始化 Model
+func Init(s Store) error {
 	logger = lib.GetLogger()
 	logger.Info("开始进行 Model 初始化 ...")
 
-	// 目录不存在, 则创建
-	if _, err := os.Stat(DBDir); err != nil {
-		if os.IsNotExist(err) {
-			if err = os.Mkdir(DBDir, 0700); err != nil {
-				return err
-			}
-		} else {
-			return err
-		}
+	store = s
+
+	appids, err := s.AppIDs()
+	if err != nil {
+		return err
 	}
 
-	// 遍历目录下所有 .db 文件
-	return filepath.Walk(DBDir, func(f string, info os.FileInfo, err error) error {
-		if err != nil || info == nil {
+	for _, appid := range appids {
+		logger.Info("初始化 Model ", appid)
+
+		if _, err := NewModel(appid); err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			return nil
+		n, err := migrate(s, appid)
+		if err != nil {
+			return errors.New("迁移 " + appid + " 的数据失败: " + err.Error())
 		}
 
-		ext := filepath.Ext(f)
-		if ext == ".db" {
-			_, fname := filepath.Split(filepath.ToSlash(f))
-			appid := strings.TrimSuffix(fname, ext)
-			logger.Info(fname, appid)
-
-			if _, err := NewModel(appid); err != nil {
-				return err
-			}
+		if n > 0 {
+			logger.Info("已重新加密 " + appid + " 的 " + strconv.Itoa(n) + " 条数据")
 		}
+	}
 
-		return nil
-	})
+	return nil
 }
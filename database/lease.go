@@ -0,0 +1,88 @@
+package database
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LEASE_KEY 租约在 appid 下的 key
+const LEASE_KEY = "lease"
+
+// Leaser 原生支持租约的存储, 比如 Redis
+// 不支持的存储通过事务实现租约
+type Leaser interface {
+	AcquireLease(appid, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(appid, owner string) error
+}
+
+// AcquireLease 获取或者续期 appid 的租约
+// 租约无人持有、已经过期, 或者本身就由 owner 持有时, 返回 true
+func AcquireLease(s Store, appid, owner string, ttl time.Duration) (bool, error) {
+	if l, ok := s.(Leaser); ok {
+		return l.AcquireLease(appid, owner, ttl)
+	}
+
+	acquired := false
+	err := s.Update(appid, func(tx Tx) error {
+		acquired = false
+		now := time.Now()
+
+		v, err := tx.Get(LEASE_KEY)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		holder, expire := parseLease(v)
+		if holder != "" && holder != owner && now.Before(expire) {
+			return nil
+		}
+
+		acquired = true
+		return tx.Set(LEASE_KEY, formatLease(owner, now.Add(ttl)))
+	})
+
+	return acquired, err
+}
+
+// ReleaseLease 释放 owner 持有的租约, 其他实例可以立即获取
+func ReleaseLease(s Store, appid, owner string) error {
+	if l, ok := s.(Leaser); ok {
+		return l.ReleaseLease(appid, owner)
+	}
+
+	return s.Update(appid, func(tx Tx) error {
+		v, err := tx.Get(LEASE_KEY)
+		if err != nil {
+			if err == ErrNotFound {
+				return nil
+			}
+			return err
+		}
+
+		if holder, _ := parseLease(v); holder != owner {
+			return nil
+		}
+
+		return tx.Delete(LEASE_KEY)
+	})
+}
+
+// formatLease 租约内容为 <owner>|<过期时间 unix 纳秒>
+func formatLease(owner string, expire time.Time) string {
+	return owner + "|" + strconv.FormatInt(expire.UnixNano(), 10)
+}
+
+func parseLease(v string) (string, time.Time) {
+	i := strings.LastIndex(v, "|")
+	if i < 0 {
+		return "", time.Time{}
+	}
+
+	ns, err := strconv.ParseInt(v[i+1:], 10, 64)
+	if err != nil {
+		return "", time.Time{}
+	}
+
+	return v[:i], time.Unix(0, ns)
+}
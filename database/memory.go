@@ -0,0 +1,157 @@
+package database
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryStore 内存存储, 主要用于测试
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string]map[string]string
+}
+
+// NewMemoryStore 初始化内存存储
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data: make(map[string]map[string]string),
+	}
+}
+
+// Get 实现 Store
+func (s *MemoryStore) Get(appid, key string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	v, ok := s.data[appid][key]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return v, nil
+}
+
+// Set 实现 Store
+func (s *MemoryStore) Set(appid, key, val string) error {
+	return s.Update(appid, func(tx Tx) error {
+		return tx.Set(key, val)
+	})
+}
+
+// Delete 实现 Store
+func (s *MemoryStore) Delete(appid, key string) error {
+	return s.Update(appid, func(tx Tx) error {
+		return tx.Delete(key)
+	})
+}
+
+// List 实现 Store
+func (s *MemoryStore) List(appid, prefix string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	res := make(map[string]string)
+	for k, v := range s.data[appid] {
+		if strings.HasPrefix(k, prefix) {
+			res[k] = v
+		}
+	}
+
+	return res, nil
+}
+
+// Update 实现 Store
+// 修改先记录在事务中, fn 成功之后才写入
+func (s *MemoryStore) Update(appid string, fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{
+		data:    s.data[appid],
+		changes: make(map[string]*string),
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if len(tx.changes) == 0 {
+		return nil
+	}
+
+	if s.data[appid] == nil {
+		s.data[appid] = make(map[string]string)
+	}
+
+	for k, v := range tx.changes {
+		if v == nil {
+			delete(s.data[appid], k)
+		} else {
+			s.data[appid][k] = *v
+		}
+	}
+
+	return nil
+}
+
+// AppIDs 实现 Store
+func (s *MemoryStore) AppIDs() ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	appids := make([]string, 0, len(s.data))
+	for appid := range s.data {
+		appids = append(appids, appid)
+	}
+
+	sort.Strings(appids)
+	return appids, nil
+}
+
+// Drop 实现 Store
+func (s *MemoryStore) Drop(appid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, appid)
+	return nil
+}
+
+// Close 实现 Store
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+type memoryTx struct {
+	data map[string]string
+
+	// changes 事务中的修改, nil 代表删除
+	changes map[string]*string
+}
+
+func (t *memoryTx) Get(key string) (string, error) {
+	if v, ok := t.changes[key]; ok {
+		if v == nil {
+			return "", ErrNotFound
+		}
+		return *v, nil
+	}
+
+	v, ok := t.data[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+
+	return v, nil
+}
+
+func (t *memoryTx) Set(key, val string) error {
+	t.changes[key] = &val
+	return nil
+}
+
+func (t *memoryTx) Delete(key string) error {
+	t.changes[key] = nil
+	return nil
+}
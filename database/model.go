@@ -1,62 +1,206 @@
 package database
 
 import (
-	"github.com/tidwall/buntdb"
+	"errors"
+	"sort"
+	"sync"
 )
 
+// ErrDropped Model 已经被 RemoveModel 删除, 不能再写入
+var ErrDropped = errors.New("数据已被删除")
+
 // Model 层结构定义
 type Model struct {
 	// ApppID 来自微信, 同时也作为 model 的 index
 	AppID string
 
-	db *buntdb.DB
+	store Store
+
+	// mu 写入时持有读锁, 删除时持有写锁, 保证删除之后不会再写入
+	mu sync.RWMutex
+
+	// dropped 已经被删除, 之后的写入返回 ErrDropped
+	// 避免删除之前开始的任务在删除之后保存结果, 重新创建 appid 的数据
+	dropped bool
 }
 
-// AllModel 装载了当前系统所有可用的微信 APP 配置
-var AllModel = make(map[string]*Model)
+// allModel 装载了当前系统所有可用的微信 APP 配置
+var allModel = struct {
+	sync.RWMutex
+	models map[string]*Model
+}{models: make(map[string]*Model)}
 
 // NewModel 初始化 model
+// 同一个 appid 多次调用, 返回的是同一个 Model
 func NewModel(appid string) (*Model, error) {
-	if m, ok := AllModel[appid]; ok {
+	allModel.Lock()
+	defer allModel.Unlock()
+
+	if m, ok := allModel.models[appid]; ok {
 		return m, nil
 	}
 
-	db, err := NewDB(appid)
-	if err != nil {
-		return nil, err
+	if store == nil {
+		return nil, errors.New("初始化 Model 失败: 存储未初始化")
 	}
 
 	m := &Model{
 		AppID: appid,
-		db:    db,
+		store: store,
 	}
 
-	AllModel[appid] = m
+	allModel.models[appid] = m
 	return m, nil
 }
 
-// Query 依据 key 查询对应的 value
-func (m *Model) Query(key string) (result string, err error) {
-	err = m.db.View(func(tx *buntdb.Tx) error {
-		result, err = tx.Get(key)
+// RemoveModel 删除 appid 对应的 Model 及其所有数据
+// 之后对该 Model 的写入都返回 ErrDropped
+func RemoveModel(appid string) error {
+	allModel.Lock()
+	defer allModel.Unlock()
+
+	if store == nil {
+		return errors.New("删除 Model 失败: 存储未初始化")
+	}
+
+	// 等待正在进行的写入结束, 删除期间不能写入
+	m, ok := allModel.models[appid]
+	if ok {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+	}
 
+	if err := store.Drop(appid); err != nil {
 		return err
+	}
+
+	if ok {
+		m.dropped = true
+	}
+
+	delete(allModel.models, appid)
+	return nil
+}
+
+// GetModel 依据 appid 获取已经初始化的 Model
+func GetModel(appid string) (*Model, bool) {
+	allModel.RLock()
+	defer allModel.RUnlock()
+
+	m, ok := allModel.models[appid]
+	return m, ok
+}
+
+// AllModels 获取所有已经初始化的 Model, 按照 appid 排序
+func AllModels() []*Model {
+	allModel.RLock()
+	defer allModel.RUnlock()
+
+	all := make([]*Model, 0, len(allModel.models))
+	for _, m := range allModel.models {
+		all = append(all, m)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].AppID < all[j].AppID
 	})
 
-	return
+	return all
+}
+
+// Query 依据 key 查询对应的 value
+// 加密保存的值会被解密
+func (m *Model) Query(key string) (string, error) {
+	v, err := m.store.Get(m.AppID, key)
+	if err != nil {
+		return "", err
+	}
+
+	return decrypt(m.AppID, key, v)
 }
 
 // Update 对 key 对应的 val 进行更新, 有更新，无插入
+// 敏感字段会被加密保存, 参见 IsSensitiveKey
 func (m *Model) Update(key, val string) error {
-	err := m.db.Update(func(tx *buntdb.Tx) error {
-		_, _, err := tx.Set(key, val, nil)
+	v, err := encrypt(m.AppID, key, val)
+	if err != nil {
 		return err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.dropped {
+		return ErrDropped
+	}
+
+	return m.store.Set(m.AppID, key, v)
+}
+
+// Delete 删除 key
+func (m *Model) Delete(key string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.dropped {
+		return ErrDropped
+	}
+
+	return m.store.Delete(m.AppID, key)
+}
+
+// List 查询所有以 prefix 开头的 key 及对应的值
+func (m *Model) List(prefix string) (map[string]string, error) {
+	all, err := m.store.List(m.AppID, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range all {
+		if all[k], err = decrypt(m.AppID, k, v); err != nil {
+			return nil, err
+		}
+	}
+
+	return all, nil
+}
+
+// Tx 在同一个事务中执行 fn
+// 与 Query, Update 一样, 事务中的敏感字段会被加解密
+// fn 中不能再调用 m 的方法
+func (m *Model) Tx(fn func(tx Tx) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.dropped {
+		return ErrDropped
+	}
+
+	return m.store.Update(m.AppID, func(tx Tx) error {
+		return fn(cryptTx{Tx: tx, appid: m.AppID})
 	})
+}
 
-	return err
+// cryptTx 对敏感字段进行加解密的事务
+type cryptTx struct {
+	Tx
+	appid string
 }
 
-// GetDB 获取 Model 对应的 DB
-func (m *Model) GetDB() *buntdb.DB {
-	return m.db
+func (t cryptTx) Get(key string) (string, error) {
+	v, err := t.Tx.Get(key)
+	if err != nil {
+		return "", err
+	}
+
+	return decrypt(t.appid, key, v)
+}
+
+func (t cryptTx) Set(key, val string) error {
+	v, err := encrypt(t.appid, key, val)
+	if err != nil {
+		return err
+	}
+
+	return t.Tx.Set(key, v)
 }
@@ -0,0 +1,73 @@
+package database
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// TestRemoveModel 删除之后的写入返回 ErrDropped, 不会重新创建 appid 的数据文件
+func TestRemoveModel(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewBuntStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := Init(s); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { store = nil }()
+
+	appid := "wx-remove-model"
+	m, err := NewModel(appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Update("task-0-value", "TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(dir, appid+".db")
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveModel(appid); err != nil {
+		t.Fatal(err)
+	}
+
+	// 删除之前开始的任务, 在删除之后才保存结果
+	if err := m.Update("task-0-value", "TOKEN"); err != ErrDropped {
+		t.Fatalf("删除之后写入应当返回 ErrDropped: %v", err)
+	}
+
+	if err := m.Delete("task-0-value"); err != ErrDropped {
+		t.Fatalf("删除之后删除应当返回 ErrDropped: %v", err)
+	}
+
+	if err := m.Tx(func(tx Tx) error { return tx.Set("task-0-notify", "{}") }); err != ErrDropped {
+		t.Fatalf("删除之后的事务应当返回 ErrDropped: %v", err)
+	}
+
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("删除之后数据文件被重新创建: %v", err)
+	}
+
+	// 重新注册时使用新的 Model
+	m2, err := NewModel(appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m2 == m {
+		t.Fatal("删除之后应当返回新的 Model")
+	}
+
+	if err := m2.Update("appsecret", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	RemoveModel(appid)
+}
@@ -0,0 +1,284 @@
+package database
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// REDIS_KEY_PREFIX Redis 中所有 key 的前缀
+// appid 下的 key 存放为 <前缀><appid>:<key>, 比如 wechat-scheduler:wx123456:task-0-value
+const REDIS_KEY_PREFIX = "wechat-scheduler:"
+
+// REDIS_APPIDS_KEY 存放所有 appid 的集合
+const REDIS_APPIDS_KEY = REDIS_KEY_PREFIX + "appids"
+
+// REDIS_TX_RETRIES 事务中读取的 key 被其他实例修改时, 最多执行的次数
+const REDIS_TX_RETRIES = 10
+
+// ErrTxConflict 事务中读取的 key 一直被其他实例修改, 超过重试次数
+var ErrTxConflict = errors.New("事务冲突, 请稍后重试")
+
+// RedisStore Redis 存储
+// 多个调度器实例可以共用同一个 Redis, 业务系统也可以直接从 Redis 读取 token
+type RedisStore struct {
+	client *redis.Client
+}
+
+// NewRedisStore 初始化 Redis 存储
+// addr 为 redis://[:password@]host:port/db 格式的地址
+func NewRedisStore(addr string) (*RedisStore, error) {
+	opt, err := redis.ParseURL(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := redis.NewClient(opt)
+	if err := client.Ping(context.Background()).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RedisStore{client: client}, nil
+}
+
+// RedisKey appid 下的 key 在 Redis 中实际的 key
+func RedisKey(appid, key string) string {
+	return REDIS_KEY_PREFIX + appid + ":" + key
+}
+
+// Get 实现 Store
+func (s *RedisStore) Get(appid, key string) (string, error) {
+	v, err := s.client.Get(context.Background(), RedisKey(appid, key)).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return v, err
+}
+
+// Set 实现 Store
+func (s *RedisStore) Set(appid, key, val string) error {
+	return s.Update(appid, func(tx Tx) error {
+		return tx.Set(key, val)
+	})
+}
+
+// Delete 实现 Store
+func (s *RedisStore) Delete(appid, key string) error {
+	return s.client.Del(context.Background(), RedisKey(appid, key)).Err()
+}
+
+// List 实现 Store
+func (s *RedisStore) List(appid, prefix string) (map[string]string, error) {
+	ctx := context.Background()
+	base := RedisKey(appid, "")
+	match := escapeRedisPattern(base+prefix) + "*"
+
+	keys := make([]string, 0)
+	iter := s.client.Scan(ctx, 0, match, 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	res := make(map[string]string)
+	if len(keys) == 0 {
+		return res, nil
+	}
+
+	vals, err := s.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range vals {
+		// SCAN 与 MGET 之间 key 可能已经被删除
+		if str, ok := v.(string); ok {
+			res[strings.TrimPrefix(keys[i], base)] = str
+		}
+	}
+
+	return res, nil
+}
+
+// Update 实现 Store
+// fn 中读取的 key 先通过 WATCH 监视, 写入先缓存起来, 最后通过 MULTI/EXEC 一次写入
+// 期间读取的 key 被其他实例修改时 EXEC 失败, 重新执行 fn, 最多 REDIS_TX_RETRIES 次
+func (s *RedisStore) Update(appid string, fn func(tx Tx) error) error {
+	ctx := context.Background()
+
+	for i := 0; i < REDIS_TX_RETRIES; i++ {
+		err := s.client.Watch(ctx, func(rtx *redis.Tx) error {
+			tx := &redisTx{
+				ctx:     ctx,
+				rtx:     rtx,
+				appid:   appid,
+				changes: make(map[string]*string),
+			}
+
+			if err := fn(tx); err != nil {
+				return err
+			}
+
+			if len(tx.changes) == 0 {
+				return nil
+			}
+
+			_, err := rtx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SAdd(ctx, REDIS_APPIDS_KEY, appid)
+
+				for k, v := range tx.changes {
+					if v == nil {
+						pipe.Del(ctx, RedisKey(appid, k))
+					} else {
+						pipe.Set(ctx, RedisKey(appid, k), *v, 0)
+					}
+				}
+
+				return nil
+			})
+
+			return err
+		})
+
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+
+	return ErrTxConflict
+}
+
+// AppIDs 实现 Store
+func (s *RedisStore) AppIDs() ([]string, error) {
+	return s.client.SMembers(context.Background(), REDIS_APPIDS_KEY).Result()
+}
+
+// Drop 实现 Store
+func (s *RedisStore) Drop(appid string) error {
+	ctx := context.Background()
+
+	keys := make([]string, 0)
+	iter := s.client.Scan(ctx, 0, escapeRedisPattern(RedisKey(appid, ""))+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	_, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SRem(ctx, REDIS_APPIDS_KEY, appid)
+		if len(keys) > 0 {
+			pipe.Del(ctx, keys...)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// Close 实现 Store
+func (s *RedisStore) Close() error {
+	return s.client.Close()
+}
+
+// acquireLeaseScript 租约无人持有或者由自己持有时, 设置并续期
+var acquireLeaseScript = redis.NewScript(`
+local v = redis.call('GET', KEYS[1])
+if v == false or v == ARGV[1] then
+	redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+	return 1
+end
+return 0
+`)
+
+// releaseLeaseScript 只删除自己持有的租约
+var releaseLeaseScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// AcquireLease 实现 Leaser
+// 租约存放在 <前缀><appid>:lease, 值为持有者, 依靠 key 的过期时间实现租约过期
+func (s *RedisStore) AcquireLease(appid, owner string, ttl time.Duration) (bool, error) {
+	res, err := acquireLeaseScript.Run(
+		context.Background(), s.client,
+		[]string{RedisKey(appid, LEASE_KEY)},
+		owner, ttl.Milliseconds(),
+	).Int()
+
+	return res == 1, err
+}
+
+// ReleaseLease 实现 Leaser
+func (s *RedisStore) ReleaseLease(appid, owner string) error {
+	return releaseLeaseScript.Run(
+		context.Background(), s.client,
+		[]string{RedisKey(appid, LEASE_KEY)},
+		owner,
+	).Err()
+}
+
+type redisTx struct {
+	ctx   context.Context
+	rtx   *redis.Tx
+	appid string
+
+	// changes 事务中的修改, nil 代表删除
+	changes map[string]*string
+}
+
+// Get 读取之前先 WATCH, 提交时 key 已经被修改则事务失败
+func (t *redisTx) Get(key string) (string, error) {
+	if v, ok := t.changes[key]; ok {
+		if v == nil {
+			return "", ErrNotFound
+		}
+		return *v, nil
+	}
+
+	k := RedisKey(t.appid, key)
+	if err := t.rtx.Watch(t.ctx, k).Err(); err != nil {
+		return "", err
+	}
+
+	v, err := t.rtx.Get(t.ctx, k).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+
+	return v, err
+}
+
+func (t *redisTx) Set(key, val string) error {
+	t.changes[key] = &val
+	return nil
+}
+
+func (t *redisTx) Delete(key string) error {
+	t.changes[key] = nil
+	return nil
+}
+
+// escapeRedisPattern 转义 SCAN MATCH 中的特殊字符
+func escapeRedisPattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(c)
+	}
+
+	return b.String()
+}
@@ -0,0 +1,162 @@
+package database
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+
+	// 纯 Go 实现的 SQLite 驱动, 不依赖 cgo
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore SQLite 存储
+// 所有 appid 共用一个数据库文件, 数据存放在 kv 表中
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+// NewSQLiteStore 初始化 SQLite 存储, 文件所在目录不存在则创建
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite 同一时间只允许一个写入, 这里直接使用单连接
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS kv (
+		appid TEXT NOT NULL,
+		key   TEXT NOT NULL,
+		value TEXT NOT NULL,
+		PRIMARY KEY (appid, key)
+	)`)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &SQLiteStore{db: db}, nil
+}
+
+// Get 实现 Store
+func (s *SQLiteStore) Get(appid, key string) (string, error) {
+	return sqliteTx{s.db, appid}.Get(key)
+}
+
+// Set 实现 Store
+func (s *SQLiteStore) Set(appid, key, val string) error {
+	return sqliteTx{s.db, appid}.Set(key, val)
+}
+
+// Delete 实现 Store
+func (s *SQLiteStore) Delete(appid, key string) error {
+	return sqliteTx{s.db, appid}.Delete(key)
+}
+
+// List 实现 Store
+func (s *SQLiteStore) List(appid, prefix string) (map[string]string, error) {
+	rows, err := s.db.Query(
+		"SELECT key, value FROM kv WHERE appid = ? AND substr(key, 1, length(?)) = ?",
+		appid, prefix, prefix,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	res := make(map[string]string)
+	for rows.Next() {
+		var k, v string
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		res[k] = v
+	}
+
+	return res, rows.Err()
+}
+
+// Update 实现 Store
+func (s *SQLiteStore) Update(appid string, fn func(tx Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err := fn(sqliteTx{tx, appid}); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// AppIDs 实现 Store
+func (s *SQLiteStore) AppIDs() ([]string, error) {
+	rows, err := s.db.Query("SELECT DISTINCT appid FROM kv ORDER BY appid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	appids := make([]string, 0)
+	for rows.Next() {
+		var appid string
+		if err := rows.Scan(&appid); err != nil {
+			return nil, err
+		}
+		appids = append(appids, appid)
+	}
+
+	return appids, rows.Err()
+}
+
+// Drop 实现 Store
+func (s *SQLiteStore) Drop(appid string) error {
+	_, err := s.db.Exec("DELETE FROM kv WHERE appid = ?", appid)
+	return err
+}
+
+// Close 实现 Store
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// sqlExecer *sql.DB 与 *sql.Tx 共有的方法
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type sqliteTx struct {
+	db    sqlExecer
+	appid string
+}
+
+func (t sqliteTx) Get(key string) (string, error) {
+	var v string
+	err := t.db.QueryRow("SELECT value FROM kv WHERE appid = ? AND key = ?", t.appid, key).Scan(&v)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+
+	return v, err
+}
+
+func (t sqliteTx) Set(key, val string) error {
+	_, err := t.db.Exec(
+		"INSERT INTO kv (appid, key, value) VALUES (?, ?, ?) ON CONFLICT (appid, key) DO UPDATE SET value = excluded.value",
+		t.appid, key, val,
+	)
+	return err
+}
+
+func (t sqliteTx) Delete(key string) error {
+	_, err := t.db.Exec("DELETE FROM kv WHERE appid = ? AND key = ?", t.appid, key)
+	return err
+}
@@ -0,0 +1,85 @@
+package database
+
+import (
+	"errors"
+)
+
+// 支持的存储类型
+const (
+	// STORE_BUNTDB 每个 appid 一个 buntdb 文件, path 为存放目录
+	STORE_BUNTDB = "buntdb"
+
+	// STORE_SQLITE 所有 appid 共用一个 SQLite 文件, path 为文件路径
+	STORE_SQLITE = "sqlite"
+
+	// STORE_REDIS Redis 存储, 多个实例可以共享, path 为 redis:// 格式的地址
+	STORE_REDIS = "redis"
+
+	// STORE_MEMORY 内存存储, 重启之后数据丢失, 主要用于测试
+	STORE_MEMORY = "memory"
+)
+
+// ErrNotFound 查询的 key 不存在
+var ErrNotFound = errors.New("not found")
+
+// Store 存储接口
+// 数据以 appid 分组, 每个 appid 下是简单的 key-value
+type Store interface {
+	// Get 查询 key 对应的值, 不存在时返回 ErrNotFound
+	Get(appid, key string) (string, error)
+
+	// Set 对 key 对应的 val 进行更新, 有更新，无插入
+	Set(appid, key, val string) error
+
+	// Delete 删除 key, key 不存在时不报错
+	Delete(appid, key string) error
+
+	// List 查询所有以 prefix 开头的 key 及对应的值
+	List(appid, prefix string) (map[string]string, error)
+
+	// Update 在同一个事务中执行 fn, fn 返回错误时全部回滚
+	// 事务冲突时 fn 可能被执行多次, 因此 fn 不能有事务之外的副作用
+	Update(appid string, fn func(tx Tx) error) error
+
+	// AppIDs 所有存储过数据的 appid
+	AppIDs() ([]string, error)
+
+	// Drop 删除 appid 下所有的数据
+	Drop(appid string) error
+
+	// Close 关闭存储, 将数据写入磁盘
+	Close() error
+}
+
+// Tx 事务中可用的操作
+type Tx interface {
+	Get(key string) (string, error)
+	Set(key, val string) error
+	Delete(key string) error
+}
+
+// Open 依据存储类型初始化存储
+// path 为空时使用各自的默认路径
+func Open(kind, path string) (Store, error) {
+	switch kind {
+	case STORE_BUNTDB, "":
+		if path == "" {
+			path = DBDir
+		}
+		return NewBuntStore(path)
+	case STORE_SQLITE:
+		if path == "" {
+			path = DBDir + "/scheduler.sqlite"
+		}
+		return NewSQLiteStore(path)
+	case STORE_REDIS:
+		if path == "" {
+			path = "redis://127.0.0.1:6379/0"
+		}
+		return NewRedisStore(path)
+	case STORE_MEMORY:
+		return NewMemoryStore(), nil
+	}
+
+	return nil, errors.New("不支持的存储类型: " + kind)
+}
@@ -0,0 +1,334 @@
+package database
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// stores 测试用的各类存储, 测试结束时关闭
+func stores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	bunt, err := NewBuntStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sqlite, err := NewSQLiteStore(filepath.Join(t.TempDir(), "scheduler.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	all := map[string]Store{
+		STORE_MEMORY: NewMemoryStore(),
+		STORE_BUNTDB: bunt,
+		STORE_SQLITE: sqlite,
+	}
+
+	all[STORE_REDIS], _ = newRedis(t)
+
+	t.Cleanup(func() {
+		for _, s := range all {
+			s.Close()
+		}
+	})
+
+	return all
+}
+
+// newRedis 使用 miniredis 的 Redis 存储
+func newRedis(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	s, err := NewRedisStore("redis://" + mr.Addr() + "/0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return s, mr
+}
+
+func TestStore(t *testing.T) {
+	for name, s := range stores(t) {
+		s := s
+
+		t.Run(name, func(t *testing.T) {
+			if _, err := s.Get("wx1", "appsecret"); err != ErrNotFound {
+				t.Fatalf("不存在的 key 应当返回 ErrNotFound: %v", err)
+			}
+
+			for _, kv := range [][3]string{
+				{"wx1", "appsecret", "s1"},
+				{"wx1", "task-0-value", "v0"},
+				{"wx1", "task-0-result", "r0"},
+				{"wx1", "task-1-value", "v1"},
+				{"wx2", "appsecret", "s2"},
+			} {
+				if err := s.Set(kv[0], kv[1], kv[2]); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if v, err := s.Get("wx1", "appsecret"); err != nil || v != "s1" {
+				t.Fatalf("Get: %q %v", v, err)
+			}
+
+			list, err := s.List("wx1", "task-0-")
+			if err != nil || len(list) != 2 || list["task-0-value"] != "v0" || list["task-0-result"] != "r0" {
+				t.Fatalf("List: %v %v", list, err)
+			}
+
+			if err := s.Delete("wx1", "task-0-value"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := s.Delete("wx1", "task-0-value"); err != nil {
+				t.Fatalf("删除不存在的 key 不应当报错: %v", err)
+			}
+
+			if _, err := s.Get("wx1", "task-0-value"); err != ErrNotFound {
+				t.Fatalf("删除之后应当返回 ErrNotFound: %v", err)
+			}
+
+			appids, err := s.AppIDs()
+			if err != nil || len(appids) != 2 {
+				t.Fatalf("AppIDs: %v %v", appids, err)
+			}
+
+			if err := s.Drop("wx1"); err != nil {
+				t.Fatal(err)
+			}
+
+			if list, err := s.List("wx1", ""); err != nil || len(list) != 0 {
+				t.Fatalf("Drop 之后仍然有数据: %v %v", list, err)
+			}
+
+			if appids, _ := s.AppIDs(); len(appids) != 1 || appids[0] != "wx2" {
+				t.Fatalf("Drop 之后的 AppIDs: %v", appids)
+			}
+		})
+	}
+}
+
+// TestStoreUpdateRollback fn 返回错误时不写入任何修改
+func TestStoreUpdateRollback(t *testing.T) {
+	for name, s := range stores(t) {
+		s := s
+
+		t.Run(name, func(t *testing.T) {
+			s.Set("wx", "a", "1")
+
+			err := s.Update("wx", func(tx Tx) error {
+				tx.Set("a", "2")
+				tx.Set("b", "2")
+				return ErrNotFound
+			})
+			if err != ErrNotFound {
+				t.Fatalf("应当返回 fn 的错误: %v", err)
+			}
+
+			if v, _ := s.Get("wx", "a"); v != "1" {
+				t.Fatalf("回滚之后的值: %q", v)
+			}
+
+			if _, err := s.Get("wx", "b"); err != ErrNotFound {
+				t.Fatalf("回滚之后不应当有新的 key: %v", err)
+			}
+		})
+	}
+}
+
+// TestStoreUpdateConcurrent 并发的读-改-写不会丢失修改
+func TestStoreUpdateConcurrent(t *testing.T) {
+	for name, s := range stores(t) {
+		s := s
+
+		t.Run(name, func(t *testing.T) {
+			const n = 20
+
+			var wg sync.WaitGroup
+			errs := make(chan error, n)
+			for i := 0; i < n; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					errs <- s.Update("wx", increase("counter"))
+				}()
+			}
+			wg.Wait()
+			close(errs)
+
+			ok := 0
+			for err := range errs {
+				if err == nil {
+					ok++
+				} else if err != ErrTxConflict {
+					t.Fatal(err)
+				}
+			}
+
+			v, err := s.Get("wx", "counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Redis 冲突过多时部分事务会返回 ErrTxConflict, 但是成功的事务不能丢失
+			if name != STORE_REDIS && ok != n {
+				t.Fatalf("%d 个事务失败", n-ok)
+			}
+
+			if v != strconv.Itoa(ok) {
+				t.Fatalf("计数: 期望 %d, 实际 %s", ok, v)
+			}
+		})
+	}
+}
+
+// TestRedisUpdateConflict 事务中读取的 key 被其他实例修改时, 重新执行事务
+func TestRedisUpdateConflict(t *testing.T) {
+	s, _ := newRedis(t)
+	defer s.Close()
+
+	s.Set("wx", "counter", "1")
+
+	runs := 0
+	err := s.Update("wx", func(tx Tx) error {
+		runs++
+
+		v, err := tx.Get("counter")
+		if err != nil {
+			return err
+		}
+
+		// 第一次执行时, 其他连接修改了读取过的 key
+		if runs == 1 {
+			if err := s.Set("wx", "counter", "10"); err != nil {
+				return err
+			}
+		}
+
+		i, _ := strconv.Atoi(v)
+		return tx.Set("counter", strconv.Itoa(i+1))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runs != 2 {
+		t.Fatalf("事务应当重新执行一次, 实际执行 %d 次", runs)
+	}
+
+	if v, _ := s.Get("wx", "counter"); v != "11" {
+		t.Fatalf("应当在其他实例修改的基础上更新: %s", v)
+	}
+}
+
+// TestRedisUpdateExhausted 一直冲突时返回 ErrTxConflict, 不写入任何修改
+func TestRedisUpdateExhausted(t *testing.T) {
+	s, _ := newRedis(t)
+	defer s.Close()
+
+	runs := 0
+	err := s.Update("wx", func(tx Tx) error {
+		runs++
+
+		if _, err := tx.Get("counter"); err != nil && err != ErrNotFound {
+			return err
+		}
+
+		s.Set("wx", "counter", strconv.Itoa(runs))
+		return tx.Set("result", "done")
+	})
+
+	if err != ErrTxConflict || runs != REDIS_TX_RETRIES {
+		t.Fatalf("应当重试 %d 次之后返回 ErrTxConflict: %v, %d", REDIS_TX_RETRIES, err, runs)
+	}
+
+	if _, err := s.Get("wx", "result"); err != ErrNotFound {
+		t.Fatalf("冲突的事务不应当写入: %v", err)
+	}
+}
+
+// TestLease 租约的获取, 续期, 释放以及过期
+func TestLease(t *testing.T) {
+	ttl := 200 * time.Millisecond
+
+	for name, s := range stores(t) {
+		if name == STORE_REDIS {
+			continue
+		}
+
+		s := s
+		t.Run(name, func(t *testing.T) {
+			testLease(t, s, ttl, func() { time.Sleep(ttl + 50*time.Millisecond) })
+		})
+	}
+
+	// miniredis 的 key 不会自动过期, 需要手动推进时间
+	t.Run(STORE_REDIS, func(t *testing.T) {
+		s, mr := newRedis(t)
+		defer s.Close()
+
+		testLease(t, s, ttl, func() { mr.FastForward(ttl) })
+	})
+}
+
+// testLease expire 等待租约过期
+func testLease(t *testing.T, s Store, ttl time.Duration, expire func()) {
+	acquire := func(owner string) bool {
+		ok, err := AcquireLease(s, "wx", owner, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ok
+	}
+
+	if !acquire("a") || !acquire("a") {
+		t.Fatal("a 应当获取并续期租约")
+	}
+
+	if acquire("b") {
+		t.Fatal("a 持有租约时 b 不能获取")
+	}
+
+	if err := ReleaseLease(s, "wx", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if acquire("b") {
+		t.Fatal("b 不能释放 a 的租约")
+	}
+
+	if err := ReleaseLease(s, "wx", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if !acquire("b") {
+		t.Fatal("a 释放之后 b 应当获取租约")
+	}
+
+	expire()
+
+	if !acquire("a") {
+		t.Fatal("b 的租约过期之后 a 应当获取租约")
+	}
+}
+
+// increase 将 key 对应的数字加一
+func increase(key string) func(tx Tx) error {
+	return func(tx Tx) error {
+		v, err := tx.Get(key)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+
+		i, _ := strconv.Atoi(v)
+		return tx.Set(key, strconv.Itoa(i+1))
+	}
+}
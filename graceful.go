@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+	"github.com/zjxpcyc/wechat-scheduler/jobs"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+// LISTEN_FD_ENV 平滑重启时, 子进程通过此环境变量得知继承了监听 socket
+// 继承的 socket 固定为文件描述符 3
+const LISTEN_FD_ENV = "WECHAT_SCHEDULER_LISTEN_FD"
+
+// listen 获取监听 socket
+// 由平滑重启启动的进程直接使用父进程传递过来的 socket
+func listen(addr string) (net.Listener, error) {
+	if os.Getenv(LISTEN_FD_ENV) == "" {
+		return net.Listen("tcp", addr)
+	}
+
+	f := os.NewFile(3, "listener")
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// fork 启动新的进程, 并将监听 socket 传递过去
+// 新旧进程共用同一个 socket, 业务系统不会出现连接被拒绝
+func fork(l net.Listener) error {
+	tl, ok := l.(*net.TCPListener)
+	if !ok {
+		return errors.New("不支持的监听类型")
+	}
+
+	f, err := tl.File()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	bin, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command(bin, os.Args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), LISTEN_FD_ENV+"=1")
+	cmd.ExtraFiles = []*os.File{f}
+
+	return cmd.Start()
+}
+
+// shutdown 平滑关闭
+// 依次停止接受修改数据的请求, 释放租约, 等待正在执行的任务及回调, 关闭存储, 最后关闭 http 服务
+// restart 为 true 时, 在关闭 http 服务之前启动新的进程接管监听 socket
+func shutdown(app *App, serv *http.Server, l net.Listener, store database.Store, elector *jobs.Elector, timeout time.Duration, restart bool) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	app.Close()
+
+	if app.Auth != nil {
+		app.Auth.Stop()
+	}
+
+	if elector != nil {
+		elector.Stop()
+	}
+
+	if err := lib.DefaultScheduler.Shutdown(ctx); err != nil {
+		logger.Error("等待任务结束超时: ", err.Error())
+	}
+
+	// 刷新任务结束之后, 新的结果已经写入 outbox, 未投递的在重启之后继续投递
+	if err := jobs.NotifyScheduler.Shutdown(ctx); err != nil {
+		logger.Error("等待回调结束超时: ", err.Error())
+	}
+
+	if err := store.Close(); err != nil {
+		logger.Error("关闭存储失败: ", err.Error())
+	}
+
+	if restart {
+		if err := fork(l); err != nil {
+			logger.Error("平滑重启失败: ", err.Error())
+		} else {
+			logger.Info("新进程已启动, 当前进程退出 ...")
+		}
+	}
+
+	// 等待任务时可能已经用完了 ctx 的超时时间, http 服务单独计算
+	sctx, scancel := context.WithTimeout(context.Background(), timeout)
+	defer scancel()
+
+	if err := serv.Shutdown(sctx); err != nil {
+		logger.Error("关闭 http 服务失败: ", err.Error())
+	}
+}
@@ -1,8 +1,9 @@
 package jobs
 
 import (
+	"context"
+	"errors"
 	"net/url"
-	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
@@ -17,13 +18,13 @@ func AccessToken(tk *JobTask) *lib.JobServer {
 	taskName := "access_token"
 	t := tk.Job
 
-	task := func() error {
+	task := func(ctx context.Context) error {
 		query := url.Values{}
 		query.Add("appid", t.AppID)
-		query.Add("secret", t.AppSecret)
+		query.Add("secret", t.Secret())
 
 		res := map[string]interface{}{}
-		_, err := lib.Request(tk.API, query, nil, &res)
+		_, err := lib.Request(ctx, tk.API, query, nil, &res)
 		if err != nil {
 			return err
 		}
@@ -32,17 +33,15 @@ func AccessToken(tk *JobTask) *lib.JobServer {
 			return err
 		}
 
-		tk.Result = res
-		tk.Value = res["access_token"].(string)
-		tk.LastTime = time.Now().Local()
-		tk.Save()
-
-		if tk.CallBack != nil {
-			tk.CallBack(t.AppID, JOB_ACCESS_TOKEN, res)
+		token, ok := stringOf(res, "access_token")
+		if !ok {
+			return errors.New("刷新 " + taskName + " 失败: 微信返回的结果中没有 access_token")
 		}
 
+		tk.Refreshed(ctx, res, token)
+
 		return nil
 	}
 
-	return lib.NewJobServer(t.AppID, taskName, task, tk.Freq)
+	return lib.NewJobServer(t.AppID, taskName, tk.guard(task), tk.Freq())
 }
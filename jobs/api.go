@@ -0,0 +1,90 @@
+package jobs
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+// DEFAULT_BASE_URL 微信接口的默认地址
+const DEFAULT_BASE_URL = "https://api.weixin.qq.com"
+
+// BaseURL 微信接口地址, 替换 JobAPIs 中的 DEFAULT_BASE_URL
+// 可以通过启动参数 -wechat-api 设置, 比如指向测试环境的模拟服务
+var BaseURL = DEFAULT_BASE_URL
+
+// APIOverrides 单个接口的地址, 以任务类型为 key, 优先于 BaseURL
+// 只替换接口的 scheme, host 以及 path, query 参数仍然使用 JobAPIs 中的定义
+// 可以通过启动参数 -wechat-api-override 设置
+var APIOverrides = map[int]string{}
+
+// APIOf 获取任务类型对应的接口, 已经应用了 BaseURL 及 APIOverrides
+func APIOf(typ int) lib.WechatAPI {
+	api := JobAPIs[typ]
+
+	u, err := url.Parse(api.URL)
+	if err != nil {
+		return api
+	}
+
+	addr := BaseURL
+	path := u.Path
+	if override, ok := APIOverrides[typ]; ok {
+		addr = override
+		path = ""
+	}
+
+	if addr == DEFAULT_BASE_URL {
+		return api
+	}
+
+	base, err := url.Parse(addr)
+	if err != nil {
+		logger.Error("微信接口地址不正确: " + addr)
+		return api
+	}
+
+	u.Scheme = base.Scheme
+	u.Host = base.Host
+	u.Path = strings.TrimRight(base.Path, "/") + path
+
+	api.URL = u.String()
+	return api
+}
+
+// ParseAPIOverrides 解析单个接口的地址
+// 格式为 name=url, 多个以逗号分隔, name 为任务名称, 比如 access_token=http://127.0.0.1:8080/cgi-bin/token
+func ParseAPIOverrides(s string) (map[int]string, error) {
+	overrides := make(map[int]string)
+	if s == "" {
+		return overrides, nil
+	}
+
+	types := make(map[string]int)
+	for typ, name := range JobNames {
+		types[name] = typ
+	}
+
+	for _, item := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(item), "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, errors.New("接口地址格式不正确: " + item)
+		}
+
+		typ, ok := types[kv[0]]
+		if !ok {
+			return nil, errors.New("不支持的任务名称: " + kv[0])
+		}
+
+		u, err := url.Parse(kv[1])
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("接口地址格式不正确: " + kv[1])
+		}
+
+		overrides[typ] = kv[1]
+	}
+
+	return overrides, nil
+}
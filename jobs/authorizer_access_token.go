@@ -2,10 +2,10 @@ package jobs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"net/url"
-	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
@@ -20,61 +20,60 @@ func AuthorizerAccessToken(tk *JobTask) *lib.JobServer {
 	taskName := "authorizer_access_token"
 	t := tk.Job
 
-	task := func() error {
+	task := func(ctx context.Context) error {
 		postData := map[string]string{
 			"component_appid": t.AppID,
 		}
 
-		if tk.DynamicParams == nil {
+		dynamicParams := tk.DynamicParams()
+		if dynamicParams == nil {
 			return errors.New("启动 " + taskName + " 任务失败, 注册须指定 DynamicParams 参数")
 		}
 
-		params := tk.DynamicParams(t.AppID, JOB_AUTHORIZER_ACCESS_TOKEN)
-		if authApp, ok := params["authorizer_appid"]; ok {
-			postData["authorizer_appid"] = authApp.(string)
+		params, err := dynamicParams(ctx, t.AppID, JOB_AUTHORIZER_ACCESS_TOKEN)
+		if err != nil {
+			return err
+		}
+
+		if authApp, ok := stringOf(params, "authorizer_appid"); ok {
+			postData["authorizer_appid"] = authApp
 		} else {
 			return errors.New("获取 " + taskName + " 失败: 未找到有效 authorizer_appid")
 		}
 
 		// authorizer_refresh_token 先从业务系统查找
-		if refresh, ok := params["authorizer_refresh_token"]; ok {
-			postData["authorizer_refresh_token"] = refresh.(string)
-		} else {
+		if refresh, ok := stringOf(params, "authorizer_refresh_token"); ok {
+			postData["authorizer_refresh_token"] = refresh
+		} else if refresh, ok := stringOf(tk.Snapshot().Result, "authorizer_refresh_token"); ok {
 			// 如果找不到, 再从上次任务中查找
-			if tk.Result == nil {
-				return errors.New("获取 " + taskName + " 失败: 未找到有效 authorizer_refresh_token")
-			} else {
-				if refresh, ok = tk.Result["authorizer_refresh_token"]; ok {
-					postData["authorizer_refresh_token"] = refresh.(string)
-				} else {
-					return errors.New("获取 " + taskName + " 失败: 未找到有效 authorizer_refresh_token")
-				}
-			}
+			postData["authorizer_refresh_token"] = refresh
+		} else {
+			return errors.New("获取 " + taskName + " 失败: 未找到有效 authorizer_refresh_token")
 		}
 
 		query := url.Values{}
 
 		// component_access_token 从两个地方来
-		if token, ok := params["component_access_token"]; ok {
+		if token, ok := stringOf(params, "component_access_token"); ok {
 			// 1、业务系统传过来
-			query.Add("component_access_token", token.(string))
+			query.Add("component_access_token", token)
 		} else {
 			// 2、从注册任务中查询
-			caTk, ok := t.Tasks[JOB_COMPONENT_ACCESS_TOKEN]
-			if !ok || caTk.Value == "" {
+			caTk, ok := t.Task(JOB_COMPONENT_ACCESS_TOKEN)
+			if !ok || caTk.Value() == "" {
 				return errors.New("获取 " + taskName + " 失败: 未找到有效 component_access_token")
 			}
 
-			query.Add("component_access_token", caTk.Value)
+			query.Add("component_access_token", caTk.Value())
 		}
 
-		dt, err := json.Marshal(params)
+		dt, err := json.Marshal(postData)
 		if err != nil {
 			return err
 		}
 
 		res := map[string]interface{}{}
-		_, err = lib.Request(tk.API, query, bytes.NewBuffer(dt), &res)
+		_, err = lib.Request(ctx, tk.API, query, bytes.NewBuffer(dt), &res)
 		if err != nil {
 			return err
 		}
@@ -83,17 +82,15 @@ func AuthorizerAccessToken(tk *JobTask) *lib.JobServer {
 			return err
 		}
 
-		tk.Result = res
-		tk.Value = res["authorizer_access_token"].(string)
-		tk.LastTime = time.Now().Local()
-		tk.Save()
-
-		if tk.CallBack != nil {
-			tk.CallBack(t.AppID, JOB_AUTHORIZER_ACCESS_TOKEN, res)
+		token, ok := stringOf(res, "authorizer_access_token")
+		if !ok {
+			return errors.New("获取 " + taskName + " 失败: 微信返回的结果中没有 authorizer_access_token")
 		}
 
+		tk.Refreshed(ctx, res, token)
+
 		return nil
 	}
 
-	return lib.NewJobServer(t.AppID, taskName, task, tk.Freq)
+	return lib.NewJobServer(t.AppID, taskName, tk.guard(task), tk.Freq())
 }
@@ -2,9 +2,9 @@ package jobs
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
-	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
@@ -19,30 +19,35 @@ func ComponentAccessToken(tk *JobTask) *lib.JobServer {
 	taskName := "component_access_token"
 	t := tk.Job
 
-	task := func() error {
+	task := func(ctx context.Context) error {
 		postData := map[string]string{
 			"component_appid":     t.AppID,
-			"component_appsecret": t.AppSecret,
+			"component_appsecret": t.Secret(),
 		}
 
-		if tk.DynamicParams == nil {
+		dynamicParams := tk.DynamicParams()
+		if dynamicParams == nil {
 			return errors.New("启动 " + taskName + " 任务失败, 注册须指定 DynamicParams 参数")
 		}
 
-		params := tk.DynamicParams(t.AppID, JOB_COMPONENT_ACCESS_TOKEN)
-		if ticket, ok := params["component_verify_ticket"]; ok {
-			postData["component_verify_ticket"] = ticket.(string)
+		params, err := dynamicParams(ctx, t.AppID, JOB_COMPONENT_ACCESS_TOKEN)
+		if err != nil {
+			return err
+		}
+
+		if ticket, ok := stringOf(params, "component_verify_ticket"); ok {
+			postData["component_verify_ticket"] = ticket
 		} else {
 			return errors.New("获取 " + taskName + " 失败: 未找到有效 verify_ticket")
 		}
 
-		dt, err := json.Marshal(params)
+		dt, err := json.Marshal(postData)
 		if err != nil {
 			return err
 		}
 
 		res := map[string]interface{}{}
-		_, err = lib.Request(tk.API, nil, bytes.NewBuffer(dt), &res)
+		_, err = lib.Request(ctx, tk.API, nil, bytes.NewBuffer(dt), &res)
 		if err != nil {
 			return err
 		}
@@ -51,17 +56,15 @@ func ComponentAccessToken(tk *JobTask) *lib.JobServer {
 			return err
 		}
 
-		tk.Result = res
-		tk.Value = res["ComponentVerifyTicket"].(string)
-		tk.LastTime = time.Now().Local()
-		tk.Save()
-
-		if tk.CallBack != nil {
-			tk.CallBack(t.AppID, JOB_COMPONENT_ACCESS_TOKEN, res)
+		token, ok := stringOf(res, "component_access_token")
+		if !ok {
+			return errors.New("获取 " + taskName + " 失败: 微信返回的结果中没有 component_access_token")
 		}
 
+		tk.Refreshed(ctx, res, token)
+
 		return nil
 	}
 
-	return lib.NewJobServer(t.AppID, taskName, task, tk.Freq)
+	return lib.NewJobServer(t.AppID, taskName, tk.guard(task), tk.Freq())
 }
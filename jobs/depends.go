@@ -0,0 +1,196 @@
+package jobs
+
+import (
+	"errors"
+)
+
+// Dependency 任务依赖
+// 依赖的任务可以在同一 appid 下注册, 也可以由业务系统通过 DynamicParams 提供
+type Dependency struct {
+	// Typ 依赖的任务类型
+	Typ int
+
+	// Param 依赖的任务未注册时, 业务系统需要提供的参数名
+	Param string
+}
+
+// Dependencies 各任务类型的依赖
+// 比如 jsapi_ticket 需要 access_token
+var Dependencies = map[int][]Dependency{
+	JOB_JSAPI_TICKET:            {{Typ: JOB_ACCESS_TOKEN, Param: "access_token"}},
+	JOB_AUTHORIZER_ACCESS_TOKEN: {{Typ: JOB_COMPONENT_ACCESS_TOKEN, Param: "component_access_token"}},
+}
+
+// order 按照依赖关系排序的任务类型, 被依赖的任务在前
+var order = sortByDependency()
+
+// sortByDependency 依据 Dependencies 对所有任务类型进行拓扑排序
+func sortByDependency() []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	marks := make(map[int]int)
+	sorted := make([]int, 0, JOB_MAX_LIMIT)
+
+	var visit func(typ int)
+	visit = func(typ int) {
+		switch marks[typ] {
+		case visited:
+			return
+		case visiting:
+			panic("任务依赖存在循环: " + JobNames[typ])
+		}
+
+		marks[typ] = visiting
+		for _, dep := range Dependencies[typ] {
+			visit(dep.Typ)
+		}
+		marks[typ] = visited
+
+		sorted = append(sorted, typ)
+	}
+
+	for typ := 0; typ < JOB_MAX_LIMIT; typ++ {
+		visit(typ)
+	}
+
+	return sorted
+}
+
+// Dependents 直接依赖于 typ 的任务类型
+func Dependents(typ int) []int {
+	deps := make([]int, 0)
+	for _, t := range order {
+		for _, dep := range Dependencies[t] {
+			if dep.Typ == typ {
+				deps = append(deps, t)
+			}
+		}
+	}
+
+	return deps
+}
+
+// DependencyError 删除任务之后, 依赖于它的任务无法获取需要的参数
+type DependencyError struct {
+	// Typ 要删除的任务类型
+	Typ int
+
+	// Dependent 依赖于 Typ 的任务类型
+	Dependent int
+
+	// Param Dependent 需要的参数名
+	Param string
+}
+
+func (e *DependencyError) Error() string {
+	return "任务 " + JobNames[e.Dependent] + " 依赖 " + JobNames[e.Typ] + ", 并且没有通过 params 提供 " + e.Param + ", 请先删除 " + JobNames[e.Dependent] + " 任务, 或者重新注册并指定 params"
+}
+
+// CheckDependencies 校验注册的任务的依赖是否可以满足
+// tasks 为本次注册的任务类型, 以及是否指定了 DynamicParams 地址
+// 依赖的任务需要已经注册, 或者在本次一起注册, 否则需要通过 DynamicParams 提供
+func (r *Registry) CheckDependencies(appid string, tasks map[int]bool) error {
+	typ, dep, ok := unmetDependency(tasks, func(t int) bool {
+		_, ok := r.Task(appid, t)
+		return ok
+	})
+
+	if ok {
+		return errors.New("任务 " + JobNames[typ] + " 依赖 " + JobNames[dep.Typ] + ", 需要同时注册 " + JobNames[dep.Typ] + " 任务, 或者通过 params 提供 " + dep.Param)
+	}
+
+	return nil
+}
+
+// checkRemove 校验删除 typ 任务之后, 剩余任务的依赖是否仍然可以满足
+// 调用方需持有 t.mu
+func (t *Job) checkRemove(typ int) error {
+	left := make(map[int]bool)
+	for k, tk := range t.tasks {
+		if k != typ {
+			left[k] = tk.DynamicParams() != nil
+		}
+	}
+
+	dependent, dep, ok := unmetDependency(left, func(int) bool { return false })
+	if ok {
+		return &DependencyError{Typ: dep.Typ, Dependent: dependent, Param: dep.Param}
+	}
+
+	return nil
+}
+
+// unmetDependency 查找依赖不能满足的任务, 以及其不能满足的依赖
+// tasks 为任务类型, 以及是否指定了 DynamicParams 地址; registered 判断 tasks 之外的任务是否已经注册
+func unmetDependency(tasks map[int]bool, registered func(typ int) bool) (int, Dependency, bool) {
+	for _, typ := range order {
+		hasParams, ok := tasks[typ]
+		if !ok {
+			continue
+		}
+
+		for _, dep := range Dependencies[typ] {
+			if _, ok := tasks[dep.Typ]; ok {
+				continue
+			}
+
+			if registered(dep.Typ) {
+				continue
+			}
+
+			if !hasParams {
+				return typ, dep, true
+			}
+		}
+	}
+
+	return 0, Dependency{}, false
+}
+
+// waiting 任务依赖的本地任务中, 还没有有效结果的那一个
+// 依赖由业务系统提供时不需要等待
+func (t *Job) waiting(typ int) (int, bool) {
+	now := Now()
+
+	for _, dep := range Dependencies[typ] {
+		parent, ok := t.Task(dep.Typ)
+		if !ok {
+			continue
+		}
+
+		if !parent.Snapshot().Valid(now) {
+			return dep.Typ, true
+		}
+	}
+
+	return 0, false
+}
+
+// refreshDependents typ 任务的结果变化之后, 重新执行依赖于它的任务
+// 未启动的任务在这里启动
+func (t *Job) refreshDependents(typ int) {
+	for _, dep := range Dependents(typ) {
+		tk, ok := t.Task(dep)
+		if !ok || tk.Execable == nil {
+			continue
+		}
+
+		if _, ok := t.waiting(dep); ok {
+			continue
+		}
+
+		if !tk.Execable.Started() {
+			logger.Info("Job-" + t.AppID + " 任务 " + JobNames[typ] + " 已就绪, 启动 " + JobNames[dep])
+			tk.Execable.Start()
+			continue
+		}
+
+		if err := tk.Execable.Refresh(); err != nil {
+			logger.Error("刷新 Job-"+t.AppID+" 依赖任务 "+JobNames[dep]+" 失败: ", err.Error())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package jobs
+
+import (
+	"errors"
+	"testing"
+)
+
+// TestRemoveDependency 删除被依赖的任务
+func TestRemoveDependency(t *testing.T) {
+	_, j := newTestJob(t, "wx-remove-dependency")
+
+	newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+	newTask(t, j, JOB_JSAPI_TICKET, "", "", "")
+
+	_, err := j.RemoveTask(JOB_ACCESS_TOKEN)
+
+	var de *DependencyError
+	if !errors.As(err, &de) || de.Typ != JOB_ACCESS_TOKEN || de.Dependent != JOB_JSAPI_TICKET {
+		t.Fatalf("jsapi_ticket 没有 params 时不能删除 access_token: %v", err)
+	}
+
+	if _, ok := j.Task(JOB_ACCESS_TOKEN); !ok {
+		t.Fatal("删除失败时任务不应当被删除")
+	}
+
+	// 为 jsapi_ticket 指定 params 之后可以删除
+	newTask(t, j, JOB_JSAPI_TICKET, "http://127.0.0.1:1/params", "", "")
+
+	left, err := j.RemoveTask(JOB_ACCESS_TOKEN)
+	if err != nil || left != 1 {
+		t.Fatalf("删除失败: %d %v", left, err)
+	}
+}
+
+// TestRemoveDependent 先删除依赖的任务, 再删除被依赖的任务
+func TestRemoveDependent(t *testing.T) {
+	_, j := newTestJob(t, "wx-remove-dependent")
+
+	newTask(t, j, JOB_COMPONENT_ACCESS_TOKEN, "http://127.0.0.1:1/params", "", "")
+	newTask(t, j, JOB_AUTHORIZER_ACCESS_TOKEN, "http://127.0.0.1:1/params", "", "")
+	newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	// authorizer_access_token 通过 params 获取 component_access_token, 可以直接删除
+	if _, err := j.RemoveTask(JOB_COMPONENT_ACCESS_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+
+	newTask(t, j, JOB_JSAPI_TICKET, "", "", "")
+	if _, err := j.RemoveTask(JOB_JSAPI_TICKET); err != nil {
+		t.Fatal(err)
+	}
+
+	if left, err := j.RemoveTask(JOB_ACCESS_TOKEN); err != nil || left != 1 {
+		t.Fatalf("删除失败: %d %v", left, err)
+	}
+}
@@ -0,0 +1,197 @@
+package jobs
+
+import (
+	"sync"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+)
+
+// Elector 多实例部署时的选主
+// 每个 appid 一个租约, 只有持有租约的实例才会运行该 appid 下的任务;
+// 其他实例只提供查询, 并定时从存储中同步任务结果, 在租约过期之后接管
+type Elector struct {
+	// ID 当前实例标识, 各实例之间不能重复
+	ID string
+
+	// TTL 租约有效期, 每 TTL/3 续期一次
+	TTL time.Duration
+
+	reg   *Registry
+	store database.Store
+
+	mu sync.Mutex
+
+	// leading 持有的租约的过期时间, 以发起续期的时间计算, 不会晚于存储中实际的过期时间
+	leading map[string]time.Time
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// NewElector 实例化选主, 并设置到 reg 中
+func NewElector(reg *Registry, store database.Store, id string, ttl time.Duration) *Elector {
+	e := &Elector{
+		ID:      id,
+		TTL:     ttl,
+		reg:     reg,
+		store:   store,
+		leading: make(map[string]time.Time),
+		done:    make(chan struct{}),
+	}
+
+	reg.SetElector(e)
+	return e
+}
+
+// Campaign 获取或者续期 appid 的租约, 返回当前实例是否为主实例
+// 存储出错时视为失去租约
+func (e *Elector) Campaign(appid string) bool {
+	start := time.Now()
+
+	ok, err := database.AcquireLease(e.store, appid, e.ID, e.TTL)
+	if err != nil {
+		logger.Error("获取 Job-"+appid+" 租约失败: ", err.Error())
+		ok = false
+	}
+
+	e.mu.Lock()
+	if ok {
+		e.leading[appid] = start.Add(e.TTL)
+	} else {
+		delete(e.leading, appid)
+	}
+	e.mu.Unlock()
+
+	return ok
+}
+
+// IsLeader 当前实例是否为 appid 的主实例
+// 续期因为存储故障或者进程卡顿而中断时, 在租约过期之前 TTL/3 就不再是主实例,
+// 避免与接管的实例同时运行任务
+func (e *Elector) IsLeader(appid string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	deadline, ok := e.leading[appid]
+	if !ok {
+		return false
+	}
+
+	return time.Now().Before(deadline.Add(-e.TTL / 3))
+}
+
+// held 最近一次续期是否成功, 即本实例是否在运行 appid 的任务
+// 与 IsLeader 不同, 不考虑租约是否即将过期
+func (e *Elector) held(appid string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	_, ok := e.leading[appid]
+	return ok
+}
+
+// Start 启动选主, 定时续期租约并同步其他实例注册的 Job
+func (e *Elector) Start() {
+	e.wg.Add(1)
+
+	go func() {
+		defer e.wg.Done()
+
+		ticker := time.NewTicker(e.TTL / 3)
+		defer ticker.Stop()
+
+		for {
+			e.elect()
+
+			select {
+			case <-e.done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop 停止选主, 停止本实例运行的任务并释放租约, 以便其他实例立即接管
+func (e *Elector) Stop() {
+	close(e.done)
+	e.wg.Wait()
+
+	for _, j := range e.reg.Jobs() {
+		if !e.held(j.AppID) {
+			continue
+		}
+
+		j.Stop()
+		if err := database.ReleaseLease(e.store, j.AppID, e.ID); err != nil {
+			logger.Error("释放 Job-"+j.AppID+" 租约失败: ", err.Error())
+		}
+
+		e.mu.Lock()
+		delete(e.leading, j.AppID)
+		e.mu.Unlock()
+	}
+}
+
+// forget 不再记录 appid 的租约状态
+func (e *Elector) forget(appid string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	delete(e.leading, appid)
+}
+
+func (e *Elector) elect() {
+	// 其他实例注册的 appid
+	appids, err := e.store.AppIDs()
+	if err != nil {
+		logger.Error("同步 Job 列表失败: ", err.Error())
+	}
+
+	for _, appid := range appids {
+		if _, ok := e.reg.Job(appid); ok {
+			continue
+		}
+
+		m, err := database.NewModel(appid)
+		if err != nil {
+			logger.Error("同步 Job-"+appid+" 失败: ", err.Error())
+			continue
+		}
+
+		if _, err := e.reg.Load(m); err != nil && err != database.ErrNotFound {
+			logger.Error("同步 Job-"+appid+" 失败: ", err.Error())
+		}
+	}
+
+	for _, j := range e.reg.Jobs() {
+		// 其他实例已经删除的 appid
+		if _, err := j.Model.Query("appsecret"); err == database.ErrNotFound {
+			logger.Info("Job-" + j.AppID + " 已被删除, 停止任务")
+			e.reg.forget(j.AppID)
+			continue
+		}
+
+		was := e.held(j.AppID)
+		now := e.Campaign(j.AppID)
+
+		if was && !now {
+			logger.Info("失去 Job-" + j.AppID + " 租约, 停止任务")
+			j.Stop()
+		}
+
+		// 同步其他实例的任务结果, 以及新注册的任务
+		// 正在运行的任务以内存为准
+		if err := j.Load(); err != nil && err != database.ErrNotFound {
+			logger.Error("同步 Job-"+j.AppID+" 失败: ", err.Error())
+		}
+
+		if now {
+			if !was {
+				logger.Info("获得 Job-" + j.AppID + " 租约, 启动任务")
+			}
+
+			j.start()
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package jobs
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TEST_LEASE_TTL 测试用的租约有效期
+const TEST_LEASE_TTL = 300 * time.Millisecond
+
+// newElector 在新的注册中心中启动选主, 与其他实例共用同一个存储
+func newElector(t *testing.T, id string) (*Registry, *Elector) {
+	reg := NewRegistry()
+	e := NewElector(reg, testStore, id, TEST_LEASE_TTL)
+	e.Start()
+
+	return reg, e
+}
+
+// watchLeaders 检查各实例是否同时为主实例, 返回结束检查的函数
+func watchLeaders(t *testing.T, appid string, electors ...*Elector) func() {
+	var overlap int32
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			leaders := 0
+			for _, e := range electors {
+				if e.IsLeader(appid) {
+					leaders++
+				}
+			}
+
+			if leaders > 1 {
+				atomic.StoreInt32(&overlap, 1)
+			}
+
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+
+		if atomic.LoadInt32(&overlap) != 0 {
+			t.Fatal("多个实例同时为主实例")
+		}
+	}
+}
+
+// TestElectorFailover 主实例卡顿, 不再续期时由其他实例接管
+func TestElectorFailover(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-failover"
+	srv.AddApp(appid, "secret-"+appid)
+
+	regA, a := newElector(t, "a")
+	j, err := regA.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	waitFor(t, "a 成为主实例", func() bool { return a.IsLeader(appid) })
+
+	regB, b := newElector(t, "b")
+	t.Cleanup(func() {
+		b.Stop()
+		regA.Remove(appid)
+		regB.Remove(appid)
+	})
+	waitFor(t, "b 同步 Job", func() bool {
+		st, err := regB.State(appid, JOB_ACCESS_TOKEN)
+		return err == nil && st.Value != ""
+	})
+
+	stop := watchLeaders(t, appid, a, b)
+
+	// a 租约有效期间 b 不能成为主实例
+	time.Sleep(2 * TEST_LEASE_TTL)
+	if b.IsLeader(appid) {
+		t.Fatal("a 续期期间 b 不应当成为主实例")
+	}
+
+	// 模拟 a 卡顿, 不再续期, 也不释放租约
+	close(a.done)
+	a.wg.Wait()
+
+	waitFor(t, "a 的租约即将过期时不再是主实例", func() bool { return !a.IsLeader(appid) })
+
+	// a 的任务虽然还在运行, 但是不再请求微信
+	if err := j.Refresh(JOB_ACCESS_TOKEN); err != ErrNotLeader {
+		t.Fatalf("a 失去租约之后刷新应当返回 ErrNotLeader: %v", err)
+	}
+
+	waitFor(t, "b 接管", func() bool { return b.IsLeader(appid) })
+	stop()
+
+	j.Stop()
+
+	st, err := regB.Refresh(appid, JOB_ACCESS_TOKEN)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st.Value != srv.AccessToken(appid) {
+		t.Fatalf("b 刷新之后的 access_token 不是最新的: %s", st.Value)
+	}
+}
+
+// TestElectorStop 主实例停止时释放租约, 其他实例立即接管
+func TestElectorStop(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-elector-stop"
+	srv.AddApp(appid, "secret-"+appid)
+
+	regA, a := newElector(t, "a")
+	j, err := regA.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	waitFor(t, "a 成为主实例", func() bool { return a.IsLeader(appid) })
+
+	regB, b := newElector(t, "b")
+	t.Cleanup(func() {
+		b.Stop()
+		regA.Remove(appid)
+		regB.Remove(appid)
+	})
+	waitFor(t, "b 同步 Job", func() bool {
+		_, ok := regB.Job(appid)
+		return ok
+	})
+
+	stop := watchLeaders(t, appid, a, b)
+	a.Stop()
+
+	if a.IsLeader(appid) {
+		t.Fatal("停止之后 a 不应当是主实例")
+	}
+
+	tk, _ := regA.Task(appid, JOB_ACCESS_TOKEN)
+	if tk.Execable.Started() {
+		t.Fatal("停止之后 a 的任务不应当再运行")
+	}
+
+	// 租约已经释放, b 在下一次续期时接管, 不需要等待租约过期
+	waitFor(t, "b 接管", func() bool { return b.IsLeader(appid) })
+	stop()
+
+	tk, _ = regB.Task(appid, JOB_ACCESS_TOKEN)
+	waitFor(t, "b 启动任务", tk.Execable.Started)
+}
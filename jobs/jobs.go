@@ -4,6 +4,7 @@ import (
 	"errors"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/zjxpcyc/tinylogger"
@@ -17,89 +18,303 @@ type Job struct {
 	// AppID 微信应用ID
 	AppID string
 
-	// AppSecret 微信应用 Secret
-	AppSecret string
-
-	// Tasks 当前 Job 所有的注册 task
-	Tasks map[int]*JobTask
-
 	// Model
 	Model *database.Model
-}
 
-// AllJob 所有注册的 Job
-var AllJob = make(map[string]*Job)
+	registry *Registry
+
+	mu sync.RWMutex
+
+	// appSecret 微信应用 Secret
+	appSecret string
+
+	// tasks 当前 Job 所有的注册 task
+	tasks map[int]*JobTask
+}
 
 var logger tinylogger.LogService
 
-// NewJob 新建一个 Job
-// 如果同一个 appid 多次创建, 那么返回的是同一个 Job
-// 因此 可以支持 runtime 更新 Job
-func NewJob(appid, appsecret string) (*Job, error) {
-	if appid == "" || appsecret == "" {
-		return nil, errors.New("新建 Job 失败, appid 或者 appsecret 不能为空")
+// Secret 获取微信应用 Secret
+func (t *Job) Secret() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.appSecret
+}
+
+func (t *Job) setSecret(appsecret string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.appSecret = appsecret
+}
+
+// Task 获取指定类型的任务
+func (t *Job) Task(typ int) (*JobTask, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	tk, ok := t.tasks[typ]
+	return tk, ok
+}
+
+// Tasks 获取当前 Job 所有的注册 task, 按照任务类型排序
+func (t *Job) Tasks() []*JobTask {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	all := make([]*JobTask, 0, len(t.tasks))
+	for i := 0; i < JOB_MAX_LIMIT; i++ {
+		if tk, ok := t.tasks[i]; ok {
+			all = append(all, tk)
+		}
+	}
+
+	return all
+}
+
+// NewTask 新建一个 Task
+// 支持任务的重复创建, retry 为 nil 时使用任务类型默认的重试策略
+// cbAddr 与已有的回调地址合并, 不会覆盖其他业务系统注册的回调地址; 新增的回调地址立即收到当前有效的结果
+// notifySecret 为 cbAddr 回调签名使用的密钥, 为空时保留原有的密钥
+// 写入 model 失败时不创建任务, 比如 Job 已经被删除时返回 database.ErrDropped
+func (t *Job) NewTask(typ int, dynAddr, cbAddr, notifySecret string, retry *RetryParam) (*JobTask, error) {
+	// 不支持的类型
+	if typ < 0 || typ >= JOB_MAX_LIMIT {
+		return nil, errors.New("不支持的任务类型: " + strconv.Itoa(typ))
 	}
 
-	m, ok := database.AllModel[appid]
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	subscribers := mergeSubscribers(t.subscribers(typ), cbAddr)
+
+	// 更新 model
+	err := t.Model.Tx(func(tx database.Tx) error {
+		tasklist, err := tx.Get("tasklist")
+		if err != nil && err != database.ErrNotFound {
+			return err
+		}
+
+		if tasklist == "" {
+			tasklist = strconv.Itoa(typ)
+		} else {
+			tasklist = lib.DistinctStr(tasklist + "," + strconv.Itoa(typ))
+		}
+
+		fields := map[string]string{
+			"dyn-" + strconv.Itoa(typ):   dynAddr,
+			"cb-" + strconv.Itoa(typ):    formatSubscribers(subscribers),
+			"retry-" + strconv.Itoa(typ): retry.String(),
+			"tasklist":                   tasklist,
+		}
+
+		for k, v := range fields {
+			if err := tx.Set(k, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	tk, added := t.addTask(typ, dynAddr, subscribers, retry)
+
+	// 在投递当前结果之前设置签名密钥
+	if err := tk.setNotifySecret(cbAddr, notifySecret); err != nil {
+		return nil, err
+	}
+
+	// 重新注册之后, 已经失败的任务可以再次启动
+	tk.Execable.ClearFailed()
+
+	tk.notifyCurrent(added)
+
+	return tk, nil
+}
+
+// subscribers 读取 model 中保存的回调地址
+// 调用方需持有 t.mu
+func (t *Job) subscribers(typ int) []string {
+	v, err := t.Model.Query("cb-" + strconv.Itoa(typ))
+	if err != nil && err != database.ErrNotFound {
+		logger.Error("读取 Job-"+t.AppID+" 任务 "+JobNames[typ]+" 回调地址失败: ", err.Error())
+	}
+
+	urls, err := parseSubscribers(v)
+	if err != nil {
+		logger.Error("读取 Job-"+t.AppID+" 任务 "+JobNames[typ]+" 回调地址失败: ", err.Error())
+		return []string{}
+	}
+
+	return urls
+}
+
+// AddNotify 为任务添加回调地址, 已经存在时只更新签名密钥
+// 新增的回调地址立即收到当前有效的结果; secret 为空时保留原有的密钥
+func (t *Job) AddNotify(typ int, addr, secret string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tk, ok := t.tasks[typ]
 	if !ok {
-		var err error
-		m, err = database.NewModel(appid)
-		if err != nil {
-			return nil, err
+		return errors.New("当前 AppID 并未注册指定类型的 任务")
+	}
+
+	subscribers := mergeSubscribers(t.subscribers(typ), addr)
+	if err := t.Model.Update("cb-"+strconv.Itoa(typ), formatSubscribers(subscribers)); err != nil {
+		return err
+	}
+
+	added := tk.setSubscribers(subscribers)
+	if err := tk.setNotifySecret(addr, secret); err != nil {
+		return err
+	}
+
+	if t.registry.IsLeader(t.AppID) {
+		for _, n := range added {
+			n.Resume()
 		}
 	}
 
-	// 重复注册, 以最后一次为准
-	// 因为有可能出现 appsecret 变更的情况
-	m.Update("appid", appid)
-	m.Update("appsecret", appsecret)
+	tk.notifyCurrent(added)
+	return nil
+}
 
-	if j, ok := AllJob[appid]; ok {
-		j.AppID = appid
-		j.AppSecret = appsecret
+// RemoveNotify 删除任务的回调地址, 同时删除其待投递的回调及投递记录
+// 其他回调地址不受影响
+func (t *Job) RemoveNotify(typ int, addr string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 
-		return j, nil
+	tk, ok := t.tasks[typ]
+	if !ok {
+		return errors.New("当前 AppID 并未注册指定类型的 任务")
 	}
 
-	j := &Job{
-		AppID:     appid,
-		AppSecret: appsecret,
-		Tasks:     make(map[int]*JobTask),
-		Model:     m,
+	subscribers := t.subscribers(typ)
+	left := make([]string, 0, len(subscribers))
+	for _, u := range subscribers {
+		if u != addr {
+			left = append(left, u)
+		}
 	}
 
-	AllJob[appid] = j
-	return j, nil
+	if len(left) == len(subscribers) {
+		return ErrNotifyNotFound
+	}
+
+	var removed *Notifier
+	for _, n := range tk.Notifiers() {
+		if n.URL == addr {
+			removed = n
+		}
+	}
+
+	tk.setSubscribers(left)
+
+	return t.Model.Tx(func(tx database.Tx) error {
+		if err := tx.Set("cb-"+strconv.Itoa(typ), formatSubscribers(left)); err != nil {
+			return err
+		}
+
+		if removed == nil {
+			return nil
+		}
+
+		for _, k := range []string{removed.outboxKey(), removed.historyKey(), removed.secretKey()} {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
-// NewTask 新建一个 Task
-// 支持任务的重复创建
-func (t *Job) NewTask(typ int, dynAddr, cbAddr string) *JobTask {
-	// 不支持的类型
-	if typ < 0 || typ >= JOB_MAX_LIMIT {
-		logger.Error("创建 Task 失败, 不支持的 Task 类型: " + strconv.Itoa(typ))
+// RemoveTask 停止并删除任务, 同时删除 model 中任务相关的所有数据
+// 返回剩余的任务数量; 其他任务依赖于此任务, 并且没有通过 params 提供时, 返回 *DependencyError
+func (t *Job) RemoveTask(typ int) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tk, ok := t.tasks[typ]
+	if !ok {
+		return len(t.tasks), errors.New("当前 AppID 并未注册指定类型的 任务")
+	}
+
+	if err := t.checkRemove(typ); err != nil {
+		return len(t.tasks), err
+	}
+
+	tk.remove()
+
+	typStr := strconv.Itoa(typ)
+	keys, err := t.Model.List("task-" + typStr + "-")
+	if err != nil {
+		return len(t.tasks), err
+	}
+
+	err = t.Model.Tx(func(tx database.Tx) error {
+		tasklist, err := tx.Get("tasklist")
+		if err != nil && err != database.ErrNotFound {
+			return err
+		}
+
+		if err := tx.Set("tasklist", lib.RemoveStr(tasklist, typStr)); err != nil {
+			return err
+		}
+
+		for _, k := range append([]string{"dyn-" + typStr, "cb-" + typStr, "retry-" + typStr}, mapKeys(keys)...) {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+
 		return nil
+	})
+	if err != nil {
+		return len(t.tasks), err
 	}
 
-	t.Model.Update("dyn-"+strconv.Itoa(typ), dynAddr)
-	t.Model.Update("cb-"+strconv.Itoa(typ), cbAddr)
+	delete(t.tasks, typ)
+	return len(t.tasks), nil
+}
+
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
 
-	if tk, ok := t.Tasks[typ]; ok {
-		tk.DynamicParams = lib.DynamicFuncFactory(dynAddr)
-		tk.CallBack = lib.CallBackFuncFactory(cbAddr)
+	return keys
+}
 
-		return tk
+// addTask 在内存中新建或者更新 Task, 不写入 model
+// 返回任务, 以及新增的回调
+// 调用方需持有 t.mu
+func (t *Job) addTask(typ int, dynAddr string, subscribers []string, retry *RetryParam) (*JobTask, []*Notifier) {
+	policy, err := retry.Policy(typ)
+	if err != nil {
+		logger.Error("Job-"+t.AppID+" 任务 "+JobNames[typ]+" 重试策略不正确, 使用默认策略: ", err.Error())
+		policy, _ = (*RetryParam)(nil).Policy(typ)
 	}
 
-	freq := FREQUENCY * time.Second
+	if tk, ok := t.tasks[typ]; ok {
+		tk.SetDynamicParams(lib.DynamicFuncFactory(dynAddr))
+		tk.Execable.SetRetry(policy)
+		return tk, tk.setSubscribers(subscribers)
+	}
 
 	task := &JobTask{
 		Typ:           typ,
-		DynamicParams: lib.DynamicFuncFactory(dynAddr),
-		API:           JobAPIs[typ],
-		Freq:          freq,
-		CallBack:      lib.CallBackFuncFactory(cbAddr),
+		API:           APIOf(typ),
 		Job:           t,
+		freq:          FREQUENCY * time.Second,
+		dynamicParams: lib.DynamicFuncFactory(dynAddr),
 	}
 
 	switch typ {
@@ -115,108 +330,187 @@ func (t *Job) NewTask(typ int, dynAddr, cbAddr string) *JobTask {
 		task.Execable = AuthorizerAccessToken(task)
 	}
 
-	// 更新 model
-	tasklist, _ := t.Model.Query("tasklist")
-	if tasklist == "" {
-		tasklist = strconv.Itoa(typ)
-	} else {
-		tasklist = lib.DistinctStr(tasklist + "," + strconv.Itoa(typ))
-	}
-
-	t.Model.Update("tasklist", tasklist)
+	task.Execable.SetRetry(policy)
 
-	t.Tasks[typ] = task
-	return task
+	t.tasks[typ] = task
+	return task, task.setSubscribers(subscribers)
 }
 
-// Run 自动运行任务, 自动运行不支持任务停止
-// 如果需要手动运行, 请直接调用相关任务的方法
-func (t *Job) Run() {
-	for i := 0; i < JOB_MAX_LIMIT; i++ {
-		tk, ok := t.Tasks[i]
-		if !ok {
-			continue
-		}
+// Load 从 model 中恢复当前 Job 的任务列表及任务结果
+// 只更新内存, 不会写入 model; 正在运行的任务以内存为准, 不会被覆盖
+func (t *Job) Load() error {
+	appid := t.AppID
 
-		tk.Start()
+	appsecret, err := t.Model.Query("appsecret")
+	if err != nil {
+		return err
 	}
-}
 
-// Init 从数据库文件进行系统初始化
-func Init() {
-	logger = lib.GetLogger()
-	logger.Info("开始进行任务列表初始化 ...")
+	t.setSecret(appsecret)
 
-	if database.AllModel == nil || len(database.AllModel) == 0 {
-		return
+	tasklist, err := t.Model.Query("tasklist")
+	if err != nil {
+		return err
 	}
 
-	for appid, m := range database.AllModel {
-		appsecret, err := m.Query("appsecret")
+	if tasklist == "" {
+		return nil
+	}
+
+	allTasks := strings.Split(tasklist, ",")
+	for _, typStr := range allTasks {
+		typ, err := strconv.Atoi(typStr)
+		if err != nil || typ < 0 || typ >= JOB_MAX_LIMIT {
+			logger.Error("初始化 Job-" + appid + " task[" + typStr + "] 失败: 不支持的 Task 类型")
+			continue
+		}
+
+		dyn, err := t.Model.Query("dyn-" + typStr)
 		if err != nil {
-			logger.Error("初始化 Job-"+appid+" 失败: ", err.Error())
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 失败: ", err.Error())
 			continue
 		}
 
-		job, err := NewJob(appid, appsecret)
+		cb, err := t.Model.Query("cb-" + typStr)
 		if err != nil {
-			logger.Error("初始化 Job-"+appid+" 失败: ", err.Error())
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 失败: ", err.Error())
 			continue
 		}
 
-		tasklist, err := m.Query("tasklist")
+		subscribers, err := parseSubscribers(cb)
 		if err != nil {
-			logger.Error("初始化 Job-"+appid+" tasklist 失败: ", err.Error())
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 回调地址失败: ", err.Error())
 			continue
 		}
 
-		if tasklist == "" {
+		// 旧版本的数据没有重试策略
+		retryStr, err := t.Model.Query("retry-" + typStr)
+		if err != nil && err != database.ErrNotFound {
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 失败: ", err.Error())
 			continue
 		}
 
-		allTasks := strings.Split(tasklist, ",")
-		for _, typStr := range allTasks {
-			dyn, err := m.Query("dyn-" + typStr)
-			if err != nil {
-				logger.Error("初始化 Job-"+appid+" task["+typStr+"] 失败: ", err.Error())
-				continue
-			}
+		retry, err := parseRetryParam(retryStr)
+		if err != nil {
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 重试策略失败, 使用默认策略: ", err.Error())
+		}
 
-			cb, err := m.Query("cb-" + typStr)
-			if err != nil {
-				logger.Error("初始化 Job-"+appid+" task["+typStr+"] 失败: ", err.Error())
-				continue
-			}
+		t.mu.Lock()
+		tk, _ := t.addTask(typ, dyn, subscribers, retry)
+		t.mu.Unlock()
 
-			typ, _ := strconv.Atoi(typStr)
-			tk := job.NewTask(typ, dyn, cb)
+		if tk.Execable == nil || !tk.Execable.Started() {
+			tk.Load()
+		}
 
-			prefix := "task-" + strconv.Itoa(typ)
+		if err := tk.loadNotifySecrets(); err != nil {
+			logger.Error("初始化 Job-"+appid+" task["+typStr+"] 回调签名密钥失败: ", err.Error())
+		}
+	}
 
-			result, err := m.Query(prefix + "-result")
-			if err != nil {
-				logger.Error("初始化 Job-"+appid+" task["+typStr+"] Result 失败: ", err.Error())
-				continue
-			}
+	return nil
+}
 
-			lasttime, err := m.Query(prefix + "-lasttime")
-			if err != nil {
-				logger.Error("初始化 Job-"+appid+" task["+typStr+"] Lasttime 失败: ", err.Error())
-				continue
-			}
+// Run 自动运行任务
+// 多实例部署时, 只有持有当前 appid 租约的实例才会运行
+func (t *Job) Run() {
+	if !t.registry.Campaign(t.AppID) {
+		return
+	}
+
+	t.start()
+}
+
+// start 按照依赖关系启动任务
+// 依赖的本地任务还没有有效结果时暂不启动, 等其刷新成功之后再启动
+// 回调的投递不受依赖关系影响, 立即开始
+func (t *Job) start() {
+	for _, typ := range order {
+		tk, ok := t.Task(typ)
+		if !ok {
+			continue
+		}
 
-			value, err := m.Query(prefix + "-value")
-			if err != nil {
-				logger.Error("初始化 Job-"+appid+" task["+typStr+"] Value 失败: ", err.Error())
-				continue
+		for _, n := range tk.Notifiers() {
+			n.Resume()
+		}
+
+		if parent, ok := t.waiting(typ); ok {
+			if tk.Execable == nil || !tk.Execable.Started() {
+				logger.Info("Job-" + t.AppID + " 任务 " + JobNames[typ] + " 等待 " + JobNames[parent] + " 刷新成功之后启动")
 			}
+			continue
+		}
+
+		tk.Start()
+	}
+}
 
-			tk.Set("result", result)
-			tk.Set("lasttime", lasttime)
-			tk.Set("value", value)
+// Refresh 立即刷新指定类型的任务
+// 结果变化之后, 依赖于它的任务随后也会刷新
+func (t *Job) Refresh(typ int) error {
+	tk, ok := t.Task(typ)
+	if !ok {
+		return errors.New("当前 AppID 并未注册指定类型的 任务")
+	}
+
+	return tk.Refresh()
+}
+
+// Invalidate 业务系统上报 token 失效, 立即刷新指定类型的任务
+// value 为业务系统使用的失效的值, 如果与当前值不同, 说明已经刷新过, 不再重复刷新
+// 同一任务在 InvalidInterval 内只会刷新一次
+func (t *Job) Invalidate(typ int, value string) error {
+	tk, ok := t.Task(typ)
+	if !ok {
+		return errors.New("当前 AppID 并未注册指定类型的 任务")
+	}
+
+	// 刷新期间的其他上报在这里等待, 之后因为值已经变化而直接返回
+	tk.invalidMu.Lock()
+	defer tk.invalidMu.Unlock()
+
+	if value != "" && value != tk.Value() {
+		return nil
+	}
+
+	now := Now()
+	if now.Sub(tk.invalidAt) < InvalidInterval {
+		return ErrInvalidTooFrequent
+	}
+	tk.invalidAt = now
+
+	logger.Info("Job-" + t.AppID + " 任务 " + JobNames[typ] + " 被上报失效, 立即刷新")
+
+	return t.Refresh(typ)
+}
+
+// Stop 停止当前 Job 所有的任务
+func (t *Job) Stop() {
+	for _, tk := range t.Tasks() {
+		tk.Stop()
+	}
+}
+
+// remove 停止并标记删除所有的任务
+func (t *Job) remove() {
+	for _, tk := range t.Tasks() {
+		tk.remove()
+	}
+}
+
+// Init 从数据库文件进行系统初始化, 恢复的 Job 注册到 reg 中
+func Init(reg *Registry) {
+	logger = lib.GetLogger()
+	logger.Info("开始进行任务列表初始化 ...")
+
+	for _, m := range database.AllModels() {
+		job, err := reg.Load(m)
+		if err != nil {
+			logger.Error("初始化 Job-"+m.AppID+" 失败: ", err.Error())
+			continue
 		}
 
 		job.Run()
-		AllJob[appid] = job
 	}
 }
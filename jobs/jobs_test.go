@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+	"github.com/zjxpcyc/wechat-scheduler/wechattest"
+)
+
+// testStore 所有测试共用的存储
+var testStore = database.NewMemoryStore()
+
+func TestMain(m *testing.M) {
+	logger = lib.GetLogger()
+
+	if err := database.Init(testStore); err != nil {
+		panic(err)
+	}
+
+	os.Exit(m.Run())
+}
+
+// setClock 将 Now 替换为固定的时间, 测试结束时恢复
+func setClock(t *testing.T, now time.Time) {
+	Now = func() time.Time { return now }
+	t.Cleanup(func() { Now = time.Now })
+}
+
+// newTestJob 在新的注册中心中注册 appid, 测试结束时删除
+func newTestJob(t *testing.T, appid string) (*Registry, *Job) {
+	t.Helper()
+
+	reg := NewRegistry()
+	j, err := reg.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { reg.Remove(appid) })
+	return reg, j
+}
+
+// newTask 在 j 中创建任务, 失败则测试失败
+func newTask(t *testing.T, j *Job, typ int, dynAddr, cbAddr, notifySecret string) *JobTask {
+	t.Helper()
+
+	tk, err := j.NewTask(typ, dynAddr, cbAddr, notifySecret, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tk
+}
+
+// newWechat 启动模拟的微信接口, 之后创建的任务都请求模拟服务
+func newWechat(t *testing.T) *wechattest.Server {
+	srv := wechattest.NewServer()
+	BaseURL = srv.URL
+
+	t.Cleanup(func() {
+		BaseURL = DEFAULT_BASE_URL
+		srv.Close()
+	})
+
+	return srv
+}
+
+// waitFor 等待 cond 成立, 超时则测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时: " + what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
@@ -1,11 +1,16 @@
 package jobs
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sort"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/zjxpcyc/wechat-scheduler/database"
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
 
@@ -33,18 +38,81 @@ const (
 )
 
 // FREQUENCY 目前已知的微信定时任务都是 7200 秒, 这里提前 200s 启动
+// 仅在首次运行, 或者微信没有返回 expires_in 时使用
 const FREQUENCY = 7000
 
+// DEFAULT_EXPIRES_IN 微信结果中没有 expires_in 时, 默认的有效期(秒)
+const DEFAULT_EXPIRES_IN = 7200
+
+// Margin 安全边际, 在 token 或者 ticket 过期前多久进行刷新
+// 可以通过启动参数 -margin 设置
+var Margin = 200 * time.Second
+
+// InvalidInterval 业务系统上报 token 失效时, 同一任务两次刷新的最小间隔
+// 避免大量业务系统同时上报, 耗尽微信接口的每日调用次数
+// 可以通过启动参数 -invalid-interval 设置
+var InvalidInterval = 60 * time.Second
+
+// InvalidCodes 微信返回的代表 token 失效的错误码
+var InvalidCodes = map[int]bool{
+	40001: true, // access_token 无效
+	40014: true, // 不合法的 access_token
+	42001: true, // access_token 超时
+}
+
+// ErrInvalidTooFrequent 上报 token 失效过于频繁
+var ErrInvalidTooFrequent = errors.New("上报过于频繁, 请稍后重试")
+
+// Now 获取当前时间, 用于计算结果的有效期及下次执行时间
+// 测试时可以替换为模拟的时钟
+var Now = time.Now
+
 // JobTask 单个任务
 // 比如 access_token 获取等
+// 任务结果会被 http 请求与任务协程同时读写, 因此所有可变的字段都需要通过方法访问
 type JobTask struct {
 	// Typ 任务类型
 	Typ int
 
-	// DynamicParams 需要动态传入过来的参数
+	// API 接口
+	API lib.WechatAPI
+
+	// Execable 任务Server
+	Execable *lib.JobServer
+
+	// Job 所属 Job
+	Job *Job
+
+	mu sync.RWMutex
+
+	// state 当前任务结果
+	state TaskState
+
+	// freq 刷新频率
+	freq time.Duration
+
+	// dynamicParams 需要动态传入过来的参数
 	// 例如, 微信开放平台的 component_token 需要 verify_ticket 来获取.
 	// 但是 verify_ticket 的刷新频率是 10 分钟一次
-	DynamicParams func(appid string, typ int) map[string]interface{}
+	dynamicParams lib.DynamicFunc
+
+	// notifiers 成功之后的回调, 以回调地址为 key
+	notifiers map[string]*Notifier
+
+	// removed 任务已经被删除, 正在执行的结果不再保存
+	removed bool
+
+	// invalidMu 上报 token 失效时使用, 刷新期间其他上报等待刷新结果
+	invalidMu sync.Mutex
+
+	// invalidAt 上次因为上报 token 失效而刷新的时间
+	invalidAt time.Time
+}
+
+// TaskState 任务结果的快照
+type TaskState struct {
+	// Typ 任务类型
+	Typ int
 
 	// Result 当前任务结果
 	// 与 Value 有区别
@@ -58,23 +126,20 @@ type JobTask struct {
 	// LastTime 上次执行时间
 	LastTime time.Time
 
-	// API 接口
-	API lib.WechatAPI
-
-	// Freq 刷新频率
-	Freq time.Duration
+	// ExpireTime 当前结果的过期时间, 依据微信返回的 expires_in 计算
+	ExpireTime time.Time
 
-	// CallBack 成功之后的回调
-	CallBack func(appid string, typ int, result map[string]interface{})
-
-	// Execable 任务Server
-	Execable *lib.JobServer
+	// NextTime 下次执行时间
+	NextTime time.Time
+}
 
-	// Job 所属 Job
-	Job *Job
+// Valid 结果在 now 时是否仍然有效
+func (s TaskState) Valid(now time.Time) bool {
+	return s.Value != "" && s.ExpireTime.After(now)
 }
 
 // JobAPIs 目前支持的微信 api
+// 实际请求的地址参见 APIOf
 var JobAPIs = map[int]lib.WechatAPI{
 	JOB_ACCESS_TOKEN: lib.WechatAPI{
 		Name:        "access_token",
@@ -112,58 +177,359 @@ var JobAPIs = map[int]lib.WechatAPI{
 	},
 }
 
+// Snapshot 获取当前任务结果的快照
+// Result 是复制出来的, 调用方可以随意修改
+func (t *JobTask) Snapshot() TaskState {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	st := t.state
+	if t.state.Result != nil {
+		st.Result = make(map[string]interface{}, len(t.state.Result))
+		for k, v := range t.state.Result {
+			st.Result[k] = v
+		}
+	}
+
+	return st
+}
+
+// Value 获取当前任务的目的结果
+func (t *JobTask) Value() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.state.Value
+}
+
+// Freq 获取当前的刷新频率
+func (t *JobTask) Freq() time.Duration {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.freq
+}
+
+// guard 只有主实例才执行 task
+// 续期中断时, 在选主停止任务之前就不再请求微信, 避免使接管的实例获取的 token 失效
+func (t *JobTask) guard(task func(ctx context.Context) error) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		if !t.Job.registry.IsLeader(t.Job.AppID) {
+			return ErrNotLeader
+		}
+
+		return task(ctx)
+	}
+}
+
+// DynamicParams 获取动态参数, 未注册动态参数地址时返回 nil
+func (t *JobTask) DynamicParams() lib.DynamicFunc {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.dynamicParams
+}
+
+// SetDynamicParams 设置动态参数函数
+func (t *JobTask) SetDynamicParams(dyn lib.DynamicFunc) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.dynamicParams = dyn
+}
+
+// Notifiers 获取所有的回调, 按照回调地址排序
+func (t *JobTask) Notifiers() []*Notifier {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	all := make([]*Notifier, 0, len(t.notifiers))
+	for _, n := range t.notifiers {
+		all = append(all, n)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].URL < all[j].URL
+	})
+
+	return all
+}
+
+// setSubscribers 将回调地址更新为 urls, 只更新内存
+// 返回新增的回调; 不再需要的回调被停止, 其 outbox 及投递记录由调用方删除
+func (t *JobTask) setSubscribers(urls []string) []*Notifier {
+	t.mu.Lock()
+
+	if t.notifiers == nil {
+		t.notifiers = make(map[string]*Notifier)
+	}
+
+	keep := make(map[string]bool)
+	added := make([]*Notifier, 0)
+	for _, u := range urls {
+		keep[u] = true
+
+		if _, ok := t.notifiers[u]; !ok {
+			n := newNotifier(t, u)
+			t.notifiers[u] = n
+			added = append(added, n)
+		}
+	}
+
+	removed := make([]*Notifier, 0)
+	for u, n := range t.notifiers {
+		if !keep[u] {
+			removed = append(removed, n)
+			delete(t.notifiers, u)
+		}
+	}
+	t.mu.Unlock()
+
+	// Notifier 会读取 t.mu, 不能在持有 t.mu 时停止
+	for _, n := range removed {
+		n.remove()
+	}
+
+	return added
+}
+
 // Start task
+// 已经失败的任务不会自动启动, 需要重新注册或者手动刷新
 func (t *JobTask) Start() {
 	if t.Execable == nil {
 		return
 	}
 
-	if t.Execable.Status == lib.TASK_STARTED {
+	if t.Execable.Started() || t.Execable.Failed() {
 		return
 	}
 
-	diff := time.Now().Local().Sub(t.LastTime)
-	delay := diff - FREQUENCY
+	t.Execable.Start(t.Delay(Now().Local()))
 
-	if delay > 0 && delay < FREQUENCY*time.Second {
-		t.Execable.Start(delay)
-	} else {
-		t.Execable.Start()
+	logger.Info("任务已加入启动队列...")
+}
+
+// Delay 计算任务启动时, 首次执行的延迟
+// 如果保存的结果仍然有效, 则继续使用, 并在剩余有效期减去 Margin 之后刷新
+// 否则立即执行
+func (t *JobTask) Delay(now time.Time) time.Duration {
+	st := t.Snapshot()
+
+	if !st.Valid(now) {
+		return 0
 	}
 
-	logger.Info("任务已加入启动队列...")
+	next := st.NextTime
+	if next.IsZero() || next.After(st.ExpireTime) {
+		next = NextRunTime(now, st.ExpireTime)
+	}
+
+	if !next.After(now) {
+		return 0
+	}
+
+	return next.Sub(now)
+}
+
+// Refresh 立即执行任务, 并重新安排下次执行
+// 已经停止的任务, 刷新成功之后重新启动
+func (t *JobTask) Refresh() error {
+	if t.Execable == nil {
+		return errors.New("任务不可执行")
+	}
+
+	if err := t.Execable.Refresh(); err != nil {
+		return err
+	}
+
+	if !t.Execable.Started() {
+		t.Execable.ClearFailed()
+		t.Start()
+	}
+
+	return nil
 }
 
 // Stop task
+// 同时停止回调的投递
 func (t *JobTask) Stop() {
+	for _, n := range t.Notifiers() {
+		n.Stop()
+	}
+
 	if t.Execable == nil {
 		return
 	}
 
-	if t.Execable.Status == lib.TASK_STARTED {
+	if t.Execable.Started() {
 		t.Execable.Stop()
 	}
 }
 
-// Save into the job model
-func (t *JobTask) Save() {
+// remove 停止任务, 并标记为已删除
+func (t *JobTask) remove() {
+	t.mu.Lock()
+	t.removed = true
+	t.mu.Unlock()
+
+	t.Stop()
+}
+
+// isRemoved 任务是否已经被删除
+func (t *JobTask) isRemoved() bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.removed
+}
+
+// Refreshed 任务执行成功之后调用
+// 更新任务结果, 依据微信返回的 expires_in 计算下次执行时间, 然后保存, 并将结果写入回调的 outbox
+// 结果变化时, 重新执行依赖于当前任务的任务
+func (t *JobTask) Refreshed(ctx context.Context, res map[string]interface{}, value string) {
+	now := Now().Local()
+
+	t.mu.Lock()
+	if t.removed {
+		t.mu.Unlock()
+		return
+	}
+
+	changed := t.state.Value != value
+	t.state.Result = res
+	t.state.Value = value
+	t.state.LastTime = now
+	t.state.ExpireTime = now.Add(ExpiresIn(res))
+	t.state.NextTime = NextRunTime(now, t.state.ExpireTime)
+	t.freq = t.state.NextTime.Sub(now)
+	freq := t.freq
+	t.mu.Unlock()
+
+	if t.Execable != nil {
+		t.Execable.SetFreq(freq)
+	}
+
+	if err := t.Save(); err != nil {
+		logger.Error("保存 Job-"+t.Job.AppID+" 任务 "+JobNames[t.Typ]+" 结果失败: ", err.Error())
+	}
+
+	for _, n := range t.Notifiers() {
+		if err := n.Enqueue(res); err != nil {
+			logger.Error("Job-"+t.Job.AppID+" 任务 "+JobNames[t.Typ]+" 写入回调 "+lib.Redact(n.URL)+" 失败: ", err.Error())
+		}
+	}
+
+	// 多实例部署时, 失去租约之后才结束的执行不再触发
+	if changed && t.Job.registry.IsLeader(t.Job.AppID) {
+		t.Job.refreshDependents(t.Typ)
+	}
+}
+
+// Load 从 model 中恢复任务结果
+// 任务从未执行成功, 或者是旧版本的数据, 对应的 key 可能不存在
+func (t *JobTask) Load() {
 	prefix := "task-" + strconv.Itoa(t.Typ)
 
-	lasttime := t.LastTime.Format("2006-01-02 15:04:05")
-	t.Job.Model.Update(prefix+"-lasttime", lasttime)
+	for _, k := range []string{"result", "value", "lasttime", "expiretime", "nexttime"} {
+		v, err := t.Job.Model.Query(prefix + "-" + k)
+		if err != nil {
+			if err != database.ErrNotFound {
+				logger.Error("恢复 Job-"+t.Job.AppID+" "+prefix+" "+k+" 失败: ", err.Error())
+			}
+			continue
+		}
+
+		t.Set(k, v)
+	}
+
+	// 旧版本数据没有保存过期时间, 依据上次执行时间推算
+	t.mu.Lock()
+	if t.state.ExpireTime.IsZero() && !t.state.LastTime.IsZero() {
+		t.state.ExpireTime = t.state.LastTime.Add(ExpiresIn(t.state.Result))
+	}
+	t.mu.Unlock()
+}
+
+// ExpiresIn 获取微信结果中的 expires_in
+// 微信一般返回数字, 部分接口返回字符串; 获取不到时使用 DEFAULT_EXPIRES_IN
+func ExpiresIn(res map[string]interface{}) time.Duration {
+	sec := 0
+
+	switch v := res["expires_in"].(type) {
+	case float64:
+		sec = int(v)
+	case string:
+		sec, _ = strconv.Atoi(v)
+	}
+
+	if sec <= 0 {
+		sec = DEFAULT_EXPIRES_IN
+	}
+
+	return time.Duration(sec) * time.Second
+}
+
+// stringOf 获取 m 中 key 对应的字符串
+// 微信或者业务系统返回的内容不一定符合预期, 不存在、不是字符串或者为空时返回 false
+func stringOf(m map[string]interface{}, key string) (string, bool) {
+	s, ok := m[key].(string)
+	return s, ok && s != ""
+}
 
-	result, err := json.Marshal(t.Result)
+// NextRunTime 计算下次执行时间, 即过期时间提前 Margin
+// 如果有效期比 Margin 还短, 则在剩余有效期过半时执行
+func NextRunTime(now, expire time.Time) time.Time {
+	next := expire.Add(-Margin)
+	if !next.After(now) {
+		next = now.Add(expire.Sub(now) / 2)
+	}
+
+	return next
+}
+
+// Save into the job model
+// 所有字段在同一个事务中写入, 不会只保存一部分
+// 持有读锁直到写入结束, 已经删除的任务不再保存, 避免重新创建删除的数据
+func (t *JobTask) Save() error {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.removed {
+		return nil
+	}
+
+	st := t.state
+	prefix := "task-" + strconv.Itoa(t.Typ)
+
+	result, err := json.Marshal(st.Result)
 	if err != nil {
-		logger.Error("保存任务结果失败: ", err.Error())
-	} else {
-		t.Job.Model.Update(prefix+"-result", string(result))
+		return err
+	}
+
+	fields := map[string]string{
+		"lasttime":   st.LastTime.Format("2006-01-02 15:04:05"),
+		"expiretime": st.ExpireTime.Format("2006-01-02 15:04:05"),
+		"nexttime":   st.NextTime.Format("2006-01-02 15:04:05"),
+		"result":     string(result),
+		"value":      st.Value,
 	}
 
-	t.Job.Model.Update(prefix+"-value", t.Value)
+	return t.Job.Model.Tx(func(tx database.Tx) error {
+		for k, v := range fields {
+			if err := tx.Set(prefix+"-"+k, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
 }
 
 // Set property of task
 func (t *JobTask) Set(k, v string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
 	switch k {
 	case "lasttime":
 		tm, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.Local)
@@ -172,7 +538,23 @@ func (t *JobTask) Set(k, v string) {
 			break
 		}
 
-		t.LastTime = tm
+		t.state.LastTime = tm
+	case "expiretime":
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.Local)
+		if err != nil {
+			logger.Error("设置 task ExpireTime 属性出错:", err.Error())
+			break
+		}
+
+		t.state.ExpireTime = tm
+	case "nexttime":
+		tm, err := time.ParseInLocation("2006-01-02 15:04:05", v, time.Local)
+		if err != nil {
+			logger.Error("设置 task NextTime 属性出错:", err.Error())
+			break
+		}
+
+		t.state.NextTime = tm
 	case "result":
 		var result map[string]interface{}
 		if err := json.Unmarshal([]byte(v), &result); err != nil {
@@ -180,9 +562,9 @@ func (t *JobTask) Set(k, v string) {
 			break
 		}
 
-		t.Result = result
+		t.state.Result = result
 	case "value":
-		t.Value = v
+		t.state.Value = v
 	default:
 	}
 }
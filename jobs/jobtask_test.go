@@ -0,0 +1,333 @@
+package jobs
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+)
+
+// restoreCase 重启之前 model 中保存的任务数据
+type restoreCase struct {
+	name string
+
+	// rows 相对于当前时间保存的数据, 为 nil 的时间不保存, 模拟旧版本的数据
+	lasttime   *time.Duration
+	expiretime *time.Duration
+	nexttime   *time.Duration
+	expiresIn  int
+
+	// delay 重启之后首次执行的延迟
+	delay time.Duration
+
+	// valid 恢复的结果是否有效
+	valid bool
+}
+
+func ago(d time.Duration) *time.Duration {
+	d = -d
+	return &d
+}
+
+func later(d time.Duration) *time.Duration {
+	return &d
+}
+
+var restoreCases = []restoreCase{
+	{
+		name:       "valid",
+		lasttime:   ago(time.Hour),
+		expiretime: later(time.Hour),
+		nexttime:   later(time.Hour - 200*time.Second),
+		expiresIn:  7200,
+		delay:      time.Hour - 200*time.Second,
+		valid:      true,
+	},
+	{
+		name:       "valid-next-after-expire",
+		lasttime:   ago(time.Hour),
+		expiretime: later(time.Hour),
+		nexttime:   later(2 * time.Hour),
+		expiresIn:  7200,
+		delay:      time.Hour - 200*time.Second,
+		valid:      true,
+	},
+	{
+		name:       "expired",
+		lasttime:   ago(3 * time.Hour),
+		expiretime: ago(time.Hour),
+		nexttime:   ago(time.Hour + 200*time.Second),
+		expiresIn:  7200,
+		delay:      0,
+		valid:      false,
+	},
+	{
+		name:       "due",
+		lasttime:   ago(2*time.Hour - 100*time.Second),
+		expiretime: later(100 * time.Second),
+		nexttime:   ago(100 * time.Second),
+		expiresIn:  7200,
+		delay:      0,
+		valid:      true,
+	},
+	{
+		name:      "legacy-valid",
+		lasttime:  ago(30 * time.Minute),
+		expiresIn: 7200,
+		delay:     90*time.Minute - 200*time.Second,
+		valid:     true,
+	},
+	{
+		name:      "legacy-short-expires",
+		lasttime:  ago(30 * time.Minute),
+		expiresIn: 1900,
+		delay:     50 * time.Second,
+		valid:     true,
+	},
+	{
+		name:      "legacy-expired",
+		lasttime:  ago(3 * time.Hour),
+		expiresIn: 7200,
+		delay:     0,
+		valid:     false,
+	},
+	{
+		name:      "legacy-no-expires-in",
+		lasttime:  ago(time.Hour),
+		expiresIn: 0,
+		delay:     time.Hour - 200*time.Second,
+		valid:     true,
+	},
+	{
+		name:  "never-refreshed",
+		delay: 0,
+		valid: false,
+	},
+}
+
+func TestRestore(t *testing.T) {
+	now := time.Date(2018, 1, 1, 10, 0, 0, 0, time.Local)
+	setClock(t, now)
+
+	for typ := 0; typ < JOB_MAX_LIMIT; typ++ {
+		for _, c := range restoreCases {
+			typ, c := typ, c
+
+			t.Run(JobNames[typ]+"/"+c.name, func(t *testing.T) {
+				appid := "wx-restore-" + strconv.Itoa(typ) + "-" + c.name
+				_, j := newTestJob(t, appid)
+				newTask(t, j, typ, "http://127.0.0.1:1/params", "", "")
+
+				saveRows(t, j.Model, typ, now, c)
+
+				// 模拟重启, 从 model 中恢复
+				tk := restart(t, j.Model, typ)
+				st := tk.Snapshot()
+
+				if got := st.Valid(now); got != c.valid {
+					t.Fatalf("结果有效: 期望 %v, 实际 %v", c.valid, got)
+				}
+
+				if got := tk.Delay(now); got != c.delay {
+					t.Fatalf("首次执行延迟: 期望 %v, 实际 %v", c.delay, got)
+				}
+
+				if c.lasttime == nil {
+					return
+				}
+
+				if st.Value != "VALUE-"+appid || st.Result["value"] != "VALUE-"+appid {
+					t.Fatalf("任务结果没有恢复: %v", st)
+				}
+
+				if !st.LastTime.Equal(now.Add(*c.lasttime)) {
+					t.Fatalf("上次执行时间: 期望 %v, 实际 %v", now.Add(*c.lasttime), st.LastTime)
+				}
+			})
+		}
+	}
+}
+
+// TestRestoreAfterRefreshed 刷新成功之后保存的数据, 重启之后在原定的时间刷新
+func TestRestoreAfterRefreshed(t *testing.T) {
+	start := time.Date(2018, 1, 1, 10, 0, 0, 0, time.Local)
+
+	for typ := 0; typ < JOB_MAX_LIMIT; typ++ {
+		typ := typ
+
+		t.Run(JobNames[typ], func(t *testing.T) {
+			setClock(t, start)
+
+			appid := "wx-refreshed-" + strconv.Itoa(typ)
+			_, j := newTestJob(t, appid)
+			tk := newTask(t, j, typ, "http://127.0.0.1:1/params", "", "")
+
+			tk.Refreshed(nil, map[string]interface{}{"expires_in": float64(7200)}, "VALUE")
+
+			// 一小时之后重启
+			now := start.Add(time.Hour)
+			setClock(t, now)
+
+			restored := restart(t, j.Model, typ)
+			if restored.Value() != "VALUE" {
+				t.Fatalf("任务结果没有恢复: %v", restored.Snapshot())
+			}
+
+			if got, want := restored.Delay(now), time.Hour-Margin; got != want {
+				t.Fatalf("首次执行延迟: 期望 %v, 实际 %v", want, got)
+			}
+
+			// 过期之后重启, 立即执行
+			if got := restored.Delay(start.Add(3 * time.Hour)); got != 0 {
+				t.Fatalf("过期之后首次执行延迟: 期望 0, 实际 %v", got)
+			}
+		})
+	}
+}
+
+// saveRows 按照 c 写入任务数据, 时间相对于 now
+func saveRows(t *testing.T, m *database.Model, typ int, now time.Time, c restoreCase) {
+	t.Helper()
+
+	prefix := "task-" + strconv.Itoa(typ) + "-"
+	rows := map[string]*time.Duration{
+		"lasttime":   c.lasttime,
+		"expiretime": c.expiretime,
+		"nexttime":   c.nexttime,
+	}
+
+	for k, d := range rows {
+		if d == nil {
+			continue
+		}
+
+		if err := m.Update(prefix+k, now.Add(*d).Format("2006-01-02 15:04:05")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c.lasttime == nil {
+		return
+	}
+
+	value := "VALUE-" + m.AppID
+	result := `{"value":"` + value + `"}`
+	if c.expiresIn > 0 {
+		result = `{"value":"` + value + `","expires_in":` + strconv.Itoa(c.expiresIn) + `}`
+	}
+
+	if err := m.Update(prefix+"result", result); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Update(prefix+"value", value); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// restart 在新的注册中心中从 model 恢复 Job, 返回 typ 类型的任务
+func restart(t *testing.T, m *database.Model, typ int) *JobTask {
+	t.Helper()
+
+	reg := NewRegistry()
+	j, err := reg.Load(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(j.Stop)
+
+	tk, ok := j.Task(typ)
+	if !ok {
+		t.Fatal("任务没有恢复: " + JobNames[typ])
+	}
+
+	return tk
+}
+
+// TestSaveAfterRemove 删除之前开始的刷新, 在删除之后才保存结果时, 不会重新创建数据
+func TestSaveAfterRemove(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-save-after-remove"
+	srv.AddApp(appid, "secret-"+appid)
+	reg, j := newTestJob(t, appid)
+
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+	if err := tk.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Remove(appid); err != nil {
+		t.Fatal(err)
+	}
+
+	// 模拟删除之前开始的刷新, 在删除之后才保存
+	if err := tk.Save(); err != nil {
+		t.Fatalf("已经删除的任务不再保存: %v", err)
+	}
+
+	if all, err := testStore.List(appid, ""); err != nil || len(all) != 0 {
+		t.Fatalf("删除之后数据被重新创建: %v %v", all, err)
+	}
+
+	appids, _ := testStore.AppIDs()
+	for _, id := range appids {
+		if id == appid {
+			t.Fatal("删除之后 appid 被重新创建")
+		}
+	}
+}
+
+// TestSaveAfterRemoveTask 删除任务之后, 不会再保存该任务的结果
+func TestSaveAfterRemoveTask(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-save-after-remove-task"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+
+	newTask(t, j, JOB_WEB_ACCESS_TOKEN, "http://127.0.0.1:1/params", "", "")
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+	if err := tk.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := j.RemoveTask(JOB_ACCESS_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tk.Save(); err != nil {
+		t.Fatalf("已经删除的任务不再保存: %v", err)
+	}
+
+	if all, err := j.Model.List("task-0-"); err != nil || len(all) != 0 {
+		t.Fatalf("删除之后任务数据被重新创建: %v %v", all, err)
+	}
+}
+
+// TestSaveDropped 数据已经被删除而任务尚未停止时, 保存返回错误, 不写入任何字段
+func TestSaveDropped(t *testing.T) {
+	appid := "wx-save-dropped"
+	_, j := newTestJob(t, appid)
+
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+	tk.Refreshed(nil, map[string]interface{}{"access_token": "TOKEN", "expires_in": float64(7200)}, "TOKEN")
+
+	all, err := j.Model.List("task-0-")
+	if err != nil || len(all) != 5 || all["task-0-value"] != "TOKEN" {
+		t.Fatalf("保存任务结果: %v %v", all, err)
+	}
+
+	if err := database.RemoveModel(appid); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tk.Save(); err != database.ErrDropped {
+		t.Fatalf("数据已经被删除时应当返回 ErrDropped: %v", err)
+	}
+
+	if all, err := testStore.List(appid, ""); err != nil || len(all) != 0 {
+		t.Fatalf("删除之后数据被重新创建: %v %v", all, err)
+	}
+}
@@ -1,9 +1,9 @@
 package jobs
 
 import (
+	"context"
 	"errors"
 	"net/url"
-	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
@@ -18,29 +18,34 @@ func JsApiTicket(tk *JobTask) *lib.JobServer {
 	taskName := "jsapi_ticket"
 	t := tk.Job
 
-	task := func() error {
+	task := func(ctx context.Context) error {
 		query := url.Values{}
 
 		// access_token 有两种来源
 		accessToken := ""
 
 		// 1、现有 APPID 的 access_token 任务
-		accessTk, ok := t.Tasks[JOB_ACCESS_TOKEN]
+		accessTk, ok := t.Task(JOB_ACCESS_TOKEN)
 		if !ok {
-			if tk.DynamicParams == nil {
+			dynamicParams := tk.DynamicParams()
+			if dynamicParams == nil {
 				return errors.New("启动 " + taskName + " 任务失败, 注册须指定 DynamicParams 参数")
 			}
 
 			// 2、是从业务 APP 获取过来
-			params := tk.DynamicParams(t.AppID, JOB_ACCESS_TOKEN)
-			token, has := params["access_token"]
-			if !has {
+			params, err := dynamicParams(ctx, t.AppID, JOB_ACCESS_TOKEN)
+			if err != nil {
+				return err
+			}
+
+			token, ok := stringOf(params, "access_token")
+			if !ok {
 				return errors.New("刷新 " + taskName + " 失败: 未找到有效 access_token")
 			}
 
-			accessToken = token.(string)
+			accessToken = token
 		} else {
-			accessToken = accessTk.Value
+			accessToken = accessTk.Value()
 		}
 
 		if accessToken == "" {
@@ -50,7 +55,7 @@ func JsApiTicket(tk *JobTask) *lib.JobServer {
 		query.Add("access_token", accessToken)
 
 		res := map[string]interface{}{}
-		_, err := lib.Request(tk.API, query, nil, &res)
+		_, err := lib.Request(ctx, tk.API, query, nil, &res)
 		if err != nil {
 			return err
 		}
@@ -59,17 +64,15 @@ func JsApiTicket(tk *JobTask) *lib.JobServer {
 			return err
 		}
 
-		tk.Result = res
-		tk.Value = res["ticket"].(string)
-		tk.LastTime = time.Now().Local()
-		tk.Save()
-
-		if tk.CallBack != nil {
-			tk.CallBack(t.AppID, JOB_JSAPI_TICKET, res)
+		ticket, ok := stringOf(res, "ticket")
+		if !ok {
+			return errors.New("刷新 " + taskName + " 失败: 微信返回的结果中没有 ticket")
 		}
 
+		tk.Refreshed(ctx, res, ticket)
+
 		return nil
 	}
 
-	return lib.NewJobServer(t.AppID, taskName, task, tk.Freq)
+	return lib.NewJobServer(t.AppID, taskName, tk.guard(task), tk.Freq())
 }
@@ -0,0 +1,551 @@
+package jobs
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+// NOTIFY_HISTORY_SIZE 每个任务保留的回调记录数量
+const NOTIFY_HISTORY_SIZE = 20
+
+// NOTIFY_SECRET_MIN_LEN 回调签名密钥的最小长度
+const NOTIFY_SECRET_MIN_LEN = 16
+
+// NOTIFY_IDLE 没有待投递的回调时, 检查 outbox 的间隔
+// 正常情况下新的结果会立即投递, 这里只是兜底
+const NOTIFY_IDLE = time.Hour
+
+// 回调记录的状态
+const (
+	// NOTIFY_DELIVERED 业务系统已经返回 2xx
+	NOTIFY_DELIVERED = "delivered"
+
+	// NOTIFY_DROPPED 投递成功之前已经有了更新的结果, 或者已经不再需要回调
+	NOTIFY_DROPPED = "dropped"
+)
+
+// ErrNotifyNotFound 任务没有注册指定的回调地址
+var ErrNotifyNotFound = errors.New("当前任务并未注册指定的回调地址")
+
+// NotifyRetryPolicy 回调失败之后的重试策略
+// 一直重试, 直到业务系统返回 2xx, 或者有了更新的结果
+var NotifyRetryPolicy = lib.RetryPolicy{
+	Initial:     5 * time.Second,
+	Multiplier:  2,
+	Max:         10 * time.Minute,
+	Jitter:      0.2,
+	MaxAttempts: lib.RETRY_FOREVER,
+}
+
+// NotifyScheduler 回调投递使用的调度器
+// 与刷新任务的 lib.DefaultScheduler 分开, 业务系统的回调地址无法访问时, 不会占用刷新任务的 worker
+var NotifyScheduler = lib.NewScheduler(lib.DEFAULT_WORKERS)
+
+// Delivery 待投递的回调, 保存在 outbox 中
+type Delivery struct {
+	ID        int64                  `json:"id"`
+	Payload   map[string]interface{} `json:"payload"`
+	CreatedAt string                 `json:"created"`
+	Attempts  int                    `json:"attempts"`
+	LastError string                 `json:"error"`
+}
+
+// DeliveryRecord 回调记录, 不包含回调的内容
+type DeliveryRecord struct {
+	ID         int64  `json:"id"`
+	Status     string `json:"status"`
+	CreatedAt  string `json:"created"`
+	FinishedAt string `json:"finished"`
+	Attempts   int    `json:"attempts"`
+	LastError  string `json:"error"`
+}
+
+// NotifyStatus 单个回调地址的状态, 用于运维查询
+type NotifyStatus struct {
+	// URL 回调地址, 其中的敏感参数被隐去
+	URL string `json:"url"`
+
+	// Pending 是否有待投递的回调
+	Pending   bool   `json:"pending"`
+	Attempts  int    `json:"attempts"`
+	LastError string `json:"error"`
+	NextTime  string `json:"nexttime"`
+
+	// History 最近的回调记录, 最新的在前
+	History []DeliveryRecord `json:"history"`
+}
+
+// Notifier 任务结果对单个回调地址的投递
+// 结果先写入 outbox 持久化, 再由调度器投递; 失败之后按照 NotifyRetryPolicy 重试, 重启或者主实例切换之后继续投递
+// 每个回调地址的 outbox 只保存最新的一个结果, 有了更新的结果之后, 尚未投递成功的旧结果被丢弃, 因此业务系统收到的结果是有序的
+// 同一任务的多个回调地址互不影响
+type Notifier struct {
+	// URL 回调地址
+	URL string
+
+	task     *JobTask
+	id       string
+	callBack lib.CallBackFunc
+	server   *lib.JobServer
+
+	// mu 保证 outbox 的读写顺序
+	mu sync.Mutex
+
+	// removed 回调地址已经被删除, 正在进行的投递不再保存结果
+	removed bool
+
+	// secret 回调签名使用的密钥, 为空时不签名
+	// 每个回调地址单独保存, 业务系统之间不能伪造对方的回调
+	secret string
+}
+
+func newNotifier(t *JobTask, addr string) *Notifier {
+	sum := sha256.Sum256([]byte(addr))
+
+	n := &Notifier{
+		URL:  addr,
+		task: t,
+		id:   hex.EncodeToString(sum[:8]),
+	}
+
+	n.callBack = lib.CallBackFuncFactory(addr, n.Secret)
+	if err := n.loadSecret(); err != nil {
+		logger.Error("Job-"+t.Job.AppID+" 任务 "+JobNames[t.Typ]+" 读取回调 "+lib.Redact(addr)+" 的签名密钥失败: ", err.Error())
+	}
+
+	n.server = lib.NewJobServer(t.Job.AppID, "notify "+JobNames[t.Typ]+" "+lib.Redact(addr), n.deliver, NOTIFY_IDLE)
+	n.server.SetRetry(NotifyRetryPolicy)
+	n.server.SetScheduler(NotifyScheduler)
+
+	return n
+}
+
+// outboxKey 待投递的回调, 以回调地址的摘要区分
+func (n *Notifier) outboxKey() string {
+	return "task-" + strconv.Itoa(n.task.Typ) + "-notify-" + n.id
+}
+
+func (n *Notifier) historyKey() string {
+	return n.outboxKey() + "-history"
+}
+
+func (n *Notifier) secretKey() string {
+	return n.outboxKey() + "-secret"
+}
+
+// Secret 获取回调签名使用的密钥
+func (n *Notifier) Secret() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.secret
+}
+
+// setSecret 设置回调签名使用的密钥, 之后的投递立即生效
+func (n *Notifier) setSecret(secret string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if err := n.task.Job.Model.Update(n.secretKey(), secret); err != nil {
+		return err
+	}
+
+	n.secret = secret
+	return nil
+}
+
+// loadSecret 从 model 中读取签名密钥, 其他实例可能修改过
+func (n *Notifier) loadSecret() error {
+	secret, err := n.task.Job.Model.Query(n.secretKey())
+	if err != nil && err != database.ErrNotFound {
+		return err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.secret = secret
+	return nil
+}
+
+// Enqueue 将任务结果写入 outbox, 尚未投递成功的旧结果被丢弃
+// 当前实例是主实例时立即投递
+func (n *Notifier) Enqueue(res map[string]interface{}) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.isRemoved() {
+		return nil
+	}
+
+	now := time.Now().Local()
+	d := &Delivery{
+		ID:        now.UnixNano(),
+		Payload:   res,
+		CreatedAt: formatTime(now),
+	}
+
+	err := n.task.Job.Model.Tx(func(tx database.Tx) error {
+		old, err := getDelivery(tx, n.outboxKey())
+		if err != nil {
+			return err
+		}
+
+		if old != nil {
+			if err := n.record(tx, old, NOTIFY_DROPPED, "已有更新的结果"); err != nil {
+				return err
+			}
+		}
+
+		return putJSON(tx, n.outboxKey(), d)
+	})
+	if err != nil {
+		return err
+	}
+
+	if n.task.Job.registry.IsLeader(n.task.Job.AppID) {
+		n.start()
+	}
+
+	return nil
+}
+
+// Resume 开始投递 outbox 中的回调, 成为主实例时调用
+// 已经开始时不做处理
+func (n *Notifier) Resume() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.removed || n.server.Started() {
+		return
+	}
+
+	n.server.Start()
+}
+
+// start 启动投递, 已经启动时立即投递
+// 调用方需持有 n.mu
+func (n *Notifier) start() {
+	if n.server.Started() {
+		n.server.Kick()
+		return
+	}
+
+	n.server.Start()
+}
+
+// Stop 停止投递, outbox 中的回调由下一个主实例继续投递
+func (n *Notifier) Stop() {
+	if n.server.Started() {
+		n.server.Stop()
+	}
+}
+
+// remove 停止投递, 并标记为已删除
+// outbox 及投递记录由调用方删除
+func (n *Notifier) remove() {
+	n.mu.Lock()
+	n.removed = true
+	n.mu.Unlock()
+
+	n.Stop()
+}
+
+// isRemoved 回调地址或者所属的任务是否已经被删除
+// 调用方需持有 n.mu
+func (n *Notifier) isRemoved() bool {
+	return n.removed || n.task.isRemoved()
+}
+
+// pending 获取待投递的回调, 没有时返回 nil
+func (n *Notifier) pending() (*Delivery, error) {
+	v, err := n.task.Job.Model.Query(n.outboxKey())
+	if err == database.ErrNotFound || (err == nil && v == "") {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Delivery{}
+	if err := json.Unmarshal([]byte(v), d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// deliver 投递 outbox 中的回调, 直到 outbox 为空
+func (n *Notifier) deliver(ctx context.Context) error {
+	for {
+		n.mu.Lock()
+		d, err := n.pending()
+		n.mu.Unlock()
+
+		if err != nil || d == nil {
+			return err
+		}
+
+		if err := n.callBack(ctx, n.task.Job.AppID, n.task.Typ, d.Payload); err != nil {
+			n.fail(d, err)
+			return err
+		}
+
+		if err := n.finish(d); err != nil {
+			return err
+		}
+	}
+}
+
+// finish 投递成功, 从 outbox 中删除并记录
+// 投递期间写入了更新的结果时, 只更新记录
+func (n *Notifier) finish(d *Delivery) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.isRemoved() {
+		return nil
+	}
+
+	d.Attempts++
+
+	return n.task.Job.Model.Tx(func(tx database.Tx) error {
+		cur, err := getDelivery(tx, n.outboxKey())
+		if err != nil {
+			return err
+		}
+
+		if cur != nil && cur.ID == d.ID {
+			if err := tx.Delete(n.outboxKey()); err != nil {
+				return err
+			}
+		}
+
+		return n.record(tx, d, NOTIFY_DELIVERED, "")
+	})
+}
+
+// fail 记录失败的投递, 调度器随后重试
+func (n *Notifier) fail(d *Delivery, cause error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.isRemoved() {
+		return
+	}
+
+	err := n.task.Job.Model.Tx(func(tx database.Tx) error {
+		cur, err := getDelivery(tx, n.outboxKey())
+		if err != nil || cur == nil || cur.ID != d.ID {
+			return err
+		}
+
+		cur.Attempts++
+		cur.LastError = cause.Error()
+		return putJSON(tx, n.outboxKey(), cur)
+	})
+	if err != nil {
+		logger.Error("Job-"+n.task.Job.AppID+" 任务 "+JobNames[n.task.Typ]+" 保存回调状态失败: ", err.Error())
+	}
+}
+
+// record 添加回调记录, 同一个回调只保留一条
+// 被丢弃的回调随后又投递成功时, 以投递成功为准
+func (n *Notifier) record(tx database.Tx, d *Delivery, status, reason string) error {
+	history, err := getHistory(tx, n.historyKey())
+	if err != nil {
+		return err
+	}
+
+	rec := DeliveryRecord{
+		ID:         d.ID,
+		Status:     status,
+		CreatedAt:  d.CreatedAt,
+		FinishedAt: formatTime(time.Now().Local()),
+		Attempts:   d.Attempts,
+		LastError:  reason,
+	}
+
+	all := []DeliveryRecord{rec}
+	for _, h := range history {
+		if h.ID != d.ID && len(all) < NOTIFY_HISTORY_SIZE {
+			all = append(all, h)
+		}
+	}
+
+	return putJSON(tx, n.historyKey(), all)
+}
+
+// Status 获取回调状态
+func (n *Notifier) Status() NotifyStatus {
+	d, err := n.pending()
+	if err != nil {
+		logger.Error("Job-"+n.task.Job.AppID+" 任务 "+JobNames[n.task.Typ]+" 读取回调失败: ", err.Error())
+	}
+
+	history := make([]DeliveryRecord, 0)
+	if v, err := n.task.Job.Model.Query(n.historyKey()); err == nil && v != "" {
+		if err := json.Unmarshal([]byte(v), &history); err != nil {
+			logger.Error("Job-"+n.task.Job.AppID+" 任务 "+JobNames[n.task.Typ]+" 读取回调记录失败: ", err.Error())
+		}
+	}
+
+	status := NotifyStatus{URL: lib.Redact(n.URL), History: history}
+	if d != nil {
+		status.Pending = true
+		status.Attempts = d.Attempts
+		status.LastError = d.LastError
+
+		if stats := n.server.Stats(); stats.Started {
+			status.NextTime = formatTime(stats.NextRun)
+		}
+	}
+
+	return status
+}
+
+// getDelivery 读取事务中的回调, 没有时返回 nil
+func getDelivery(tx database.Tx, key string) (*Delivery, error) {
+	v, err := tx.Get(key)
+	if err == database.ErrNotFound || (err == nil && v == "") {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	d := &Delivery{}
+	if err := json.Unmarshal([]byte(v), d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// getHistory 读取事务中的回调记录
+func getHistory(tx database.Tx, key string) ([]DeliveryRecord, error) {
+	v, err := tx.Get(key)
+	if err == database.ErrNotFound || (err == nil && v == "") {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	history := make([]DeliveryRecord, 0)
+	if err := json.Unmarshal([]byte(v), &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+func putJSON(tx database.Tx, key string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return tx.Set(key, string(b))
+}
+
+// notifyCurrent 将当前有效的结果投递给新增的回调
+func (t *JobTask) notifyCurrent(added []*Notifier) {
+	st := t.Snapshot()
+	if len(added) == 0 || !st.Valid(Now()) {
+		return
+	}
+
+	for _, n := range added {
+		if err := n.Enqueue(st.Result); err != nil {
+			logger.Error("Job-"+t.Job.AppID+" 任务 "+JobNames[t.Typ]+" 写入回调 "+lib.Redact(n.URL)+" 失败: ", err.Error())
+		}
+	}
+}
+
+// setNotifySecret 设置回调地址 addr 签名使用的密钥
+// secret 为空时保留原有的密钥, 避免未传入密钥的注册关闭签名
+func (t *JobTask) setNotifySecret(addr, secret string) error {
+	if addr == "" || secret == "" {
+		return nil
+	}
+
+	t.mu.RLock()
+	n, ok := t.notifiers[addr]
+	t.mu.RUnlock()
+
+	if !ok {
+		return ErrNotifyNotFound
+	}
+
+	return n.setSecret(secret)
+}
+
+// loadNotifySecrets 重新读取所有回调的签名密钥
+func (t *JobTask) loadNotifySecrets() error {
+	for _, n := range t.Notifiers() {
+		if err := n.loadSecret(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// parseSubscribers 读取 model 中保存的回调地址
+// 旧版本只有一个回调地址, 保存的是地址本身
+func parseSubscribers(s string) ([]string, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return []string{}, nil
+	}
+
+	if !strings.HasPrefix(s, "[") {
+		return []string{s}, nil
+	}
+
+	urls := make([]string, 0)
+	if err := json.Unmarshal([]byte(s), &urls); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
+
+// formatSubscribers 用于保存到 model
+func formatSubscribers(urls []string) string {
+	b, _ := json.Marshal(urls)
+	return string(b)
+}
+
+// mergeSubscribers 合并回调地址, 去重并排序, 忽略空地址
+func mergeSubscribers(urls []string, add ...string) []string {
+	seen := make(map[string]bool)
+	all := make([]string, 0, len(urls)+len(add))
+
+	for _, u := range append(append([]string{}, urls...), add...) {
+		if u == "" || seen[u] {
+			continue
+		}
+
+		seen[u] = true
+		all = append(all, u)
+	}
+
+	sort.Strings(all)
+	return all
+}
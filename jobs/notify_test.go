@@ -0,0 +1,337 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/callback"
+	"github.com/zjxpcyc/wechat-scheduler/database"
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+// subscriber 模拟业务系统的回调地址, 使用 secret 校验签名
+type subscriber struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	verified int
+	rejected int
+	failed   int
+
+	// fail 返回 true 时, 回调返回 500
+	fail func(payload map[string]interface{}) bool
+
+	// received 签名校验通过并返回 2xx 的回调内容
+	received []map[string]interface{}
+}
+
+func newSubscriber(t *testing.T, secret string) *subscriber {
+	s := &subscriber{}
+	v := callback.NewVerifier(secret)
+
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := v.Verify(r)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		if err != nil {
+			s.rejected++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		payload := make(map[string]interface{})
+		json.Unmarshal(body, &payload)
+
+		if s.fail != nil && s.fail(payload) {
+			s.failed++
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		s.verified++
+		s.received = append(s.received, payload)
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// failWhen 之后的回调在 fail 返回 true 时失败, nil 代表不再失败
+func (s *subscriber) failWhen(fail func(payload map[string]interface{}) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.fail = fail
+}
+
+// failTimes 之后的 n 次回调失败
+func (s *subscriber) failTimes(n int) {
+	s.failWhen(func(map[string]interface{}) bool {
+		n--
+		return n >= 0
+	})
+}
+
+// values 收到的回调中的 access_token, 按照收到的顺序
+func (s *subscriber) values() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	values := make([]string, 0, len(s.received))
+	for _, p := range s.received {
+		v, _ := p["access_token"].(string)
+		values = append(values, v)
+	}
+
+	return values
+}
+
+// failures 返回 500 的回调数量
+func (s *subscriber) failures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.failed
+}
+
+// counts 签名校验通过及失败的回调数量
+func (s *subscriber) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.verified, s.rejected
+}
+
+// waitVerified 等待签名校验通过的回调达到 n 次, 期间不能有校验失败的回调
+func (s *subscriber) waitVerified(t *testing.T, what string, n int) {
+	t.Helper()
+
+	waitFor(t, what, func() bool {
+		verified, rejected := s.counts()
+		if rejected > 0 {
+			t.Fatalf("%s: 回调签名校验失败 %d 次", what, rejected)
+		}
+
+		return verified >= n
+	})
+}
+
+const (
+	SECRET_A = "secret-of-subscriber-a"
+	SECRET_B = "secret-of-subscriber-b"
+)
+
+// TestNotifySecretPerSubscriber 每个回调地址使用各自的密钥签名
+func TestNotifySecretPerSubscriber(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-notify-secret"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+
+	a := newSubscriber(t, SECRET_A)
+	b := newSubscriber(t, SECRET_B)
+
+	newTask(t, j, JOB_ACCESS_TOKEN, "", a.URL, SECRET_A)
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", b.URL, SECRET_B)
+
+	if err := tk.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	a.waitVerified(t, "a 收到回调", 1)
+	b.waitVerified(t, "b 收到回调", 1)
+
+	// 重新注册时不传入密钥, 保留原有的密钥
+	newTask(t, j, JOB_ACCESS_TOKEN, "", a.URL, "")
+	if err := tk.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	a.waitVerified(t, "不传入密钥时 a 仍然使用原有的密钥", 2)
+	b.waitVerified(t, "不传入密钥时 b 不受影响", 2)
+
+	// 添加已经存在的回调地址时更新密钥
+	c := newSubscriber(t, SECRET_B+"-new")
+	if err := j.AddNotify(JOB_ACCESS_TOKEN, c.URL, SECRET_B); err != nil {
+		t.Fatal(err)
+	}
+	if err := j.AddNotify(JOB_ACCESS_TOKEN, c.URL, SECRET_B+"-new"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tk.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	c.waitVerified(t, "c 使用更新之后的密钥", 1)
+}
+
+// TestNotifySecretRemoved 删除回调地址时同时删除其密钥
+func TestNotifySecretRemoved(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-notify-secret-removed"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+
+	a := newSubscriber(t, SECRET_A)
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", a.URL, SECRET_A)
+
+	key := tk.Notifiers()[0].secretKey()
+	if v, err := j.Model.Query(key); err != nil || v != SECRET_A {
+		t.Fatalf("密钥没有保存: %q %v", v, err)
+	}
+
+	if err := j.RemoveNotify(JOB_ACCESS_TOKEN, a.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := j.Model.Query(key); err != database.ErrNotFound {
+		t.Fatalf("删除回调地址之后密钥应当被删除: %v", err)
+	}
+}
+
+// fastNotifyRetry 缩短回调的重试间隔, 测试结束时恢复
+// 需要在创建任务之前调用
+func fastNotifyRetry(t *testing.T) {
+	policy := NotifyRetryPolicy
+	NotifyRetryPolicy = lib.RetryPolicy{
+		Initial:     10 * time.Millisecond,
+		Multiplier:  1,
+		Max:         10 * time.Millisecond,
+		MaxAttempts: lib.RETRY_FOREVER,
+	}
+
+	t.Cleanup(func() { NotifyRetryPolicy = policy })
+}
+
+// result 微信返回的 access_token 结果
+func result(token string) map[string]interface{} {
+	return map[string]interface{}{"access_token": token, "expires_in": float64(7200)}
+}
+
+// TestNotifyRetry 回调失败之后一直重试, 直到业务系统返回 2xx
+func TestNotifyRetry(t *testing.T) {
+	fastNotifyRetry(t)
+
+	appid := "wx-notify-retry"
+	_, j := newTestJob(t, appid)
+
+	sub := newSubscriber(t, SECRET_A)
+	sub.failTimes(3)
+
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", sub.URL, SECRET_A)
+	tk.Refreshed(nil, result("A"), "A")
+
+	sub.waitVerified(t, "重试之后投递成功", 1)
+
+	if got := sub.failures(); got != 3 {
+		t.Fatalf("期望失败 3 次, 实际 %d 次", got)
+	}
+
+	n := tk.Notifiers()[0]
+	waitFor(t, "记录投递结果", func() bool { return len(n.Status().History) == 1 })
+
+	st := n.Status()
+	if st.Pending {
+		t.Fatal("投递成功之后 outbox 应当为空")
+	}
+
+	if rec := st.History[0]; rec.Status != NOTIFY_DELIVERED || rec.Attempts != 4 {
+		t.Fatalf("投递记录: %+v", rec)
+	}
+
+	if got := sub.values(); !reflect.DeepEqual(got, []string{"A"}) {
+		t.Fatalf("收到的回调: %v", got)
+	}
+}
+
+// TestNotifyRestart 重启之后继续投递 outbox 中的回调, 并保留已经失败的次数
+func TestNotifyRestart(t *testing.T) {
+	fastNotifyRetry(t)
+
+	appid := "wx-notify-restart"
+	_, j := newTestJob(t, appid)
+
+	sub := newSubscriber(t, SECRET_A)
+	sub.failWhen(func(map[string]interface{}) bool { return true })
+
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", sub.URL, SECRET_A)
+	tk.Refreshed(nil, result("A"), "A")
+
+	n := tk.Notifiers()[0]
+	waitFor(t, "投递失败", func() bool { return n.Status().Attempts >= 2 })
+
+	// 模拟进程退出
+	j.Stop()
+	attempts := n.Status().Attempts
+	sub.failWhen(nil)
+
+	restored := restart(t, j.Model, JOB_ACCESS_TOKEN)
+	rn := restored.Notifiers()
+	if len(rn) != 1 || rn[0].Secret() != SECRET_A {
+		t.Fatal("回调地址及密钥没有恢复")
+	}
+
+	st := rn[0].Status()
+	if !st.Pending || st.Attempts < attempts || st.LastError == "" {
+		t.Fatalf("重启之后 outbox 应当保留待投递的回调: %+v", st)
+	}
+
+	// 成为主实例
+	rn[0].Resume()
+	sub.waitVerified(t, "重启之后投递成功", 1)
+
+	waitFor(t, "记录投递结果", func() bool { return len(rn[0].Status().History) == 1 })
+
+	if rec := rn[0].Status().History[0]; rec.Status != NOTIFY_DELIVERED || rec.Attempts <= attempts {
+		t.Fatalf("投递记录应当包含重启之前的失败次数: %+v", rec)
+	}
+
+	if got := sub.values(); !reflect.DeepEqual(got, []string{"A"}) {
+		t.Fatalf("收到的回调: %v", got)
+	}
+}
+
+// TestNotifyDropped 投递成功之前有了更新的结果时, 旧的结果被丢弃, 业务系统只收到最新的结果
+func TestNotifyDropped(t *testing.T) {
+	fastNotifyRetry(t)
+
+	appid := "wx-notify-dropped"
+	_, j := newTestJob(t, appid)
+
+	sub := newSubscriber(t, SECRET_A)
+	sub.failWhen(func(payload map[string]interface{}) bool { return payload["access_token"] == "A" })
+
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", sub.URL, SECRET_A)
+	tk.Refreshed(nil, result("A"), "A")
+
+	n := tk.Notifiers()[0]
+	waitFor(t, "投递失败", func() bool { return n.Status().Attempts >= 1 })
+
+	tk.Refreshed(nil, result("B"), "B")
+	sub.waitVerified(t, "投递更新的结果", 1)
+
+	waitFor(t, "记录投递结果", func() bool { return len(n.Status().History) == 2 })
+
+	st := n.Status()
+	if st.Pending {
+		t.Fatal("投递成功之后 outbox 应当为空")
+	}
+
+	delivered, dropped := st.History[0], st.History[1]
+	if delivered.Status != NOTIFY_DELIVERED || dropped.Status != NOTIFY_DROPPED || dropped.Attempts < 1 || dropped.ID >= delivered.ID {
+		t.Fatalf("投递记录: %+v", st.History)
+	}
+
+	if got := sub.values(); !reflect.DeepEqual(got, []string{"B"}) {
+		t.Fatalf("旧的结果应当被丢弃: %v", got)
+	}
+}
@@ -0,0 +1,302 @@
+package jobs
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+)
+
+// ErrNotLeader 多实例部署时, 当前实例不是 appid 的主实例
+var ErrNotLeader = errors.New("当前实例不是主实例, 请稍后重试")
+
+// Registry Job 注册中心
+// 以 appid 为 key 持有所有注册的 Job, 可以被多个协程同时访问
+type Registry struct {
+	mu   sync.RWMutex
+	jobs map[string]*Job
+
+	// elector 多实例部署时的选主, 为 nil 时代表单实例运行
+	elector *Elector
+}
+
+// NewRegistry 新建一个空的注册中心
+func NewRegistry() *Registry {
+	return &Registry{
+		jobs: make(map[string]*Job),
+	}
+}
+
+// NewJob 新建一个 Job
+// 如果同一个 appid 多次创建, 那么返回的是同一个 Job
+// 因此 可以支持 runtime 更新 Job
+func (r *Registry) NewJob(appid, appsecret string) (*Job, error) {
+	if appid == "" || appsecret == "" {
+		return nil, errors.New("新建 Job 失败, appid 或者 appsecret 不能为空")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	m, err := database.NewModel(appid)
+	if err != nil {
+		return nil, err
+	}
+
+	// 重复注册, 以最后一次为准
+	// 因为有可能出现 appsecret 变更的情况
+	err = m.Tx(func(tx database.Tx) error {
+		if err := tx.Set("appid", appid); err != nil {
+			return err
+		}
+
+		return tx.Set("appsecret", appsecret)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return r.addJob(m, appsecret), nil
+}
+
+// addJob 在内存中新建或者更新 Job, 不写入 model
+// 调用方需持有 r.mu
+func (r *Registry) addJob(m *database.Model, appsecret string) *Job {
+	if j, ok := r.jobs[m.AppID]; ok {
+		j.setSecret(appsecret)
+		return j
+	}
+
+	j := &Job{
+		AppID:     m.AppID,
+		Model:     m,
+		registry:  r,
+		appSecret: appsecret,
+		tasks:     make(map[int]*JobTask),
+	}
+
+	r.jobs[m.AppID] = j
+	return j
+}
+
+// Load 从 model 中恢复 Job 及其任务
+// 只更新内存, 不会写入 model
+func (r *Registry) Load(m *database.Model) (*Job, error) {
+	appsecret, err := m.Query("appsecret")
+	if err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	j := r.addJob(m, appsecret)
+	r.mu.Unlock()
+
+	return j, j.Load()
+}
+
+// Refresh 立即刷新指定任务, 返回刷新之后的结果
+// 多实例部署时, 只有主实例可以刷新, 避免使主实例的 token 失效
+func (r *Registry) Refresh(appid string, typ int) (TaskState, error) {
+	j, ok := r.Job(appid)
+	if !ok {
+		return TaskState{}, errors.New("非法的 AppID")
+	}
+
+	if !r.IsLeader(appid) {
+		return TaskState{}, ErrNotLeader
+	}
+
+	if err := j.Refresh(typ); err != nil {
+		return TaskState{}, err
+	}
+
+	return r.State(appid, typ)
+}
+
+// Invalidate 业务系统上报 token 失效, 返回刷新之后的结果
+// 参见 Job.Invalidate
+func (r *Registry) Invalidate(appid string, typ int, value string) (TaskState, error) {
+	j, ok := r.Job(appid)
+	if !ok {
+		return TaskState{}, errors.New("非法的 AppID")
+	}
+
+	if !r.IsLeader(appid) {
+		return TaskState{}, ErrNotLeader
+	}
+
+	if err := j.Invalidate(typ, value); err != nil {
+		return TaskState{}, err
+	}
+
+	return r.State(appid, typ)
+}
+
+// IsLeader 当前实例是否为 appid 的主实例
+// 未设置选主时, 当前实例始终是主实例
+func (r *Registry) IsLeader(appid string) bool {
+	r.mu.RLock()
+	e := r.elector
+	r.mu.RUnlock()
+
+	if e == nil {
+		return true
+	}
+
+	return e.IsLeader(appid)
+}
+
+// SetElector 设置选主, 多实例部署时使用
+func (r *Registry) SetElector(e *Elector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.elector = e
+}
+
+// Campaign 尝试成为 appid 的主实例
+// 未设置选主时, 当前实例始终是主实例
+func (r *Registry) Campaign(appid string) bool {
+	r.mu.RLock()
+	e := r.elector
+	r.mu.RUnlock()
+
+	if e == nil {
+		return true
+	}
+
+	return e.Campaign(appid)
+}
+
+// Remove 停止 appid 下所有的任务, 并删除其所有数据
+// 重启之后不会再恢复
+func (r *Registry) Remove(appid string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	j, ok := r.jobs[appid]
+	if !ok {
+		return errors.New("非法的 AppID")
+	}
+
+	j.remove()
+
+	if err := database.RemoveModel(appid); err != nil {
+		return err
+	}
+
+	delete(r.jobs, appid)
+
+	if r.elector != nil {
+		r.elector.forget(appid)
+	}
+
+	return nil
+}
+
+// forget 停止 appid 下所有的任务, 只从内存中删除, 不删除数据
+func (r *Registry) forget(appid string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if j, ok := r.jobs[appid]; ok {
+		j.remove()
+		delete(r.jobs, appid)
+	}
+
+	if r.elector != nil {
+		r.elector.forget(appid)
+	}
+}
+
+// RemoveTask 停止并删除 appid 下指定类型的任务
+// 没有剩余任务时, 删除 appid 的所有数据
+func (r *Registry) RemoveTask(appid string, typ int) error {
+	j, ok := r.Job(appid)
+	if !ok {
+		return errors.New("非法的 AppID")
+	}
+
+	left, err := j.RemoveTask(typ)
+	if err != nil {
+		return err
+	}
+
+	if left == 0 {
+		return r.Remove(appid)
+	}
+
+	return nil
+}
+
+// AddNotify 为 appid 下指定类型的任务添加回调地址, secret 为该地址签名使用的密钥
+func (r *Registry) AddNotify(appid string, typ int, addr, secret string) error {
+	j, ok := r.Job(appid)
+	if !ok {
+		return errors.New("非法的 AppID")
+	}
+
+	return j.AddNotify(typ, addr, secret)
+}
+
+// RemoveNotify 删除 appid 下指定类型的任务的回调地址
+func (r *Registry) RemoveNotify(appid string, typ int, addr string) error {
+	j, ok := r.Job(appid)
+	if !ok {
+		return errors.New("非法的 AppID")
+	}
+
+	return j.RemoveNotify(typ, addr)
+}
+
+// Job 依据 appid 获取 Job
+func (r *Registry) Job(appid string) (*Job, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	j, ok := r.jobs[appid]
+	return j, ok
+}
+
+// Jobs 获取所有的 Job, 按照 appid 排序
+func (r *Registry) Jobs() []*Job {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := make([]*Job, 0, len(r.jobs))
+	for _, j := range r.jobs {
+		all = append(all, j)
+	}
+
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].AppID < all[j].AppID
+	})
+
+	return all
+}
+
+// Task 获取指定 appid 下指定类型的任务
+func (r *Registry) Task(appid string, typ int) (*JobTask, bool) {
+	j, ok := r.Job(appid)
+	if !ok {
+		return nil, false
+	}
+
+	return j.Task(typ)
+}
+
+// State 获取指定任务结果的快照
+func (r *Registry) State(appid string, typ int) (TaskState, error) {
+	j, ok := r.Job(appid)
+	if !ok {
+		return TaskState{}, errors.New("非法的 AppID")
+	}
+
+	tk, ok := j.Task(typ)
+	if !ok {
+		return TaskState{}, errors.New("当前 AppID 并未注册指定类型的 任务")
+	}
+
+	return tk.Snapshot(), nil
+}
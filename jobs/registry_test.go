@@ -0,0 +1,161 @@
+package jobs
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/zjxpcyc/wechat-scheduler/database"
+)
+
+// TestRegistryConcurrent 同时注册, 查询及刷新, 需要通过 go test -race 运行
+func TestRegistryConcurrent(t *testing.T) {
+	srv := newWechat(t)
+	reg := NewRegistry()
+
+	appids := make([]string, 5)
+	for i := range appids {
+		appids[i] = "wx-concurrent-" + strconv.Itoa(i)
+		srv.AddApp(appids[i], "secret-"+appids[i])
+	}
+
+	t.Cleanup(func() {
+		for _, appid := range appids {
+			reg.Remove(appid)
+		}
+	})
+
+	var wg sync.WaitGroup
+	for round := 0; round < 10; round++ {
+		for _, appid := range appids {
+			appid := appid
+			wg.Add(3)
+
+			// 重复注册
+			go func() {
+				defer wg.Done()
+
+				j, err := reg.NewJob(appid, "secret-"+appid)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				if _, err := j.NewTask(JOB_ACCESS_TOKEN, "", "", "", nil); err != nil {
+					t.Error(err)
+				}
+			}()
+
+			// 查询
+			go func() {
+				defer wg.Done()
+
+				reg.State(appid, JOB_ACCESS_TOKEN)
+				for _, j := range reg.Jobs() {
+					j.Status()
+				}
+			}()
+
+			// 刷新, 注册之前刷新会失败
+			go func() {
+				defer wg.Done()
+
+				reg.Refresh(appid, JOB_ACCESS_TOKEN)
+			}()
+		}
+	}
+	wg.Wait()
+
+	for _, appid := range appids {
+		st, err := reg.Refresh(appid, JOB_ACCESS_TOKEN)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Value == "" || st.Value != srv.AccessToken(appid) {
+			t.Fatalf("%s 的 access_token 不是最新的: %s", appid, st.Value)
+		}
+
+		tk, _ := reg.Task(appid, JOB_ACCESS_TOKEN)
+		if !tk.Execable.Started() {
+			t.Fatalf("%s 刷新成功之后任务应当启动", appid)
+		}
+	}
+}
+
+// TestRegistryRemoveConcurrent 删除的同时刷新及查询
+func TestRegistryRemoveConcurrent(t *testing.T) {
+	srv := newWechat(t)
+	reg := NewRegistry()
+
+	appid := "wx-remove-concurrent"
+	srv.AddApp(appid, "secret-"+appid)
+
+	j, err := reg.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+
+		go func() {
+			defer wg.Done()
+			reg.Refresh(appid, JOB_ACCESS_TOKEN)
+		}()
+
+		go func() {
+			defer wg.Done()
+			reg.State(appid, JOB_ACCESS_TOKEN)
+		}()
+	}
+
+	if err := reg.Remove(appid); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	if _, ok := reg.Job(appid); ok {
+		t.Fatal("删除之后不应当再查询到 Job")
+	}
+}
+
+// TestNewTaskAfterRemove 注册的同时被删除时, 添加任务返回 ErrDropped, 不创建任务也不写入数据
+func TestNewTaskAfterRemove(t *testing.T) {
+	reg := NewRegistry()
+
+	appid := "wx-new-task-after-remove"
+	j, err := reg.NewJob(appid, "secret-"+appid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := reg.Remove(appid); err != nil {
+		t.Fatal(err)
+	}
+
+	if tk, err := j.NewTask(JOB_ACCESS_TOKEN, "", "", "", nil); err != database.ErrDropped || tk != nil {
+		t.Fatalf("删除之后添加任务应当返回 ErrDropped: %v", err)
+	}
+
+	if _, ok := j.Task(JOB_ACCESS_TOKEN); ok {
+		t.Fatal("删除之后不应当创建任务")
+	}
+
+	if all, err := testStore.List(appid, ""); err != nil || len(all) != 0 {
+		t.Fatalf("删除之后数据被重新创建: %v %v", all, err)
+	}
+}
+
+// TestNewTaskInvalidType 不支持的任务类型返回错误
+func TestNewTaskInvalidType(t *testing.T) {
+	_, j := newTestJob(t, "wx-new-task-invalid-type")
+
+	for _, typ := range []int{-1, JOB_MAX_LIMIT} {
+		if tk, err := j.NewTask(typ, "", "", "", nil); err == nil || tk != nil {
+			t.Fatalf("任务类型 %d 应当返回错误", typ)
+		}
+	}
+}
@@ -0,0 +1,89 @@
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+// RetryPolicies 各任务类型默认的重试策略
+// 注册时可以通过 RetryParam 覆盖
+var RetryPolicies = map[int]lib.RetryPolicy{
+	JOB_ACCESS_TOKEN:            lib.DefaultRetryPolicy,
+	JOB_WEB_ACCESS_TOKEN:        lib.DefaultRetryPolicy,
+	JOB_JSAPI_TICKET:            lib.DefaultRetryPolicy,
+	JOB_COMPONENT_ACCESS_TOKEN:  lib.DefaultRetryPolicy,
+	JOB_AUTHORIZER_ACCESS_TOKEN: lib.DefaultRetryPolicy,
+}
+
+// RetryParam 注册任务时指定的重试策略, 时间单位为秒
+// 未指定的字段使用任务类型默认的重试策略
+type RetryParam struct {
+	Initial    *int     `json:"initial,omitempty"`
+	Multiplier *float64 `json:"multiplier,omitempty"`
+	Max        *int     `json:"max,omitempty"`
+	Jitter     *float64 `json:"jitter,omitempty"`
+
+	// Attempts 最大重试次数, -1 代表一直重试
+	Attempts *int `json:"attempts,omitempty"`
+}
+
+// Policy 合并任务类型默认的重试策略, 并进行校验
+// p 为 nil 时返回默认的重试策略
+func (p *RetryParam) Policy(typ int) (lib.RetryPolicy, error) {
+	policy, ok := RetryPolicies[typ]
+	if !ok {
+		policy = lib.DefaultRetryPolicy
+	}
+
+	if p == nil {
+		return policy, nil
+	}
+
+	if p.Initial != nil {
+		policy.Initial = time.Duration(*p.Initial) * time.Second
+	}
+
+	if p.Multiplier != nil {
+		policy.Multiplier = *p.Multiplier
+	}
+
+	if p.Max != nil {
+		policy.Max = time.Duration(*p.Max) * time.Second
+	}
+
+	if p.Jitter != nil {
+		policy.Jitter = *p.Jitter
+	}
+
+	if p.Attempts != nil {
+		policy.MaxAttempts = *p.Attempts
+	}
+
+	return policy, policy.Validate()
+}
+
+// parseRetryParam 读取 model 中保存的重试策略, 空字符串代表未指定
+func parseRetryParam(s string) (*RetryParam, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	p := &RetryParam{}
+	if err := json.Unmarshal([]byte(s), p); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// String 用于保存到 model, nil 时为空字符串
+func (p *RetryParam) String() string {
+	if p == nil {
+		return ""
+	}
+
+	b, _ := json.Marshal(p)
+	return string(b)
+}
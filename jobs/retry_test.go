@@ -0,0 +1,71 @@
+package jobs
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+)
+
+func TestRetryParamPolicy(t *testing.T) {
+	initial, max, attempts := 5, 60, lib.RETRY_FOREVER
+	multiplier, jitter := 1.5, 0.0
+
+	policy, err := (*RetryParam)(nil).Policy(JOB_ACCESS_TOKEN)
+	if err != nil || policy != RetryPolicies[JOB_ACCESS_TOKEN] {
+		t.Fatalf("未指定时应当使用默认的重试策略: %v %v", policy, err)
+	}
+
+	// 只覆盖指定的字段
+	policy, err = (&RetryParam{Initial: &initial, Max: &max}).Policy(JOB_JSAPI_TICKET)
+	want := RetryPolicies[JOB_JSAPI_TICKET]
+	want.Initial = 5 * time.Second
+	want.Max = time.Minute
+	if err != nil || policy != want {
+		t.Fatalf("合并重试策略: 期望 %v, 实际 %v %v", want, policy, err)
+	}
+
+	p := &RetryParam{Initial: &initial, Multiplier: &multiplier, Max: &max, Jitter: &jitter, Attempts: &attempts}
+	policy, err = p.Policy(JOB_ACCESS_TOKEN)
+	want = lib.RetryPolicy{Initial: 5 * time.Second, Multiplier: 1.5, Max: time.Minute, MaxAttempts: lib.RETRY_FOREVER}
+	if err != nil || policy != want {
+		t.Fatalf("合并重试策略: 期望 %v, 实际 %v %v", want, policy, err)
+	}
+
+	// 保存到 model 之后读取
+	parsed, err := parseRetryParam(p.String())
+	if err != nil || !reflect.DeepEqual(parsed, p) {
+		t.Fatalf("读取保存的重试策略: %s %v", p.String(), err)
+	}
+
+	if parsed, err := parseRetryParam((*RetryParam)(nil).String()); err != nil || parsed != nil {
+		t.Fatalf("读取未指定的重试策略: %v %v", parsed, err)
+	}
+
+	if _, err := parseRetryParam("{"); err == nil {
+		t.Fatal("读取格式不正确的重试策略应当失败")
+	}
+}
+
+func TestRetryParamInvalid(t *testing.T) {
+	zero, small, negative := 0, 1, -2
+	lessThanOne, tooLarge := 0.5, 1.5
+
+	cases := []struct {
+		name  string
+		param RetryParam
+	}{
+		{"间隔为 0", RetryParam{Initial: &zero}},
+		{"倍数小于 1", RetryParam{Multiplier: &lessThanOne}},
+		{"最大间隔小于首次间隔", RetryParam{Max: &small}},
+		{"抖动大于 1", RetryParam{Jitter: &tooLarge}},
+		{"重试次数小于 -1", RetryParam{Attempts: &negative}},
+	}
+
+	for _, c := range cases {
+		if _, err := c.param.Policy(JOB_ACCESS_TOKEN); err == nil {
+			t.Fatalf("%s: 应当校验失败", c.name)
+		}
+	}
+}
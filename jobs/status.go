@@ -0,0 +1,121 @@
+package jobs
+
+import (
+	"time"
+)
+
+// 任务运行状态
+const (
+	// STATUS_RUNNING 正常运行中
+	STATUS_RUNNING = "running"
+
+	// STATUS_FAILING 运行中, 但是最近一次执行失败, 正在重试
+	STATUS_FAILING = "failing"
+
+	// STATUS_WAITING 等待依赖的任务刷新成功之后启动
+	STATUS_WAITING = "waiting"
+
+	// STATUS_FAILED 因为不可重试的错误, 或者超过最大重试次数而停止
+	STATUS_FAILED = "failed"
+
+	// STATUS_STOPPED 已停止, 比如多实例部署时非主实例
+	STATUS_STOPPED = "stopped"
+)
+
+// JobNames 任务类型名称
+var JobNames = map[int]string{
+	JOB_ACCESS_TOKEN:            "access_token",
+	JOB_WEB_ACCESS_TOKEN:        "web_access_token",
+	JOB_JSAPI_TICKET:            "jsapi_ticket",
+	JOB_COMPONENT_ACCESS_TOKEN:  "component_access_token",
+	JOB_AUTHORIZER_ACCESS_TOKEN: "authorizer_access_token",
+}
+
+// TaskStatus 任务状态, 用于运维查询
+// 不包含 appsecret 以及 token 等敏感内容
+type TaskStatus struct {
+	Type       int    `json:"type"`
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	LastTime   string `json:"lasttime"`
+	NextTime   string `json:"nexttime"`
+	ExpireTime string `json:"expiretime"`
+	Failures   int    `json:"failures"`
+	LastError  string `json:"error"`
+	ErrorCode  int    `json:"errcode"`
+	ErrorClass string `json:"error_class"`
+
+	// Notify 各回调地址的状态, 未注册回调地址时为空
+	Notify []NotifyStatus `json:"notify,omitempty"`
+}
+
+// JobStatus Job 状态
+type JobStatus struct {
+	AppID string       `json:"appid"`
+	Tasks []TaskStatus `json:"tasks"`
+}
+
+// Status 获取任务状态
+func (t *JobTask) Status() TaskStatus {
+	st := t.Snapshot()
+
+	status := TaskStatus{
+		Type:       t.Typ,
+		Name:       JobNames[t.Typ],
+		Status:     STATUS_STOPPED,
+		LastTime:   formatTime(st.LastTime),
+		ExpireTime: formatTime(st.ExpireTime),
+	}
+
+	for _, n := range t.Notifiers() {
+		status.Notify = append(status.Notify, n.Status())
+	}
+
+	if t.Execable == nil {
+		return status
+	}
+
+	stats := t.Execable.Stats()
+	status.Failures = stats.Failures
+	status.LastError = stats.LastError
+	status.ErrorCode = stats.ErrorCode
+	status.ErrorClass = stats.ErrorClass
+
+	if stats.Started {
+		status.Status = STATUS_RUNNING
+		if stats.Failures > 0 {
+			status.Status = STATUS_FAILING
+		}
+
+		status.NextTime = formatTime(stats.NextRun)
+	} else if stats.Failed {
+		status.Status = STATUS_FAILED
+	} else if _, ok := t.Job.waiting(t.Typ); ok {
+		status.Status = STATUS_WAITING
+	}
+
+	return status
+}
+
+// Status 获取 Job 下所有任务的状态
+func (t *Job) Status() JobStatus {
+	status := JobStatus{
+		AppID: t.AppID,
+		Tasks: make([]TaskStatus, 0),
+	}
+
+	for _, tk := range t.Tasks() {
+		status.Tasks = append(status.Tasks, tk.Status())
+	}
+
+	return status
+}
+
+// formatTime 零值返回空字符串
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format("2006-01-02 15:04:05")
+}
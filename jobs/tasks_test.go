@@ -0,0 +1,428 @@
+package jobs
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zjxpcyc/wechat-scheduler/lib"
+	"github.com/zjxpcyc/wechat-scheduler/wechattest"
+)
+
+// paramsServer 模拟业务系统提供 DynamicParams
+type paramsServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	params map[int]map[string]interface{}
+}
+
+// newParams 启动模拟的业务系统, 按照任务类型返回 params
+func newParams(t *testing.T, params map[int]map[string]interface{}) *paramsServer {
+	s := &paramsServer{params: params}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		typ, _ := strconv.Atoi(r.URL.Query().Get("type"))
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		json.NewEncoder(w).Encode(s.params[typ])
+	}))
+
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Set 修改 typ 类型的任务需要的参数
+func (s *paramsServer) Set(typ int, params map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.params[typ] = params
+}
+
+// TestUnexpectedParams 业务系统返回的参数类型不正确时, 任务失败而不是 panic
+func TestUnexpectedParams(t *testing.T) {
+	srv := newWechat(t)
+
+	cases := map[int]map[string]interface{}{
+		JOB_WEB_ACCESS_TOKEN:       {"refresh_token": 1},
+		JOB_JSAPI_TICKET:           {"access_token": 1},
+		JOB_COMPONENT_ACCESS_TOKEN: {"component_verify_ticket": true},
+		JOB_AUTHORIZER_ACCESS_TOKEN: {
+			"authorizer_appid":         []string{"wx"},
+			"authorizer_refresh_token": "REFRESH",
+			"component_access_token":   "TOKEN",
+		},
+	}
+
+	for typ, params := range cases {
+		appid := "wx-unexpected-" + strconv.Itoa(typ)
+		srv.AddApp(appid, "secret-"+appid)
+
+		p := newParams(t, map[int]map[string]interface{}{typ: params})
+		_, j := newTestJob(t, appid)
+		newTask(t, j, typ, p.URL, "", "")
+
+		if err := j.Refresh(typ); err == nil {
+			t.Fatalf("%s 参数类型不正确时应当失败", JobNames[typ])
+		}
+	}
+}
+
+// wechatAPIs 各任务类型对应的模拟接口
+var wechatAPIs = map[int]string{
+	JOB_ACCESS_TOKEN:            wechattest.API_ACCESS_TOKEN,
+	JOB_WEB_ACCESS_TOKEN:        wechattest.API_WEB_ACCESS_TOKEN,
+	JOB_JSAPI_TICKET:            wechattest.API_JSAPI_TICKET,
+	JOB_COMPONENT_ACCESS_TOKEN:  wechattest.API_COMPONENT_ACCESS_TOKEN,
+	JOB_AUTHORIZER_ACCESS_TOKEN: wechattest.API_AUTHORIZER_ACCESS_TOKEN,
+}
+
+// newAllTasks 在 appid 下注册所有类型的任务, 并按照依赖顺序首次刷新
+// appid 同时作为开放平台的 component_appid
+func newAllTasks(t *testing.T, srv *wechattest.Server, appid string) *Job {
+	t.Helper()
+
+	srv.AddApp(appid, "secret-"+appid)
+
+	p := newParams(t, map[int]map[string]interface{}{
+		JOB_WEB_ACCESS_TOKEN:        {"refresh_token": "WEB-REFRESH-" + appid},
+		JOB_COMPONENT_ACCESS_TOKEN:  {"component_verify_ticket": "TICKET-" + appid},
+		JOB_AUTHORIZER_ACCESS_TOKEN: {"authorizer_appid": "wx-authorizer", "authorizer_refresh_token": "AUTH-REFRESH-" + appid},
+	})
+
+	_, j := newTestJob(t, appid)
+	for _, typ := range order {
+		newTask(t, j, typ, p.URL, "", "")
+	}
+
+	for _, typ := range order {
+		if err := j.Refresh(typ); err != nil {
+			t.Fatalf("%s 刷新失败: %v", JobNames[typ], err)
+		}
+	}
+
+	return j
+}
+
+// TestTasks 所有类型的任务从模拟的微信接口获取结果
+func TestTasks(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-tasks"
+	j := newAllTasks(t, srv, appid)
+
+	for _, typ := range order {
+		tk, _ := j.Task(typ)
+		if tk.Value() == "" {
+			t.Fatalf("%s 没有结果", JobNames[typ])
+		}
+
+		if srv.Calls(wechatAPIs[typ]) == 0 {
+			t.Fatalf("%s 没有请求微信接口", JobNames[typ])
+		}
+
+		if st := tk.Status(); st.Status != STATUS_RUNNING {
+			t.Fatalf("%s 状态: 期望 %s, 实际 %s", JobNames[typ], STATUS_RUNNING, st.Status)
+		}
+	}
+
+	// jsapi_ticket 使用注册的 access_token
+	at, _ := j.Task(JOB_ACCESS_TOKEN)
+	if at.Value() != srv.AccessToken(appid) {
+		t.Fatalf("access_token 与微信签发的不一致: %s %s", at.Value(), srv.AccessToken(appid))
+	}
+
+	reqs := srv.Requests(wechattest.API_JSAPI_TICKET)
+	if got := reqs[len(reqs)-1].Query.Get("access_token"); got != at.Value() {
+		t.Fatalf("jsapi_ticket 使用的 access_token 不正确: %s", got)
+	}
+}
+
+// TestTasksFault 微信返回错误时, 可重试的错误继续运行, 不可重试的错误停止任务, 手动刷新之后恢复
+func TestTasksFault(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-tasks-fault"
+	j := newAllTasks(t, srv, appid)
+
+	// 从依赖链的末端开始, 避免被依赖的任务刷新之后触发的重新执行消耗注入的错误
+	for i := len(order) - 1; i >= 0; i-- {
+		typ := order[i]
+		api := wechatAPIs[typ]
+		tk, _ := j.Task(typ)
+		before := tk.Value()
+
+		srv.Fail(api, -1, 1)
+		err := j.Refresh(typ)
+		if lib.ErrorClass(err) != lib.ERR_RETRYABLE || lib.ErrorCode(err) != -1 {
+			t.Fatalf("%s 系统繁忙时应当返回可重试的错误: %v", JobNames[typ], err)
+		}
+
+		if tk.Value() != before {
+			t.Fatalf("%s 失败之后不应当修改结果", JobNames[typ])
+		}
+
+		if st := tk.Status(); st.Status != STATUS_FAILING || st.ErrorCode != -1 {
+			t.Fatalf("%s 状态: 期望 %s, 实际 %s %d", JobNames[typ], STATUS_FAILING, st.Status, st.ErrorCode)
+		}
+
+		srv.Fail(api, 40125, 1)
+		err = j.Refresh(typ)
+		if lib.ErrorClass(err) != lib.ERR_FATAL || lib.ErrorCode(err) != 40125 {
+			t.Fatalf("%s appsecret 无效时应当返回不可重试的错误: %v", JobNames[typ], err)
+		}
+
+		if st := tk.Status(); st.Status != STATUS_FAILED || st.ErrorClass != lib.ERR_FATAL {
+			t.Fatalf("%s 状态: 期望 %s, 实际 %s %s", JobNames[typ], STATUS_FAILED, st.Status, st.ErrorClass)
+		}
+
+		if tk.Value() != before {
+			t.Fatalf("%s 失败之后不应当修改结果", JobNames[typ])
+		}
+
+		// 问题解决之后手动刷新, 任务重新启动
+		if err := j.Refresh(typ); err != nil {
+			t.Fatalf("%s 刷新失败: %v", JobNames[typ], err)
+		}
+
+		if tk.Value() == "" || tk.Value() == before {
+			t.Fatalf("%s 刷新之后没有新的结果", JobNames[typ])
+		}
+
+		if st := tk.Status(); st.Status != STATUS_RUNNING || st.Failures != 0 {
+			t.Fatalf("%s 状态: 期望 %s, 实际 %s %d", JobNames[typ], STATUS_RUNNING, st.Status, st.Failures)
+		}
+	}
+}
+
+// lastBody 解析 api 最近一次收到的请求体
+func lastBody(t *testing.T, srv *wechattest.Server, api string) (wechattest.Request, map[string]string) {
+	t.Helper()
+
+	reqs := srv.Requests(api)
+	if len(reqs) == 0 {
+		t.Fatalf("%s 没有收到请求", api)
+	}
+
+	req := reqs[len(reqs)-1]
+	body := map[string]string{}
+	if err := json.Unmarshal(req.Body, &body); err != nil {
+		t.Fatalf("%s 请求体不是 json: %q %v", api, req.Body, err)
+	}
+
+	return req, body
+}
+
+// TestPostPayload component_access_token 及 authorizer_access_token 发送给微信的请求体完整
+func TestPostPayload(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-post-payload"
+	j := newAllTasks(t, srv, appid)
+
+	req, body := lastBody(t, srv, wechattest.API_COMPONENT_ACCESS_TOKEN)
+	if req.Method != http.MethodPost || req.ContentType != lib.MimeJSON {
+		t.Fatalf("component_access_token 请求方式不正确: %s %s", req.Method, req.ContentType)
+	}
+
+	want := map[string]string{
+		"component_appid":         appid,
+		"component_appsecret":     "secret-" + appid,
+		"component_verify_ticket": "TICKET-" + appid,
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Fatalf("component_access_token 请求体: 期望 %v, 实际 %v", want, body)
+	}
+
+	ca, _ := j.Task(JOB_COMPONENT_ACCESS_TOKEN)
+	req, body = lastBody(t, srv, wechattest.API_AUTHORIZER_ACCESS_TOKEN)
+	if req.Method != http.MethodPost || req.ContentType != lib.MimeJSON {
+		t.Fatalf("authorizer_access_token 请求方式不正确: %s %s", req.Method, req.ContentType)
+	}
+
+	if got := req.Query.Get("component_access_token"); got != ca.Value() {
+		t.Fatalf("authorizer_access_token 使用的 component_access_token: 期望 %s, 实际 %s", ca.Value(), got)
+	}
+
+	want = map[string]string{
+		"component_appid":          appid,
+		"authorizer_appid":         "wx-authorizer",
+		"authorizer_refresh_token": "AUTH-REFRESH-" + appid,
+	}
+	if !reflect.DeepEqual(body, want) {
+		t.Fatalf("authorizer_access_token 请求体: 期望 %v, 实际 %v", want, body)
+	}
+}
+
+// TestRefreshSingleFlight 调度器的执行与并发的手动刷新合并, 只请求一次微信接口, 所有调用方得到同一个结果
+func TestRefreshSingleFlight(t *testing.T) {
+	srv := newWechat(t)
+	api := wechattest.API_ACCESS_TOKEN
+
+	appid := "wx-refresh-single-flight"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	// refresh 并发刷新 n 次, 请求在 release 之后才返回
+	refresh := func(n int, release func()) ([]string, []error) {
+		values := make([]string, n)
+		errs := make([]error, n)
+
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				errs[i] = tk.Refresh()
+				values[i] = tk.Value()
+			}(i)
+		}
+
+		// 等待所有调用方合并到进行中的请求
+		time.Sleep(50 * time.Millisecond)
+		release()
+
+		wg.Wait()
+		return values, errs
+	}
+
+	// 调度器的执行进行中时手动刷新
+	release := srv.Hold(api)
+	t.Cleanup(release)
+
+	tk.Start()
+	waitFor(t, "调度器请求微信接口", func() bool { return srv.Calls(api) == 1 })
+
+	values, errs := refresh(10, release)
+
+	if got := srv.Calls(api); got != 1 {
+		t.Fatalf("应当只请求一次微信接口, 实际 %d 次", got)
+	}
+
+	for i := range values {
+		if errs[i] != nil || values[i] != srv.AccessToken(appid) {
+			t.Fatalf("所有调用方应当得到同一个结果: %s %v", values[i], errs[i])
+		}
+	}
+
+	// 失败时所有调用方得到同一个错误
+	srv.Fail(api, -1, 1)
+	release = srv.Hold(api)
+	t.Cleanup(release)
+
+	_, errs = refresh(10, release)
+
+	if got := srv.Calls(api); got != 2 {
+		t.Fatalf("应当只请求一次微信接口, 实际 %d 次", got-1)
+	}
+
+	for _, err := range errs {
+		if lib.ErrorCode(err) != -1 {
+			t.Fatalf("所有调用方应当得到同一个错误: %v", err)
+		}
+	}
+}
+
+// TestRefreshDependents 手动刷新被依赖的任务之后, 依赖于它的任务使用新的结果重新执行
+func TestRefreshDependents(t *testing.T) {
+	srv := newWechat(t)
+
+	appid := "wx-refresh-dependents"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+
+	at := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+	ticket := newTask(t, j, JOB_JSAPI_TICKET, "", "", "")
+
+	for _, typ := range []int{JOB_ACCESS_TOKEN, JOB_JSAPI_TICKET} {
+		if err := j.Refresh(typ); err != nil {
+			t.Fatalf("%s 刷新失败: %v", JobNames[typ], err)
+		}
+	}
+
+	before := ticket.Value()
+	if err := j.Refresh(JOB_ACCESS_TOKEN); err != nil {
+		t.Fatal(err)
+	}
+
+	waitFor(t, "jsapi_ticket 重新执行", func() bool { return ticket.Value() != before })
+
+	reqs := srv.Requests(wechattest.API_JSAPI_TICKET)
+	if got := reqs[len(reqs)-1].Query.Get("access_token"); got != at.Value() {
+		t.Fatalf("jsapi_ticket 应当使用新的 access_token: 期望 %s, 实际 %s", at.Value(), got)
+	}
+}
+
+// TestInvalidate 上报的值已经不是当前值时直接返回, 同一任务在 InvalidInterval 内只刷新一次
+func TestInvalidate(t *testing.T) {
+	srv := newWechat(t)
+	api := wechattest.API_ACCESS_TOKEN
+
+	now := time.Now()
+	setClock(t, now)
+
+	appid := "wx-invalidate"
+	srv.AddApp(appid, "secret-"+appid)
+	_, j := newTestJob(t, appid)
+	tk := newTask(t, j, JOB_ACCESS_TOKEN, "", "", "")
+
+	tk.Start()
+	waitFor(t, "获取 access_token", func() bool { return tk.Value() != "" })
+
+	old := tk.Value()
+
+	// 业务系统使用的值已经过期, 不请求微信接口
+	if err := j.Invalidate(JOB_ACCESS_TOKEN, "EXPIRED"); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Calls(api); got != 1 || tk.Value() != old {
+		t.Fatalf("上报的值不是当前值时不应当刷新: %d 次请求, %s", got, tk.Value())
+	}
+
+	srv.Invalidate(appid)
+	if err := j.Invalidate(JOB_ACCESS_TOKEN, old); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.Calls(api); got != 2 || tk.Value() == old || tk.Value() != srv.AccessToken(appid) {
+		t.Fatalf("上报当前值应当立即刷新: %d 次请求, %s", got, tk.Value())
+	}
+
+	cases := []struct {
+		name  string
+		after time.Duration
+		value string
+		err   error
+		calls int
+	}{
+		// 其他业务系统仍然上报刷新前的值
+		{"刷新前的值", 0, old, nil, 2},
+		{"间隔内上报当前值", InvalidInterval - time.Second, "", ErrInvalidTooFrequent, 2},
+		{"间隔之后上报当前值", InvalidInterval, "", nil, 3},
+		{"刚刚刷新过", InvalidInterval, "", ErrInvalidTooFrequent, 3},
+	}
+
+	for _, c := range cases {
+		setClock(t, now.Add(c.after))
+
+		value := c.value
+		if value == "" {
+			value = tk.Value()
+		}
+
+		if err := j.Invalidate(JOB_ACCESS_TOKEN, value); err != c.err {
+			t.Fatalf("%s: 期望 %v, 实际 %v", c.name, c.err, err)
+		}
+
+		if got := srv.Calls(api); got != c.calls {
+			t.Fatalf("%s: 期望请求 %d 次, 实际 %d 次", c.name, c.calls, got)
+		}
+	}
+}
@@ -1,9 +1,9 @@
 package jobs
 
 import (
+	"context"
 	"errors"
 	"net/url"
-	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/lib"
 )
@@ -18,38 +18,34 @@ func WebAccessToken(tk *JobTask) *lib.JobServer {
 	taskName := "web_access_token"
 	t := tk.Job
 
-	task := func() error {
+	task := func(ctx context.Context) error {
 		query := url.Values{}
 		query.Add("appid", t.AppID)
 
 		// refresh_token 有两种来源
-		refreshToken := ""
-
 		// 1、直接是上次任务结果的返回
-		refresh := tk.Result["refresh_token"]
-		if refresh == nil || refresh.(string) == "" {
-			if tk.DynamicParams == nil {
+		refreshToken, ok := stringOf(tk.Snapshot().Result, "refresh_token")
+		if !ok {
+			dynamicParams := tk.DynamicParams()
+			if dynamicParams == nil {
 				return errors.New("启动 " + taskName + " 任务失败, 注册须指定 DynamicParams 参数")
 			}
 
 			// 2、是从业务 APP 获取过来
-			params := tk.DynamicParams(t.AppID, JOB_WEB_ACCESS_TOKEN)
-			var ok bool
-			refresh, ok = params["refresh_token"]
-			if !ok {
-				return errors.New("刷新 " + taskName + " 失败: 未找到有效 refresh_token")
+			params, err := dynamicParams(ctx, t.AppID, JOB_WEB_ACCESS_TOKEN)
+			if err != nil {
+				return err
 			}
-		}
 
-		refreshToken = refresh.(string)
-		if refreshToken == "" {
-			return errors.New("刷新 " + taskName + " 失败: 未找到有效 refresh_token")
+			if refreshToken, ok = stringOf(params, "refresh_token"); !ok {
+				return errors.New("刷新 " + taskName + " 失败: 未找到有效 refresh_token")
+			}
 		}
 
 		query.Add("refresh_token", refreshToken)
 
 		res := map[string]interface{}{}
-		_, err := lib.Request(tk.API, query, nil, &res)
+		_, err := lib.Request(ctx, tk.API, query, nil, &res)
 		if err != nil {
 			return err
 		}
@@ -58,17 +54,15 @@ func WebAccessToken(tk *JobTask) *lib.JobServer {
 			return err
 		}
 
-		tk.Result = res
-		tk.Value = res["access_token"].(string)
-		tk.LastTime = time.Now().Local()
-		tk.Save()
-
-		if tk.CallBack != nil {
-			tk.CallBack(t.AppID, JOB_WEB_ACCESS_TOKEN, res)
+		token, ok := stringOf(res, "access_token")
+		if !ok {
+			return errors.New("刷新 " + taskName + " 失败: 微信返回的结果中没有 access_token")
 		}
 
+		tk.Refreshed(ctx, res, token)
+
 		return nil
 	}
 
-	return lib.NewJobServer(t.AppID, taskName, task, tk.Freq)
+	return lib.NewJobServer(t.AppID, taskName, tk.guard(task), tk.Freq())
 }
@@ -0,0 +1,241 @@
+package lib
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 访问权限
+const (
+	// PERM_READ 只能查询任务结果
+	PERM_READ = "read"
+
+	// PERM_REGISTE 可以注册任务, 同时可以查询
+	PERM_REGISTE = "register"
+)
+
+// 校验方式
+const (
+	// AUTH_APIKEY 请求头中直接带上 X-Api-Key 及 X-Api-Secret
+	AUTH_APIKEY = "apikey"
+
+	// AUTH_HMAC 请求头中带上 X-Api-Key, X-Timestamp, X-Nonce 及 X-Signature
+	// X-Signature 为 hex(HMAC-SHA256(secret, METHOD\nURI\nTIMESTAMP\nNONCE\nBODY))
+	// URI 为包含 query 的请求地址, 比如 /task/wx123/0/notify?url=xxx
+	AUTH_HMAC = "hmac"
+)
+
+// AUTH_WINDOW 签名请求的时间戳与服务器时间允许的最大误差
+// 时间戳可以早于或者晚于服务器时间, nonce 需要保存 2 倍的 AUTH_WINDOW, 每隔 AUTH_WINDOW 清理一次
+const AUTH_WINDOW = 5 * time.Minute
+
+// 校验失败
+var (
+	ErrUnauthorized = errors.New("访问校验失败")
+	ErrForbidden    = errors.New("没有访问权限")
+)
+
+// Credential 业务系统的访问凭证
+type Credential struct {
+	// Key 凭证标识
+	Key string `json:"key"`
+
+	// Secret 凭证密钥
+	Secret string `json:"secret"`
+
+	// Mode 校验方式, apikey 或者 hmac, 默认 hmac
+	Mode string `json:"mode"`
+
+	// AppIDs 可以访问的 appid, * 代表所有
+	AppIDs []string `json:"appids"`
+
+	// Permission 权限, read 或者 register
+	Permission string `json:"permission"`
+}
+
+// Allow 是否可以对 appid 进行 perm 操作
+func (c *Credential) Allow(appid, perm string) bool {
+	if perm == PERM_REGISTE && c.Permission != PERM_REGISTE {
+		return false
+	}
+
+	for _, id := range c.AppIDs {
+		if id == "*" || id == appid {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Authenticator 访问校验
+type Authenticator struct {
+	credentials map[string]*Credential
+
+	mu     sync.Mutex
+	nonces map[string]time.Time
+
+	done chan struct{}
+	once sync.Once
+}
+
+// NewAuthenticator 依据凭证列表实例化访问校验
+// 同时启动过期 nonce 的定时清理, 不再使用时需要调用 Stop
+func NewAuthenticator(credentials []Credential) (*Authenticator, error) {
+	a := &Authenticator{
+		credentials: make(map[string]*Credential),
+		nonces:      make(map[string]time.Time),
+		done:        make(chan struct{}),
+	}
+
+	for i := range credentials {
+		c := credentials[i]
+		if c.Key == "" || c.Secret == "" {
+			return nil, errors.New("凭证的 key 或者 secret 不能为空")
+		}
+
+		if c.Mode == "" {
+			c.Mode = AUTH_HMAC
+		}
+
+		if c.Mode != AUTH_APIKEY && c.Mode != AUTH_HMAC {
+			return nil, errors.New("凭证 " + c.Key + " 校验方式不正确: " + c.Mode)
+		}
+
+		if c.Permission != PERM_READ && c.Permission != PERM_REGISTE {
+			return nil, errors.New("凭证 " + c.Key + " 权限不正确: " + c.Permission)
+		}
+
+		a.credentials[c.Key] = &c
+	}
+
+	go func() {
+		ticker := time.NewTicker(AUTH_WINDOW)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-a.done:
+				return
+			case now := <-ticker.C:
+				a.sweep(now)
+			}
+		}
+	}()
+
+	return a, nil
+}
+
+// Stop 停止过期 nonce 的定时清理
+func (a *Authenticator) Stop() {
+	a.once.Do(func() { close(a.done) })
+}
+
+// LoadAuthenticator 从 json 文件中读取凭证列表
+// 文件内容为 Credential 数组
+func LoadAuthenticator(file string) (*Authenticator, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	credentials := make([]Credential, 0)
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+
+	return NewAuthenticator(credentials)
+}
+
+// Verify 校验请求, 返回请求对应的凭证
+// body 为请求的原始内容, 签名时使用
+func (a *Authenticator) Verify(r *http.Request, body []byte) (*Credential, error) {
+	c, ok := a.credentials[r.Header.Get("X-Api-Key")]
+	if !ok {
+		return nil, ErrUnauthorized
+	}
+
+	if c.Mode == AUTH_APIKEY {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Api-Secret")), []byte(c.Secret)) != 1 {
+			return nil, ErrUnauthorized
+		}
+
+		return c, nil
+	}
+
+	ts := r.Header.Get("X-Timestamp")
+	nonce := r.Header.Get("X-Nonce")
+	sign := r.Header.Get("X-Signature")
+	if ts == "" || nonce == "" || sign == "" {
+		return nil, ErrUnauthorized
+	}
+
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, ErrUnauthorized
+	}
+
+	now := time.Now()
+	diff := now.Sub(time.Unix(sec, 0))
+	if diff > AUTH_WINDOW || diff < -AUTH_WINDOW {
+		return nil, ErrUnauthorized
+	}
+
+	// 签名包含 query, 比如 DELETE 回调地址时的 url 参数, 不能被篡改
+	expect := Sign(c.Secret, r.Method, r.URL.RequestURI(), ts, nonce, body)
+	if !hmac.Equal([]byte(sign), []byte(expect)) {
+		return nil, ErrUnauthorized
+	}
+
+	// 防止重放
+	if !a.useNonce(c.Key+":"+nonce, now) {
+		return nil, ErrUnauthorized
+	}
+
+	return c, nil
+}
+
+// useNonce nonce 在有效期内未被使用过时返回 true
+// 过期的 nonce 由 sweep 定时清理, 这里不遍历
+func (a *Authenticator) useNonce(nonce string, now time.Time) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if t, ok := a.nonces[nonce]; ok && now.Sub(t) <= 2*AUTH_WINDOW {
+		return false
+	}
+
+	a.nonces[nonce] = now
+	return true
+}
+
+// sweep 清理已经过期的 nonce
+func (a *Authenticator) sweep(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for k, t := range a.nonces {
+		if now.Sub(t) > 2*AUTH_WINDOW {
+			delete(a.nonces, k)
+		}
+	}
+}
+
+// Sign 计算请求签名
+// uri 为包含 query 的请求地址
+func Sign(secret, method, uri, timestamp, nonce string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n" + nonce + "\n"))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
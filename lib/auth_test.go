@@ -0,0 +1,105 @@
+package lib
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newAuth 只有一个 hmac 凭证的访问校验, 测试结束时停止
+func newAuth(t *testing.T) *Authenticator {
+	t.Helper()
+
+	a, err := NewAuthenticator([]Credential{{
+		Key:        "key",
+		Secret:     "secret",
+		AppIDs:     []string{"*"},
+		Permission: PERM_REGISTE,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(a.Stop)
+	return a
+}
+
+// signed 构造签名的请求, 签名使用 target 的 URI
+func signed(method, target, nonce string, body []byte) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+
+	r.Header.Set("X-Api-Key", "key")
+	r.Header.Set("X-Timestamp", ts)
+	r.Header.Set("X-Nonce", nonce)
+	r.Header.Set("X-Signature", Sign("secret", method, r.URL.RequestURI(), ts, nonce, body))
+
+	return r
+}
+
+// TestVerifyQuery 签名包含 query, 篡改 query 之后校验失败
+func TestVerifyQuery(t *testing.T) {
+	a := newAuth(t)
+
+	target := "/task/wx123/0/notify?url=http%3A%2F%2F127.0.0.1%2Fa"
+	if _, err := a.Verify(signed(http.MethodDelete, target, "nonce-1", nil), nil); err != nil {
+		t.Fatalf("校验失败: %v", err)
+	}
+
+	r := signed(http.MethodDelete, target, "nonce-2", nil)
+	r.URL.RawQuery = "url=http%3A%2F%2F127.0.0.1%2Fb"
+	if _, err := a.Verify(r, nil); err != ErrUnauthorized {
+		t.Fatalf("篡改 query 之后应当校验失败: %v", err)
+	}
+
+	r = signed(http.MethodPost, "/registe", "nonce-3", []byte(`{"appid":"wx123"}`))
+	if _, err := a.Verify(r, []byte(`{"appid":"wx456"}`)); err != ErrUnauthorized {
+		t.Fatalf("篡改 body 之后应当校验失败: %v", err)
+	}
+}
+
+// TestVerifyReplay 同一个 nonce 只能使用一次
+func TestVerifyReplay(t *testing.T) {
+	a := newAuth(t)
+
+	r := signed(http.MethodGet, "/jobs", "nonce-replay", nil)
+	if _, err := a.Verify(r, nil); err != nil {
+		t.Fatalf("校验失败: %v", err)
+	}
+
+	if _, err := a.Verify(r, nil); err != ErrUnauthorized {
+		t.Fatalf("重放的请求应当校验失败: %v", err)
+	}
+}
+
+// TestSweepNonce 定时清理过期的 nonce, 未过期的保留
+func TestSweepNonce(t *testing.T) {
+	a := newAuth(t)
+
+	now := time.Now()
+	a.useNonce("old", now.Add(-2*AUTH_WINDOW-time.Second))
+	a.useNonce("new", now.Add(-AUTH_WINDOW))
+
+	// 过期的 nonce 清理之前也可以再次使用
+	if !a.useNonce("old", now) {
+		t.Fatal("过期的 nonce 应当可以再次使用")
+	}
+
+	a.useNonce("expired", now.Add(-3*AUTH_WINDOW))
+	a.sweep(now)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if _, ok := a.nonces["expired"]; ok {
+		t.Fatal("过期的 nonce 没有被清理")
+	}
+
+	for _, k := range []string{"old", "new"} {
+		if _, ok := a.nonces[k]; !ok {
+			t.Fatalf("未过期的 nonce %s 被清理", k)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// 微信错误的分类, 决定任务失败之后如何重试以及是否告警
+const (
+	// ERR_RETRYABLE 临时错误, 按照重试策略重试
+	ERR_RETRYABLE = "retryable"
+
+	// ERR_FATAL 配置错误, 重试也不会成功, 任务立即停止并告警
+	ERR_FATAL = "fatal"
+
+	// ERR_CREDENTIAL 请求使用的 token 或者 ticket 等凭证无效, 等待凭证更新之后重试, 并告警
+	ERR_CREDENTIAL = "credential"
+
+	// ERR_QUOTA 接口调用次数超过限制, 按照最大间隔重试, 并告警
+	ERR_QUOTA = "quota"
+)
+
+// ErrorInfo 已知错误码的说明及分类
+type ErrorInfo struct {
+	Class string
+	Desc  string
+}
+
+// ErrorCatalog 已知的微信错误码
+// 不在其中的错误码按照 ERR_RETRYABLE 处理
+var ErrorCatalog = map[int]ErrorInfo{
+	-1:    {ERR_RETRYABLE, "系统繁忙"},
+	40001: {ERR_CREDENTIAL, "access_token 无效或者不是最新的"},
+	40002: {ERR_FATAL, "不合法的凭证类型"},
+	40013: {ERR_FATAL, "不合法的 AppID"},
+	40014: {ERR_CREDENTIAL, "不合法的 access_token"},
+	40030: {ERR_CREDENTIAL, "不合法的 refresh_token"},
+	40125: {ERR_FATAL, "appsecret 无效"},
+	40164: {ERR_FATAL, "调用接口的 IP 不在白名单中"},
+	41001: {ERR_CREDENTIAL, "缺少 access_token 参数"},
+	41002: {ERR_FATAL, "缺少 appid 参数"},
+	41004: {ERR_FATAL, "缺少 secret 参数"},
+	42001: {ERR_CREDENTIAL, "access_token 超时"},
+	42002: {ERR_CREDENTIAL, "refresh_token 超时"},
+	45009: {ERR_QUOTA, "接口调用超过每日限制"},
+	45011: {ERR_QUOTA, "接口调用太频繁"},
+	48001: {ERR_FATAL, "接口功能未授权"},
+	50001: {ERR_FATAL, "用户未授权该接口"},
+	50002: {ERR_FATAL, "用户受限"},
+	61005: {ERR_CREDENTIAL, "component_verify_ticket 已过期"},
+	61006: {ERR_CREDENTIAL, "component_verify_ticket 无效"},
+	61023: {ERR_CREDENTIAL, "refresh_token 无效"},
+}
+
+// WechatError 微信接口返回的错误
+type WechatError struct {
+	// Code errcode
+	Code int
+
+	// Message errmsg, 不包含 rid
+	Message string
+
+	// RID 微信的请求标识, 向微信反馈问题时使用
+	RID string
+}
+
+// NewWechatError 实例化微信错误
+// errmsg 末尾的 "rid: xxx" 会被拆分到 RID 中
+func NewWechatError(code int, errmsg string) *WechatError {
+	e := &WechatError{Code: code, Message: errmsg}
+
+	if i := strings.LastIndex(errmsg, "rid:"); i >= 0 {
+		e.RID = strings.TrimSpace(errmsg[i+len("rid:"):])
+		e.Message = strings.TrimRight(strings.TrimSpace(errmsg[:i]), ",")
+	}
+
+	return e
+}
+
+func (e *WechatError) Error() string {
+	msg := fmt.Sprintf("%d - %s", e.Code, e.Message)
+
+	if info, ok := ErrorCatalog[e.Code]; ok {
+		msg += " (" + info.Desc + ")"
+	}
+
+	if e.RID != "" {
+		msg += " rid: " + e.RID
+	}
+
+	return msg
+}
+
+// Class 错误分类
+func (e *WechatError) Class() string {
+	if info, ok := ErrorCatalog[e.Code]; ok {
+		return info.Class
+	}
+
+	return ERR_RETRYABLE
+}
+
+// ErrorClass 获取任意错误的分类
+// 非微信返回的错误, 比如网络错误, 均为 ERR_RETRYABLE
+func ErrorClass(err error) string {
+	var we *WechatError
+	if errors.As(err, &we) {
+		return we.Class()
+	}
+
+	return ERR_RETRYABLE
+}
+
+// ErrorCode 获取微信错误码, 非微信返回的错误为 0
+func ErrorCode(err error) int {
+	var we *WechatError
+	if errors.As(err, &we) {
+		return we.Code
+	}
+
+	return 0
+}
+
+// Alert 任务遇到需要人工处理的错误时调用
+// 默认记录错误日志, 可以替换为其他的告警方式
+var Alert = func(appid, name string, err error) {
+	logger.Error("[告警] Job-"+appid+" 任务 "+name+" 失败("+ErrorClass(err)+"): ", err.Error())
+}
@@ -0,0 +1,125 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// TestNewWechatError errmsg 末尾的 rid 拆分到 RID 中
+func TestNewWechatError(t *testing.T) {
+	cases := []struct {
+		errmsg  string
+		message string
+		rid     string
+	}{
+		{"invalid appsecret rid: 5f0a-1b2c", "invalid appsecret", "5f0a-1b2c"},
+		{"invalid appsecret, rid: 5f0a-1b2c", "invalid appsecret", "5f0a-1b2c"},
+		{"invalid credential, access_token is invalid or not latest hint: [xyz]", "invalid credential, access_token is invalid or not latest hint: [xyz]", ""},
+		{"rid: 5f0a", "", "5f0a"},
+		{"", "", ""},
+	}
+
+	for _, c := range cases {
+		e := NewWechatError(40125, c.errmsg)
+		if e.Message != c.message || e.RID != c.rid {
+			t.Fatalf("%q: 期望 %q %q, 实际 %q %q", c.errmsg, c.message, c.rid, e.Message, e.RID)
+		}
+	}
+}
+
+// TestCheckJSONResult errcode 为数字或者字符串时都能识别, rid 也可以单独返回
+func TestCheckJSONResult(t *testing.T) {
+	cases := []struct {
+		name string
+		res  map[string]interface{}
+		code int
+		rid  string
+		ok   bool
+	}{
+		{"no-errcode", map[string]interface{}{"access_token": "TOKEN"}, 0, "", true},
+		{"float-zero", map[string]interface{}{"errcode": float64(0), "errmsg": "ok"}, 0, "", true},
+		{"string-zero", map[string]interface{}{"errcode": "0", "errmsg": "ok"}, 0, "", true},
+		{"string-empty", map[string]interface{}{"errcode": ""}, 0, "", true},
+		{"float", map[string]interface{}{"errcode": float64(40001), "errmsg": "invalid credential rid: abc"}, 40001, "abc", false},
+		{"string", map[string]interface{}{"errcode": "45009", "errmsg": "reach max api daily quota limit"}, 45009, "", false},
+		{"negative", map[string]interface{}{"errcode": float64(-1), "errmsg": "system error"}, -1, "", false},
+		{"rid-field", map[string]interface{}{"errcode": float64(40125), "errmsg": "invalid appsecret", "rid": "def"}, 40125, "def", false},
+	}
+
+	for _, c := range cases {
+		err := CheckJSONResult(c.res)
+		if c.ok {
+			if err != nil {
+				t.Fatalf("%s: 不应当返回错误: %v", c.name, err)
+			}
+			continue
+		}
+
+		var we *WechatError
+		if !errors.As(err, &we) {
+			t.Fatalf("%s: 应当返回 *WechatError: %v", c.name, err)
+		}
+
+		if we.Code != c.code || we.RID != c.rid {
+			t.Fatalf("%s: 期望 %d %q, 实际 %d %q", c.name, c.code, c.rid, we.Code, we.RID)
+		}
+	}
+
+	// 无法识别的 errcode 同样是错误
+	if err := CheckJSONResult(map[string]interface{}{"errcode": "busy", "errmsg": "x"}); err == nil {
+		t.Fatal("无法识别的 errcode 应当返回错误")
+	}
+}
+
+// TestErrorClass 已知错误码的分类, 未知错误码及非微信错误均可重试
+func TestErrorClass(t *testing.T) {
+	cases := map[int]string{
+		-1:    ERR_RETRYABLE,
+		40001: ERR_CREDENTIAL,
+		40002: ERR_FATAL,
+		40013: ERR_FATAL,
+		40014: ERR_CREDENTIAL,
+		40030: ERR_CREDENTIAL,
+		40125: ERR_FATAL,
+		40164: ERR_FATAL,
+		41001: ERR_CREDENTIAL,
+		41002: ERR_FATAL,
+		41004: ERR_FATAL,
+		42001: ERR_CREDENTIAL,
+		42002: ERR_CREDENTIAL,
+		45009: ERR_QUOTA,
+		45011: ERR_QUOTA,
+		48001: ERR_FATAL,
+		50001: ERR_FATAL,
+		50002: ERR_FATAL,
+		61005: ERR_CREDENTIAL,
+		61006: ERR_CREDENTIAL,
+		61023: ERR_CREDENTIAL,
+		99999: ERR_RETRYABLE,
+	}
+
+	for code, class := range cases {
+		if got := ErrorClass(NewWechatError(code, "")); got != class {
+			t.Fatalf("%d: 期望 %s, 实际 %s", code, class, got)
+		}
+	}
+
+	for code := range ErrorCatalog {
+		if _, ok := cases[code]; !ok {
+			t.Fatalf("%d 没有测试分类", code)
+		}
+	}
+
+	// 包装之后仍然可以识别
+	wrapped := fmt.Errorf("获取 access_token 失败: %w", NewWechatError(40125, ""))
+	if ErrorClass(wrapped) != ERR_FATAL || ErrorCode(wrapped) != 40125 {
+		t.Fatalf("包装之后的微信错误: %s %d", ErrorClass(wrapped), ErrorCode(wrapped))
+	}
+
+	for _, err := range []error{&HTTPError{API: "access_token", StatusCode: 502}, errors.New("connection refused")} {
+		if ErrorClass(err) != ERR_RETRYABLE || ErrorCode(err) != 0 {
+			t.Fatalf("非微信错误 %v: %s %d", err, ErrorClass(err), ErrorCode(err))
+		}
+	}
+}
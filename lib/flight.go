@@ -0,0 +1,43 @@
+package lib
+
+import (
+	"sync"
+)
+
+// Flight 合并并发的调用
+// 同一时间只会执行一次, 执行期间的调用方等待并得到同一个结果
+type Flight struct {
+	mu   sync.Mutex
+	call *flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	err error
+}
+
+// Do 执行 fn, 如果已经有正在执行的调用, 则等待其结果
+func (f *Flight) Do(fn func() error) error {
+	f.mu.Lock()
+	if c := f.call; c != nil {
+		f.mu.Unlock()
+		c.wg.Wait()
+		return c.err
+	}
+
+	c := new(flightCall)
+	c.wg.Add(1)
+	f.call = c
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		f.call = nil
+		f.mu.Unlock()
+
+		c.wg.Done()
+	}()
+
+	c.err = fn()
+	return c.err
+}
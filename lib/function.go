@@ -2,19 +2,25 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"net/http"
 	"net/url"
 	"strconv"
+
+	"github.com/zjxpcyc/wechat-scheduler/callback"
 )
 
+// DynamicFunc 从业务系统获取动态参数
+type DynamicFunc func(ctx context.Context, appid string, typ int) (map[string]interface{}, error)
+
 // DynamicFuncFactory 获取动态参数函数
-func DynamicFuncFactory(addr string) func(string, int) map[string]interface{} {
+func DynamicFuncFactory(addr string) DynamicFunc {
 	if addr == "" {
 		return nil
 	}
 
-	f := func(appid string, typ int) map[string]interface{} {
+	f := func(ctx context.Context, appid string, typ int) (map[string]interface{}, error) {
 		res := make(map[string]interface{})
 
 		api := WechatAPI{
@@ -27,21 +33,30 @@ func DynamicFuncFactory(addr string) func(string, int) map[string]interface{} {
 		query := url.Values{}
 		query.Add("appid", appid)
 		query.Add("type", strconv.Itoa(typ))
+		api.AddQueryParams(query)
+
+		if _, err := Request(ctx, api, nil, nil, &res); err != nil {
+			return nil, err
+		}
 
-		Request(api, query, nil, &res)
-		return res
+		return res, nil
 	}
 
 	return f
 }
 
+// CallBackFunc 任务成功之后回调业务系统
+// 业务系统返回非 2xx 的状态码时返回 *HTTPError
+type CallBackFunc func(ctx context.Context, appid string, typ int, result map[string]interface{}) error
+
 // CallBackFuncFactory 获取回调函数
-func CallBackFuncFactory(addr string) func(string, int, map[string]interface{}) {
+// secret 返回回调时签名使用的密钥, 为空时不签名; 每次回调时获取, 因此重新注册之后立即生效
+func CallBackFuncFactory(addr string, secret func() string) CallBackFunc {
 	if addr == "" {
 		return nil
 	}
 
-	f := func(appid string, typ int, result map[string]interface{}) {
+	f := func(ctx context.Context, appid string, typ int, result map[string]interface{}) error {
 		api := WechatAPI{
 			Name:        "callback function",
 			URL:         addr,
@@ -52,11 +67,22 @@ func CallBackFuncFactory(addr string) func(string, int, map[string]interface{})
 		query := url.Values{}
 		query.Add("appid", appid)
 		query.Add("type", strconv.Itoa(typ))
+		api.AddQueryParams(query)
+
+		dt, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
 
-		dt, _ := json.Marshal(result)
+		if key := secret(); key != "" {
+			api.Header = make(http.Header)
+			if err := callback.SignRequest(api.Header, key, appid, strconv.Itoa(typ), dt); err != nil {
+				return err
+			}
+		}
 
-		Request(api, query, bytes.NewBuffer(dt))
-		return
+		_, err = Request(ctx, api, nil, bytes.NewBuffer(dt))
+		return err
 	}
 
 	return f
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// http 客户端的默认配置
+const (
+	// DEFAULT_HTTP_TIMEOUT 单次请求的超时时间, 包括读取结果
+	DEFAULT_HTTP_TIMEOUT = 10 * time.Second
+
+	// DEFAULT_HTTP_MAX_IDLE 连接池中最多保留的空闲连接数
+	DEFAULT_HTTP_MAX_IDLE = 100
+)
+
+// HTTPConfig 访问微信接口及业务系统的 http 客户端配置
+type HTTPConfig struct {
+	// Timeout 单次请求的超时时间, 默认 DEFAULT_HTTP_TIMEOUT
+	Timeout time.Duration
+
+	// MaxIdleConns 连接池中最多保留的空闲连接数, 默认 DEFAULT_HTTP_MAX_IDLE
+	MaxIdleConns int
+
+	// Proxy 出口代理地址, 比如 http://10.0.0.1:3128
+	// 微信接口要求 IP 白名单时, 可以通过固定出口 IP 的代理访问; 为空时使用环境变量 HTTPS_PROXY 等
+	Proxy string
+}
+
+// HTTPClient 所有外部请求共用的 http 客户端
+// 可以通过 NewHTTPClient 替换
+var HTTPClient, _ = NewHTTPClient(HTTPConfig{})
+
+// NewHTTPClient 依据配置实例化 http 客户端
+func NewHTTPClient(c HTTPConfig) (*http.Client, error) {
+	if c.Timeout <= 0 {
+		c.Timeout = DEFAULT_HTTP_TIMEOUT
+	}
+
+	if c.MaxIdleConns <= 0 {
+		c.MaxIdleConns = DEFAULT_HTTP_MAX_IDLE
+	}
+
+	proxy := http.ProxyFromEnvironment
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return nil, errors.New("代理地址不正确: " + c.Proxy)
+		}
+
+		proxy = http.ProxyURL(u)
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   c.Timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:          c.MaxIdleConns,
+		MaxIdleConnsPerHost:   c.MaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   c.Timeout,
+		ResponseHeaderTimeout: c.Timeout,
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   c.Timeout,
+	}, nil
+}
+
+// HTTPError 远程接口返回了非 2xx 的状态码
+type HTTPError struct {
+	// API 接口名称
+	API string
+
+	// StatusCode http 状态码
+	StatusCode int
+}
+
+func (e *HTTPError) Error() string {
+	return e.API + ": http 状态码 " + strconv.Itoa(e.StatusCode)
+}
@@ -1,6 +1,10 @@
 package lib
 
 import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
 	"time"
 )
 
@@ -13,27 +17,57 @@ const (
 	TASK_STARTED
 )
 
+// 任务失败后默认的重试策略, 参见 DefaultRetryPolicy
+const (
+	// RETRY_MAX_TIMES 连续失败的最大重试次数, 超过之后任务停止
+	RETRY_MAX_TIMES = 30
+
+	// RETRY_INTERVAL 失败之后首次重试的间隔
+	RETRY_INTERVAL = 30 * time.Second
+)
+
 // JobServer 定时任务服务
+// 任务本身不持有协程, 由 Scheduler 统一调度执行
 type JobServer struct {
-	AppID  string
-	Name   string
-	Status int
-	done   chan bool
-	task   func() error
-	freq   time.Duration
+	AppID string
+	Name  string
+
+	sched  *Scheduler
+	task   func(ctx context.Context) error
+	flight Flight
+
+	mu       sync.Mutex
+	status   int
+	freq     time.Duration
+	retry    RetryPolicy
+	tryTimes int
+	failed   bool
+	lastErr  error
+	nextRun  time.Time
+	running  bool
+	kicked   bool
+	ctx      context.Context
+	cancel   context.CancelFunc
+
+	// 以下由 Scheduler 维护
+	index int
+	next  time.Time
 }
 
 // NewJobServer 实例化 JobServer
 // query 主要是 微信 一系列接口在调用的时候, url query 参数
 // body 是部分接口需要发送的数据
-func NewJobServer(appid string, name string, task func() error, freq time.Duration) *JobServer {
+// task 的 ctx 在任务被停止, 或者调度器关闭超时之后结束
+func NewJobServer(appid string, name string, task func(ctx context.Context) error, freq time.Duration) *JobServer {
 	return &JobServer{
 		AppID:  appid,
 		Name:   name,
-		Status: TASK_NOT_START,
-		done:   make(chan bool),
+		sched:  DefaultScheduler,
 		task:   task,
+		status: TASK_NOT_START,
 		freq:   freq,
+		retry:  DefaultRetryPolicy,
+		index:  -1,
 	}
 }
 
@@ -42,68 +76,306 @@ func (t *JobServer) ID() string {
 	return t.AppID
 }
 
+// SetFreq 设置任务的执行间隔, 下次执行时生效
+func (t *JobServer) SetFreq(freq time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.freq = freq
+}
+
+// SetRetry 设置失败之后的重试策略, 下次失败时生效
+func (t *JobServer) SetRetry(p RetryPolicy) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.retry = p
+}
+
+// Started 任务是否已经启动
+func (t *JobServer) Started() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.status == TASK_STARTED
+}
+
+// Failed 任务是否因为不可重试的错误, 或者超过最大重试次数而停止
+func (t *JobServer) Failed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.failed
+}
+
+// ClearFailed 清除失败状态, 之后任务可以被重新启动
+func (t *JobServer) ClearFailed() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.failed = false
+}
+
+// SetScheduler 使用 s 调度任务, 默认是 DefaultScheduler
+// 需要在 Start 之前调用
+func (t *JobServer) SetScheduler(s *Scheduler) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.sched = s
+}
+
 // Start 启动任务
-// delay 为首次启动任务的延迟时间
+// delay 为首次启动任务的延迟时间, 默认是立即开始
 func (t *JobServer) Start(delay ...time.Duration) {
-	if t.Status == TASK_STARTED {
+	t.mu.Lock()
+	if t.status == TASK_STARTED {
+		t.mu.Unlock()
 		return
 	}
 
-	t.Status = TASK_STARTED
-	go t.start(delay...)
+	d := 0 * time.Second
+	if delay != nil && len(delay) > 0 {
+		d = delay[0]
+	}
+
+	t.status = TASK_STARTED
+	t.tryTimes = 0
+	t.failed = false
+	t.ctx, t.cancel = context.WithCancel(t.sched.runCtx)
+	t.mu.Unlock()
+
+	t.sched.schedule(t, time.Now().Add(d))
 }
 
-// Stop 停止任务
+// Stop 停止任务, 立即生效
+// 正在执行中的任务会执行完毕, 但是不会再被安排
 func (t *JobServer) Stop() {
-	t.Status = TASK_NOT_START
-	t.done <- true
+	t.mu.Lock()
+	t.stop()
+	t.mu.Unlock()
+
+	t.sched.remove(t)
 }
 
-func (t *JobServer) start(delay ...time.Duration) {
-	maxTimes := 30
-	tryTimes := 0
-	firstTime := true
+// Kick 尽快再执行一次任务, 未启动的任务不执行
+// 正在执行时, 在本次执行成功之后立即再执行一次
+func (t *JobServer) Kick() {
+	t.mu.Lock()
+	if t.status != TASK_STARTED {
+		t.mu.Unlock()
+		return
+	}
 
-	// 默认是立即开始
-	d := 0 * time.Second
-	if delay != nil && len(delay) > 0 {
-		d = delay[0]
+	t.kicked = true
+	running := t.running
+	t.mu.Unlock()
+
+	if !running {
+		t.sched.schedule(t, time.Now())
 	}
+}
 
-	for {
-		select {
-		case done := <-t.done:
-			if done {
-				return
-			}
-		default:
-		}
+func (t *JobServer) stop() {
+	t.status = TASK_NOT_START
+	t.nextRun = time.Time{}
+	if t.cancel != nil {
+		t.cancel()
+	}
+}
+
+// ServerStats 任务的运行状态
+type ServerStats struct {
+	// Started 是否已经启动
+	Started bool
 
-		if firstTime {
-			time.Sleep(d)
-			firstTime = false
+	// Failures 连续失败的次数
+	Failures int
+
+	// Failed 因为不可重试的错误, 或者超过最大重试次数而停止
+	Failed bool
+
+	// LastError 最近一次失败的原因, 成功之后清空
+	LastError string
+
+	// ErrorCode 最近一次失败的微信错误码, 非微信返回的错误为 0
+	ErrorCode int
+
+	// ErrorClass 最近一次失败的错误分类, 参见 ERR_RETRYABLE 等
+	ErrorClass string
+
+	// NextRun 下次执行的时间, 未启动时为零值
+	NextRun time.Time
+}
+
+// Stats 获取任务的运行状态
+func (t *JobServer) Stats() ServerStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	st := ServerStats{
+		Started:  t.status == TASK_STARTED,
+		Failures: t.tryTimes,
+		Failed:   t.failed,
+		NextRun:  t.nextRun,
+	}
+
+	if t.lastErr != nil {
+		st.LastError = t.lastErr.Error()
+		st.ErrorCode = ErrorCode(t.lastErr)
+		st.ErrorClass = ErrorClass(t.lastErr)
+	}
+
+	return st
+}
+
+func (t *JobServer) setNextRun(at time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.nextRun = at
+}
+
+// Refresh 立即执行任务, 并依据结果重新安排下次执行
+// 与调度器的执行合并, 同一时间只会执行一次, 所有调用方得到同一个结果
+func (t *JobServer) Refresh() error {
+	return t.run()
+}
+
+// run 执行任务, 任务处于启动状态时安排下次执行
+func (t *JobServer) run() error {
+	err := t.flight.Do(func() error {
+		ctx := t.context()
+
+		// 未启动, 以及已经停止或者失败的任务只受调度器关闭的影响
+		// 比如手动刷新已经失败的任务
+		runCtx := ctx
+		if runCtx == nil {
+			runCtx = t.sched.runCtx
 		}
 
+		t.mu.Lock()
+		t.running = true
+		t.kicked = false
+		t.mu.Unlock()
+
 		logger.Info("任务 " + t.Name + " 开始 ...")
-		err := t.task()
+		err := t.call(runCtx)
+
+		// 未启动, 或者执行过程中任务被停止, 则不再安排
+		if ctx == nil || ctx.Err() != nil {
+			t.mu.Lock()
+			t.running = false
+			t.mu.Unlock()
+			return err
+		}
+
+		next, ok := t.after(err)
+		if ok {
+			t.sched.schedule(t, time.Now().Add(next))
+		}
+
+		// 需要人工处理的错误, 以及任务因为失败而停止时告警
+		if err != nil && (!ok || ErrorClass(err) != ERR_RETRYABLE) {
+			Alert(t.AppID, t.Name, err)
+		}
+
+		return err
+	})
+
+	// 执行期间任务被停止又重新启动时, 新启动安排的执行合并到了旧的执行中,
+	// 而旧的执行因为 ctx 已经取消不再安排, 需要补上
+	t.reschedule()
+
+	return err
+}
 
-		if err != nil {
-			if tryTimes >= maxTimes {
-				t.Stop()
-				return
-			}
+// reschedule 任务处于启动状态, 但是既没有在执行, 也不在等待队列中时, 立即安排执行
+func (t *JobServer) reschedule() {
+	t.mu.Lock()
+	idle := t.status == TASK_STARTED && !t.running
+	t.mu.Unlock()
 
-			tryTimes++
-			logger.Error("任务 "+t.Name+" 执行失败, ", err.Error())
+	if idle {
+		t.sched.scheduleIdle(t, time.Now())
+	}
+}
 
-			// 30 秒后重试
-			logger.Error("30 秒后自动重试 ...")
-			time.Sleep(30 * time.Second)
-			continue
+// call 执行任务, 任务 panic 时转换为任务的错误
+// 所有 appid 的任务共用调度器的 worker, 一个任务的 panic 不能影响其他任务
+func (t *JobServer) call(ctx context.Context) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error("任务 "+t.Name+" panic: ", fmt.Sprintf("%v\n%s", p, debug.Stack()))
+			err = fmt.Errorf("任务 %s 执行出错: %v", t.Name, p)
 		}
+	}()
+
+	return t.task(ctx)
+}
+
+// context 任务启动时的 ctx, 未启动时返回 nil
+// 停止或者失败之后 t.ctx 已经被取消, 不能再使用
+func (t *JobServer) context() context.Context {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.status != TASK_STARTED {
+		return nil
+	}
+
+	return t.ctx
+}
+
+// after 依据执行结果, 计算下次执行的间隔
+// 返回 false 表示任务不再执行
+func (t *JobServer) after(err error) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// 与 Kick 在同一个锁内判断, 避免执行结束时的 Kick 被忽略
+	t.running = false
+	kicked := t.kicked
+	t.kicked = false
 
-		tryTimes = 0
+	if err == nil {
+		t.tryTimes = 0
+		t.lastErr = nil
 		logger.Info("任务 " + t.Name + " 结束")
-		time.Sleep(t.freq)
+
+		if kicked {
+			return 0, true
+		}
+
+		return t.freq, true
+	}
+
+	logger.Error("任务 "+t.Name+" 执行失败, ", err.Error())
+
+	t.lastErr = err
+	t.tryTimes++
+
+	class := ErrorClass(err)
+	if class == ERR_FATAL {
+		logger.Error("任务 " + t.Name + " 遇到不可重试的错误, 已停止")
+		t.failed = true
+		t.stop()
+		return 0, false
+	}
+
+	if t.retry.Exhausted(t.tryTimes) {
+		logger.Error("任务 " + t.Name + " 连续失败次数过多, 已停止")
+		t.failed = true
+		t.stop()
+		return 0, false
 	}
+
+	// 超过调用次数限制时, 短时间内重试也不会成功
+	next := t.retry.Backoff(t.tryTimes)
+	if class == ERR_QUOTA {
+		next = t.retry.Max
+	}
+
+	logger.Error(next.Round(time.Second).String() + " 后自动重试 ...")
+	return next, true
 }
@@ -0,0 +1,173 @@
+package lib
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestServer 使用独立调度器的 JobServer, 测试结束时关闭调度器
+func newTestServer(t *testing.T, task func(ctx context.Context) error) *JobServer {
+	sched := NewScheduler(2)
+	t.Cleanup(sched.Stop)
+
+	s := NewJobServer("wx-test", "test", task, time.Hour)
+	s.sched = sched
+	return s
+}
+
+// waitFor 等待 cond 成立, 超时则测试失败
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("等待超时: " + what)
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRefreshAfterFatalError(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return NewWechatError(40125, "invalid appsecret")
+		}
+
+		return ctx.Err()
+	})
+
+	s.Start()
+	waitFor(t, "任务失败", s.Failed)
+
+	if s.Started() {
+		t.Fatal("遇到不可重试的错误之后任务应当停止")
+	}
+
+	if err := s.Refresh(); err != nil {
+		t.Fatalf("手动刷新已经失败的任务: %v", err)
+	}
+}
+
+func TestRefreshAfterStop(t *testing.T) {
+	s := newTestServer(t, func(ctx context.Context) error {
+		return ctx.Err()
+	})
+
+	s.Start(time.Hour)
+	s.Stop()
+
+	if err := s.Refresh(); err != nil {
+		t.Fatalf("手动刷新已经停止的任务: %v", err)
+	}
+
+	if s.Started() {
+		t.Fatal("手动刷新不应当启动已经停止的任务")
+	}
+}
+
+func TestStopDuringRun(t *testing.T) {
+	running := make(chan struct{})
+	release := make(chan struct{})
+
+	s := newTestServer(t, func(ctx context.Context) error {
+		close(running)
+		<-release
+		return ctx.Err()
+	})
+
+	s.Start()
+	<-running
+	s.Stop()
+	close(release)
+
+	waitFor(t, "任务结束", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		return !s.running
+	})
+
+	if s.Stats().NextRun != (time.Time{}) || s.sched.Len() != 0 {
+		t.Fatal("执行过程中被停止的任务不应当再被安排")
+	}
+}
+
+// TestRestartDuringRun 执行过程中任务被停止又重新启动, 之后仍然按时执行
+// 重新启动安排的执行会合并到正在进行的执行中, 不能因此丢失
+func TestRestartDuringRun(t *testing.T) {
+	var calls int32
+	running := make(chan struct{})
+	release := make(chan struct{})
+
+	s := newTestServer(t, func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(running)
+			<-release
+		}
+
+		return nil
+	})
+
+	s.Start()
+	<-running
+
+	s.Stop()
+	s.Start()
+
+	// 等待重新启动安排的执行从队列中取出, 合并到正在进行的执行中
+	waitFor(t, "重新启动的执行开始", func() bool { return s.sched.Len() == 0 })
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	waitFor(t, "重新启动之后再次执行", func() bool { return atomic.LoadInt32(&calls) >= 2 })
+	waitFor(t, "安排下次执行", func() bool { return s.Stats().NextRun.After(time.Now()) })
+
+	if !s.Started() || s.sched.Len() != 1 {
+		t.Fatalf("重新启动的任务应当继续被安排: %+v", s.Stats())
+	}
+}
+
+// TestRefreshConcurrent 并发的手动刷新与调度器的执行合并为一次, 所有调用方得到同一个结果
+func TestRefreshConcurrent(t *testing.T) {
+	var calls int32
+	running := make(chan struct{})
+	release := make(chan struct{})
+
+	s := newTestServer(t, func(ctx context.Context) error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(running)
+			<-release
+		}
+
+		return NewWechatError(-1, "system busy")
+	})
+
+	// 调度器的执行
+	s.Start()
+	<-running
+
+	const n = 10
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() { errs <- s.Refresh() }()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(release)
+
+	for i := 0; i < n; i++ {
+		err := <-errs
+		if ErrorCode(err) != -1 {
+			t.Fatalf("所有调用方应当得到同一个结果: %v", err)
+		}
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("任务应当只执行一次, 实际 %d 次", got)
+	}
+}
@@ -1,16 +1,75 @@
 package lib
 
 import (
+	"fmt"
+	"sync"
+
 	"github.com/zjxpcyc/tinylogger"
 )
 
 var logger tinylogger.LogService
 
+// output 默认日志记录器实际的输出
+var output = &redactLogger{out: new(tinylogger.Logger)}
+
 // GetLogger 获取日志记录器
+// 记录的内容会先经过 Redact 去除 appsecret, token 等敏感内容
 func GetLogger() tinylogger.LogService {
 	return logger
 }
 
+// SetOutput 替换 GetLogger 实际的输出, 已经获取的日志记录器同样生效
+// 记录的内容仍然先经过 Redact, 主要用于测试时检查日志内容
+func SetOutput(l tinylogger.LogService) {
+	output.mu.Lock()
+	defer output.mu.Unlock()
+
+	output.out = l
+}
+
+// redactLogger 记录日志之前去除敏感内容
+type redactLogger struct {
+	mu  sync.RWMutex
+	out tinylogger.LogService
+}
+
+// NewRedactLogger 包装 l, 记录的内容会先经过 Redact
+func NewRedactLogger(l tinylogger.LogService) tinylogger.LogService {
+	return &redactLogger{out: l}
+}
+
+func (l *redactLogger) sink() tinylogger.LogService {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return l.out
+}
+
+func (l *redactLogger) Info(v ...interface{}) {
+	l.sink().Info(redactArgs(v)...)
+}
+
+func (l *redactLogger) Warning(v ...interface{}) {
+	l.sink().Warning(redactArgs(v)...)
+}
+
+func (l *redactLogger) Error(v ...interface{}) {
+	l.sink().Error(redactArgs(v)...)
+}
+
+func (l *redactLogger) Debug(v ...interface{}) {
+	l.sink().Debug(redactArgs(v)...)
+}
+
+func redactArgs(v []interface{}) []interface{} {
+	args := make([]interface{}, len(v))
+	for i, arg := range v {
+		args[i] = Redact(fmt.Sprint(arg))
+	}
+
+	return args
+}
+
 func init() {
-	logger = new(tinylogger.Logger)
+	logger = output
 }
@@ -0,0 +1,40 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/zjxpcyc/tinylogger"
+)
+
+// lines 记录所有日志
+type lines []string
+
+func (l *lines) Info(v ...interface{})    { *l = append(*l, fmt.Sprint(v...)) }
+func (l *lines) Warning(v ...interface{}) { *l = append(*l, fmt.Sprint(v...)) }
+func (l *lines) Error(v ...interface{})   { *l = append(*l, fmt.Sprint(v...)) }
+func (l *lines) Debug(v ...interface{})   { *l = append(*l, fmt.Sprint(v...)) }
+
+// TestSetOutput 替换输出之后, 已经获取的日志记录器同样生效, 内容仍然去除敏感字段
+func TestSetOutput(t *testing.T) {
+	l := GetLogger()
+
+	out := &lines{}
+	SetOutput(out)
+	defer SetOutput(new(tinylogger.Logger))
+
+	l.Info("请求: ", "https://api.weixin.qq.com/cgi-bin/token?appid=wx&secret=APPSECRET")
+	l.Error(`微信返回: {"access_token":"ACCESS_TOKEN","expires_in":7200}`)
+
+	all := strings.Join(*out, "\n")
+	if len(*out) != 2 {
+		t.Fatalf("日志没有写入新的输出: %q", all)
+	}
+
+	for _, secret := range []string{"APPSECRET", "ACCESS_TOKEN"} {
+		if strings.Contains(all, secret) {
+			t.Fatalf("日志中出现了 %s: %s", secret, all)
+		}
+	}
+}
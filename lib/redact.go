@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"regexp"
+	"strings"
+)
+
+// REDACTED 日志中替换敏感内容的字符串
+const REDACTED = "******"
+
+// SensitiveKeys 不能出现在日志中的字段
+// 匹配时忽略大小写及下划线, 因此同时适用于 url query, json 以及 xml(比如 ComponentVerifyTicket)
+var SensitiveKeys = map[string]bool{
+	"secret":                   true,
+	"appsecret":                true,
+	"component_appsecret":      true,
+	"component_verify_ticket":  true,
+	"access_token":             true,
+	"refresh_token":            true,
+	"component_access_token":   true,
+	"authorizer_access_token":  true,
+	"authorizer_refresh_token": true,
+	"pre_auth_code":            true,
+	"ticket":                   true,
+	"notify_secret":            true,
+}
+
+var (
+	// key=value, url query 或者 form 表单
+	queryPattern = regexp.MustCompile(`([A-Za-z_]+)=([^&\s"'<>]*)`)
+
+	// "key": "value", json
+	jsonPattern = regexp.MustCompile(`"([A-Za-z_]+)"(\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+	// <Key>value</Key> 或者 <Key><![CDATA[value]]></Key>, xml
+	xmlPattern = regexp.MustCompile(`<([A-Za-z_]+)>(?:<!\[CDATA\[[\s\S]*?\]\]>|[^<]*)</([A-Za-z_]+)>`)
+)
+
+// IsSensitive key 是否为敏感字段
+func IsSensitive(key string) bool {
+	key = normalizeKey(key)
+
+	for k := range SensitiveKeys {
+		if normalizeKey(k) == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+func normalizeKey(key string) string {
+	return strings.ToLower(strings.Replace(key, "_", "", -1))
+}
+
+// Redact 将内容中敏感字段的值替换为 REDACTED, 用于记录日志
+// 支持 url, json 以及 xml 格式的内容
+func Redact(s string) string {
+	s = jsonPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := jsonPattern.FindStringSubmatch(m)
+		if !IsSensitive(sub[1]) {
+			return m
+		}
+
+		return `"` + sub[1] + `"` + sub[2] + `"` + REDACTED + `"`
+	})
+
+	s = xmlPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := xmlPattern.FindStringSubmatch(m)
+		if sub[1] != sub[2] || !IsSensitive(sub[1]) {
+			return m
+		}
+
+		return "<" + sub[1] + ">" + REDACTED + "</" + sub[2] + ">"
+	})
+
+	s = queryPattern.ReplaceAllStringFunc(s, func(m string) string {
+		sub := queryPattern.FindStringSubmatch(m)
+		if !IsSensitive(sub[1]) {
+			return m
+		}
+
+		return sub[1] + "=" + REDACTED
+	})
+
+	return s
+}
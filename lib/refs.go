@@ -1,6 +1,9 @@
 package lib
 
-import "net/url"
+import (
+	"net/http"
+	"net/url"
+)
 
 // WechatAPI 微信接口
 type WechatAPI struct {
@@ -15,6 +18,9 @@ type WechatAPI struct {
 
 	// 请求及返回格式
 	ContentType string
+
+	// Header 额外的请求头, 比如回调的签名
+	Header http.Header
 }
 
 // SetQueryParams 设置 URL query 参数
@@ -36,6 +42,24 @@ func (w *WechatAPI) SetQueryParams(params url.Values) *WechatAPI {
 	return w
 }
 
+// AddQueryParams 添加 URL query 参数, 已有的参数会被替换
+// 与 SetQueryParams 不同, 地址中原来没有的参数也会被加上
+func (w *WechatAPI) AddQueryParams(params url.Values) *WechatAPI {
+	u, e := url.Parse(w.URL)
+	if e != nil {
+		return w
+	}
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+
+	u.RawQuery = q.Encode()
+	w.URL = u.String()
+	return w
+}
+
 var (
 	// MimeJSON mime-type json
 	MimeJSON = "application/json"
@@ -2,6 +2,7 @@ package lib
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
@@ -9,51 +10,63 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 )
 
 // Request 请求数据
 // 请求远程 http 服务数据, 针对微信相关接口进行了特殊的处理
+// ctx 结束时请求被取消, 请求使用共用的 HTTPClient, 超时时间等参见 HTTPConfig
 // 请求的地址, 方式等通过 api 指定, url 中的 search 参数通过 query 指定
 // 如果请求中需要包含 body 内容, 则传入 body 参数, 没有传 nil 即可
 // result 是可选参数, 用来承载或者格式化远程请求的结果, 比如 远程返回的实际上是 json 字串, 那么 result 可以为该 json 对应的 struct 指针
-// data 返回值是远程请求的原始结果内容
-func Request(api WechatAPI, query url.Values, body io.Reader, result ...interface{}) (data []byte, err error) {
+// data 返回值是远程请求的原始结果内容, 远程返回非 2xx 状态码时返回 *HTTPError
+func Request(ctx context.Context, api WechatAPI, query url.Values, body io.Reader, result ...interface{}) (data []byte, err error) {
 	// 请求地址
 	if query != nil {
 		(&api).SetQueryParams(query)
 	}
 	addr := api.URL
 
-	logger.Info("远程请求接口 URL ", addr)
+	logger.Info("远程请求接口 URL ", Redact(addr))
 	logger.Info("远程请求方法 ", api.Method)
 
 	// 请求 Body
+	// 先读取出来, 记录日志之后再发送, 不能直接使用 body, 否则发送的内容为空
 	var bodyData io.Reader
 	if api.Method != http.MethodGet && body != nil {
-		bodyData = body
+		var b []byte
+		b, err = ioutil.ReadAll(body)
+		if err != nil {
+			logger.Error("读取请求体内容失败 ", err.Error())
+			return
+		}
 
-		b := &bytes.Buffer{}
-		io.Copy(b, body)
-		logger.Info("远程请求体内容 ", b.String())
-	} else {
-		bodyData = nil
+		logger.Info("远程请求体内容 ", Redact(string(b)))
+		bodyData = bytes.NewReader(b)
 	}
 
 	// 构造 http 请求
 	var req *http.Request
 	var res *http.Response
-	client := new(http.Client)
 
-	req, err = http.NewRequest(api.Method, addr, bodyData)
+	req, err = http.NewRequestWithContext(ctx, api.Method, addr, bodyData)
 	if err != nil {
 		logger.Error("初始化 http 客户端失败 ", err.Error())
 		return
 	}
 
 	req.Header.Add("Content-type", api.ContentType)
+	for k, v := range api.Header {
+		req.Header[k] = v
+	}
 
-	res, err = client.Do(req)
+	res, err = HTTPClient.Do(req)
 	if err != nil {
+		// 错误中带有完整的请求地址, 可能包含 secret 等参数, 这里只保留接口名称
+		if ue, ok := err.(*url.Error); ok {
+			err = fmt.Errorf("%s %s: %w", ue.Op, api.Name, ue.Err)
+		}
+
 		logger.Error("http 请求数据失败 ", err.Error())
 		return
 	}
@@ -64,7 +77,14 @@ func Request(api WechatAPI, query url.Values, body io.Reader, result ...interfac
 		logger.Error("读取 http 请求结果失败 ", err.Error())
 		return
 	} else {
-		logger.Info("远程请求结果 ", string(data))
+		logger.Info("远程请求结果 ", Redact(string(data)))
+	}
+
+	// 错误页面不做格式化
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		err = &HTTPError{API: api.Name, StatusCode: res.StatusCode}
+		logger.Error("http 请求数据失败 ", err.Error())
+		return
 	}
 
 	// 格式化结果
@@ -88,22 +108,37 @@ func Request(api WechatAPI, query url.Values, body io.Reader, result ...interfac
 }
 
 // CheckJSONResult 校验结果
+// 微信返回错误时, 返回 *WechatError
 func CheckJSONResult(res map[string]interface{}) error {
 	code, ok := res["errcode"]
 	if !ok {
 		return nil
 	}
 
+	errcode := 0
 	switch status := code.(type) {
 	case float64:
-		if int(status) == 0 {
-			return nil
-		}
+		errcode = int(status)
 	case string:
-		if status == "0" || status == "" {
+		if status == "" {
 			return nil
 		}
+
+		var err error
+		if errcode, err = strconv.Atoi(status); err != nil {
+			return fmt.Errorf("%v - %s", code, res["errmsg"])
+		}
+	}
+
+	if errcode == 0 {
+		return nil
+	}
+
+	errmsg, _ := res["errmsg"].(string)
+	e := NewWechatError(errcode, errmsg)
+	if rid, ok := res["rid"].(string); ok && e.RID == "" {
+		e.RID = rid
 	}
 
-	return fmt.Errorf("%v - %s", code, res["errmsg"])
+	return e
 }
@@ -0,0 +1,54 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRequestContext 请求被取消或者超时时, 可以通过 errors.Is 区分, 错误中不包含请求地址的参数
+func TestRequestContext(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(func() {
+		close(release)
+		srv.Close()
+	})
+
+	api := WechatAPI{Name: "access_token", URL: srv.URL + "/cgi-bin/token?secret=APPSECRET", Method: http.MethodGet, ContentType: MimeJSON}
+
+	canceled, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	expired, cancel2 := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel2()
+
+	cases := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"canceled", canceled, context.Canceled},
+		{"deadline", expired, context.DeadlineExceeded},
+	}
+
+	for _, c := range cases {
+		_, err := Request(c.ctx, api, nil, nil)
+		if !errors.Is(err, c.want) {
+			t.Fatalf("%s: 期望 %v, 实际 %v", c.name, c.want, err)
+		}
+
+		if strings.Contains(err.Error(), "APPSECRET") {
+			t.Fatalf("%s: 错误中出现了请求地址的参数: %v", c.name, err)
+		}
+	}
+}
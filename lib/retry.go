@@ -0,0 +1,87 @@
+package lib
+
+import (
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// RETRY_FOREVER 不限制重试次数
+const RETRY_FOREVER = -1
+
+// RetryPolicy 任务失败之后的重试策略
+// 第 n 次重试的间隔为 Initial * Multiplier^(n-1), 不超过 Max, 并随机增减不超过 Jitter 比例的时间
+type RetryPolicy struct {
+	// Initial 第一次重试的间隔
+	Initial time.Duration
+
+	// Multiplier 每次重试间隔的倍数, 1 代表固定间隔
+	Multiplier float64
+
+	// Max 重试间隔的最大值
+	Max time.Duration
+
+	// Jitter 随机抖动的比例, 0 到 1 之间, 避免大量任务同时重试
+	Jitter float64
+
+	// MaxAttempts 连续失败之后的最大重试次数, 超过之后任务停止; RETRY_FOREVER 代表一直重试
+	MaxAttempts int
+}
+
+// DefaultRetryPolicy 默认的重试策略
+var DefaultRetryPolicy = RetryPolicy{
+	Initial:     RETRY_INTERVAL,
+	Multiplier:  2,
+	Max:         10 * time.Minute,
+	Jitter:      0.2,
+	MaxAttempts: RETRY_MAX_TIMES,
+}
+
+// Validate 校验重试策略
+func (p RetryPolicy) Validate() error {
+	if p.Initial <= 0 {
+		return errors.New("重试间隔必须大于 0")
+	}
+
+	if p.Multiplier < 1 {
+		return errors.New("重试间隔的倍数不能小于 1")
+	}
+
+	if p.Max < p.Initial {
+		return errors.New("最大重试间隔不能小于首次重试间隔")
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("随机抖动的比例必须在 0 到 1 之间")
+	}
+
+	if p.MaxAttempts < RETRY_FOREVER {
+		return errors.New("最大重试次数不正确")
+	}
+
+	return nil
+}
+
+// Exhausted 连续失败 failures 次之后, 是否不再重试
+func (p RetryPolicy) Exhausted(failures int) bool {
+	return p.MaxAttempts != RETRY_FOREVER && failures > p.MaxAttempts
+}
+
+// Backoff 第 attempt 次重试前的等待时间, attempt 从 1 开始
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 {
+		attempt = 1
+	}
+
+	d := float64(p.Initial) * math.Pow(p.Multiplier, float64(attempt-1))
+	if d > float64(p.Max) {
+		d = float64(p.Max)
+	}
+
+	if p.Jitter > 0 {
+		d += d * p.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return time.Duration(d)
+}
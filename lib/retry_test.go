@@ -0,0 +1,175 @@
+package lib
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := RetryPolicy{
+		Initial:    time.Second,
+		Multiplier: 2,
+		Max:        10 * time.Second,
+	}
+
+	cases := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{100, 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		if got := p.Backoff(c.attempt); got != c.want {
+			t.Fatalf("第 %d 次重试: 期望 %s, 实际 %s", c.attempt, c.want, got)
+		}
+	}
+
+	// 倍数为 1 时为固定间隔
+	p.Multiplier = 1
+	for attempt := 1; attempt < 5; attempt++ {
+		if got := p.Backoff(attempt); got != time.Second {
+			t.Fatalf("固定间隔第 %d 次重试: 实际 %s", attempt, got)
+		}
+	}
+}
+
+func TestBackoffJitter(t *testing.T) {
+	p := RetryPolicy{
+		Initial:    time.Second,
+		Multiplier: 2,
+		Max:        10 * time.Second,
+		Jitter:     0.2,
+	}
+
+	cases := []struct {
+		attempt int
+		base    time.Duration
+	}{
+		{1, time.Second},
+		{3, 4 * time.Second},
+		// 抖动在上限之后计算, 可能超过 Max
+		{10, 10 * time.Second},
+	}
+
+	for _, c := range cases {
+		min := c.base - time.Duration(float64(c.base)*p.Jitter)
+		max := c.base + time.Duration(float64(c.base)*p.Jitter)
+
+		lower, higher := false, false
+		for i := 0; i < 1000; i++ {
+			got := p.Backoff(c.attempt)
+			if got < min || got > max {
+				t.Fatalf("第 %d 次重试: %s 超出 [%s, %s]", c.attempt, got, min, max)
+			}
+
+			lower = lower || got < c.base
+			higher = higher || got > c.base
+		}
+
+		if !lower || !higher {
+			t.Fatalf("第 %d 次重试: 没有随机抖动", c.attempt)
+		}
+	}
+}
+
+func TestExhausted(t *testing.T) {
+	cases := []struct {
+		attempts int
+		failures int
+		want     bool
+	}{
+		{0, 0, false},
+		{0, 1, true},
+		{3, 1, false},
+		{3, 3, false},
+		{3, 4, true},
+		{RETRY_FOREVER, 1, false},
+		{RETRY_FOREVER, 1 << 20, false},
+	}
+
+	for _, c := range cases {
+		p := RetryPolicy{MaxAttempts: c.attempts}
+		if got := p.Exhausted(c.failures); got != c.want {
+			t.Fatalf("最大重试 %d 次, 连续失败 %d 次: 期望 %v, 实际 %v", c.attempts, c.failures, c.want, got)
+		}
+	}
+}
+
+func TestRetryPolicyValidate(t *testing.T) {
+	valid := RetryPolicy{
+		Initial:     time.Second,
+		Multiplier:  1,
+		Max:         time.Second,
+		Jitter:      1,
+		MaxAttempts: RETRY_FOREVER,
+	}
+
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("校验合法的重试策略: %v", err)
+	}
+
+	if err := DefaultRetryPolicy.Validate(); err != nil {
+		t.Fatalf("校验默认的重试策略: %v", err)
+	}
+
+	cases := []struct {
+		name   string
+		modify func(p *RetryPolicy)
+	}{
+		{"间隔为 0", func(p *RetryPolicy) { p.Initial = 0 }},
+		{"间隔为负数", func(p *RetryPolicy) { p.Initial = -time.Second }},
+		{"倍数小于 1", func(p *RetryPolicy) { p.Multiplier = 0.5 }},
+		{"最大间隔小于首次间隔", func(p *RetryPolicy) { p.Max = time.Millisecond }},
+		{"抖动为负数", func(p *RetryPolicy) { p.Jitter = -0.1 }},
+		{"抖动大于 1", func(p *RetryPolicy) { p.Jitter = 1.1 }},
+		{"重试次数小于 -1", func(p *RetryPolicy) { p.MaxAttempts = -2 }},
+	}
+
+	for _, c := range cases {
+		p := valid
+		c.modify(&p)
+
+		if err := p.Validate(); err == nil {
+			t.Fatalf("%s: 应当校验失败", c.name)
+		}
+	}
+}
+
+// TestRetryExhausted 连续失败超过最大重试次数之后任务停止
+func TestRetryExhausted(t *testing.T) {
+	var calls int32
+	s := newTestServer(t, func(ctx context.Context) error {
+		atomic.AddInt32(&calls, 1)
+		return errors.New("请求失败")
+	})
+
+	s.SetRetry(RetryPolicy{
+		Initial:     time.Millisecond,
+		Multiplier:  1,
+		Max:         time.Millisecond,
+		MaxAttempts: 2,
+	})
+
+	s.Start()
+	waitFor(t, "任务失败", s.Failed)
+
+	if s.Started() {
+		t.Fatal("超过最大重试次数之后任务应当停止")
+	}
+
+	// 第一次执行及两次重试
+	time.Sleep(20 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 3 {
+		t.Fatalf("期望执行 3 次, 实际 %d 次", got)
+	}
+}
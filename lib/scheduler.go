@@ -0,0 +1,268 @@
+package lib
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// DEFAULT_WORKERS 调度器默认的 worker 数量
+const DEFAULT_WORKERS = 10
+
+// Scheduler 定时任务调度器
+// 所有的 JobServer 共用一个调度器, 按照下次执行时间维护一个最小堆,
+// 到期的任务交给固定数量的 worker 执行
+type Scheduler struct {
+	workers int
+
+	mu    sync.Mutex
+	queue serverQueue
+	wake  chan struct{}
+	work  chan *JobServer
+
+	once   sync.Once
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// runCtx 正在执行的任务使用, 关闭时等待超时之后才结束
+	runCtx    context.Context
+	runCancel context.CancelFunc
+}
+
+// DefaultScheduler 默认调度器, NewJobServer 创建的任务都由它调度
+var DefaultScheduler = NewScheduler(DEFAULT_WORKERS)
+
+// NewScheduler 实例化调度器
+// workers 为同时执行任务的最大数量, 调度器在第一个任务加入时启动
+func NewScheduler(workers int) *Scheduler {
+	if workers <= 0 {
+		workers = DEFAULT_WORKERS
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	runCtx, runCancel := context.WithCancel(context.Background())
+
+	return &Scheduler{
+		workers:   workers,
+		wake:      make(chan struct{}, 1),
+		work:      make(chan *JobServer),
+		ctx:       ctx,
+		cancel:    cancel,
+		runCtx:    runCtx,
+		runCancel: runCancel,
+	}
+}
+
+// Stop 停止调度器
+// 不再执行新的任务, 并等待正在执行的任务结束
+func (s *Scheduler) Stop() {
+	s.Shutdown(context.Background())
+}
+
+// Shutdown 停止调度器, 并等待正在执行的任务结束
+// ctx 结束时取消正在执行的任务, 不再等待, 返回 ctx 的错误
+func (s *Scheduler) Shutdown(ctx context.Context) error {
+	s.cancel()
+	defer s.runCancel()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len 当前等待执行的任务数量
+func (s *Scheduler) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.queue)
+}
+
+// schedule 安排任务在 at 时刻执行
+func (s *Scheduler) schedule(t *JobServer, at time.Time) {
+	s.push(t, at, false)
+}
+
+// scheduleIdle 任务不在等待队列中时, 安排在 at 时刻执行
+func (s *Scheduler) scheduleIdle(t *JobServer, at time.Time) {
+	s.push(t, at, true)
+}
+
+// push 将任务加入等待队列, 已经在队列中时调整执行时间
+// idle 为 true 时, 已经在队列中的任务保持不变
+func (s *Scheduler) push(t *JobServer, at time.Time, idle bool) {
+	s.once.Do(s.run)
+	if !idle {
+		t.setNextRun(at)
+	}
+
+	s.mu.Lock()
+	if idle && t.index >= 0 {
+		s.mu.Unlock()
+		return
+	}
+
+	t.next = at
+	if t.index >= 0 {
+		heap.Fix(&s.queue, t.index)
+	} else {
+		heap.Push(&s.queue, t)
+	}
+	s.mu.Unlock()
+
+	if idle {
+		t.setNextRun(at)
+	}
+
+	s.notify()
+}
+
+// remove 将任务从等待队列中移除
+func (s *Scheduler) remove(t *JobServer) {
+	s.mu.Lock()
+	if t.index >= 0 {
+		heap.Remove(&s.queue, t.index)
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) run() {
+	s.wg.Add(s.workers + 1)
+
+	for i := 0; i < s.workers; i++ {
+		go s.worker()
+	}
+
+	go s.loop()
+}
+
+// loop 取出到期的任务交给 worker, 没有到期的任务则等待最近的一个
+func (s *Scheduler) loop() {
+	defer s.wg.Done()
+
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 && !s.queue[0].next.After(time.Now()) {
+			t := heap.Pop(&s.queue).(*JobServer)
+			s.mu.Unlock()
+
+			select {
+			case s.work <- t:
+			case <-s.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		// 没有任务时一直等待, 直到有任务加入
+		var wait time.Duration
+		if len(s.queue) > 0 {
+			wait = s.queue[0].next.Sub(time.Now())
+		}
+		s.mu.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		var alarm <-chan time.Time
+		if wait > 0 {
+			timer.Reset(wait)
+			alarm = timer.C
+		}
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.wake:
+		case <-alarm:
+		}
+	}
+}
+
+func (s *Scheduler) worker() {
+	defer s.wg.Done()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case t := <-s.work:
+			s.exec(t)
+		}
+	}
+}
+
+// exec 执行任务, 并依据执行结果安排下一次执行
+// 任务的 panic 已经在 JobServer 中转换为错误, 这里兜底, 保证 worker 不会退出
+func (s *Scheduler) exec(t *JobServer) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error("调度任务 "+t.Name+" 出错: ", fmt.Sprintf("%v\n%s", p, debug.Stack()))
+		}
+	}()
+
+	ctx := t.context()
+	if ctx == nil || ctx.Err() != nil {
+		return
+	}
+
+	t.run()
+}
+
+// serverQueue 以下次执行时间排序的最小堆
+type serverQueue []*JobServer
+
+func (q serverQueue) Len() int { return len(q) }
+
+func (q serverQueue) Less(i, j int) bool { return q[i].next.Before(q[j].next) }
+
+func (q serverQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index = i
+	q[j].index = j
+}
+
+func (q *serverQueue) Push(x interface{}) {
+	t := x.(*JobServer)
+	t.index = len(*q)
+	*q = append(*q, t)
+}
+
+func (q *serverQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*q = old[:n-1]
+	return t
+}
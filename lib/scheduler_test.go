@@ -0,0 +1,81 @@
+package lib
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestPanicTask 任务 panic 不影响调度器中的其他任务
+func TestPanicTask(t *testing.T) {
+	sched := NewScheduler(1)
+	t.Cleanup(sched.Stop)
+
+	bad := NewJobServer("wx-panic", "panic", func(ctx context.Context) error {
+		var m map[string]interface{}
+		_ = m["token"].(string)
+		return nil
+	}, time.Hour)
+	bad.sched = sched
+	bad.SetRetry(RetryPolicy{Initial: time.Hour, Multiplier: 1, Max: time.Hour, MaxAttempts: RETRY_FOREVER})
+
+	var runs int32
+	good := NewJobServer("wx-good", "good", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, 10*time.Millisecond)
+	good.sched = sched
+
+	bad.Start()
+	waitFor(t, "panic 的任务执行失败", func() bool { return bad.Stats().Failures > 0 })
+
+	good.Start()
+	waitFor(t, "其他任务继续执行", func() bool { return atomic.LoadInt32(&runs) >= 3 })
+
+	st := bad.Stats()
+	if !st.Started || st.ErrorClass != ERR_RETRYABLE || !strings.Contains(st.LastError, "执行出错") {
+		t.Fatalf("panic 应当作为可重试的错误: %+v", st)
+	}
+
+	// 手动刷新时同样返回错误
+	if err := bad.Refresh(); err == nil {
+		t.Fatal("panic 的任务刷新应当返回错误")
+	}
+}
+
+// TestSchedulerIsolation 不同调度器的任务互不影响
+// 一个调度器的 worker 全部被阻塞时, 另一个调度器的任务照常执行
+func TestSchedulerIsolation(t *testing.T) {
+	blocked := NewScheduler(1)
+	free := NewScheduler(1)
+
+	release := make(chan struct{})
+	t.Cleanup(func() {
+		close(release)
+		blocked.Stop()
+		free.Stop()
+	})
+
+	var started int32
+	slow := NewJobServer("wx-slow", "slow", func(ctx context.Context) error {
+		atomic.StoreInt32(&started, 1)
+		<-release
+		return nil
+	}, time.Hour)
+	slow.SetScheduler(blocked)
+
+	var runs int32
+	fast := NewJobServer("wx-fast", "fast", func(ctx context.Context) error {
+		atomic.AddInt32(&runs, 1)
+		return nil
+	}, 10*time.Millisecond)
+	fast.SetScheduler(free)
+
+	slow.Start()
+	waitFor(t, "阻塞的任务开始执行", func() bool { return atomic.LoadInt32(&started) == 1 })
+
+	fast.Start()
+	waitFor(t, "另一个调度器的任务照常执行", func() bool { return atomic.LoadInt32(&runs) >= 3 })
+}
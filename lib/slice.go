@@ -26,3 +26,17 @@ func DistinctStr(v string) string {
 
 	return strings.Join(cp, ",")
 }
+
+// RemoveStr 从 逗号连接的 字符串 中删除指定的项
+func RemoveStr(v, item string) string {
+	as := strings.Split(v, ",")
+
+	cp := make([]string, 0)
+	for _, a := range as {
+		if a != item && a != "" {
+			cp = append(cp, a)
+		}
+	}
+
+	return strings.Join(cp, ",")
+}
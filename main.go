@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/zjxpcyc/wechat-scheduler/database"
 	"github.com/zjxpcyc/wechat-scheduler/jobs"
@@ -18,13 +22,26 @@ const Version = "v0.1.0"
 
 var version = flag.Bool("v", false, "Show version of the system")
 var port = flag.Int("p", 9001, "Define http port, default is 9001")
+var workers = flag.Int("workers", lib.DEFAULT_WORKERS, "Define max number of tasks running at the same time, default is 10")
+var notifyWorkers = flag.Int("notify-workers", lib.DEFAULT_WORKERS, "Define max number of callbacks delivering at the same time, default is 10")
+var margin = flag.Int("margin", 200, "Seconds to refresh before token expires, default is 200")
+var invalidInterval = flag.Int("invalid-interval", 60, "Minimum seconds between two refreshes of a task reported invalid by clients, default is 60")
+var wechatAPI = flag.String("wechat-api", jobs.DEFAULT_BASE_URL, "Define base url of wechat api, default is "+jobs.DEFAULT_BASE_URL)
+var wechatAPIOverride = flag.String("wechat-api-override", "", "Define url of single api, format is name=url separated by comma, e.g. access_token=http://127.0.0.1:8080/cgi-bin/token")
+var httpTimeout = flag.Int("http-timeout", 10, "Seconds of timeout for each request to wechat or business systems, default is 10")
+var httpMaxIdle = flag.Int("http-max-idle", lib.DEFAULT_HTTP_MAX_IDLE, "Define max number of idle connections kept in pool, default is 100")
+var httpProxy = flag.String("http-proxy", "", "Define outbound proxy url, e.g. http://10.0.0.1:3128, empty means using HTTPS_PROXY env")
+var masterKeyFile = flag.String("master-key", "", "Define file of base64 encoded 32 bytes key to encrypt appsecret and tokens at rest, default is env "+database.MASTER_KEY_ENV)
+var oldMasterKeyFile = flag.String("old-master-key", "", "Define file of previous master key when rotating keys, default is env "+database.OLD_MASTER_KEY_ENV)
+var storeKind = flag.String("store", database.STORE_BUNTDB, "Define storage backend: buntdb, sqlite, redis or memory, default is buntdb")
+var dataPath = flag.String("data", "", "Define data directory for buntdb, file for sqlite or redis:// url for redis")
+var lease = flag.Int("lease", 0, "Seconds of the per appid lease when several instances share storage, 0 means single instance")
+var instanceID = flag.String("id", "", "Define unique id of this instance, default is hostname-pid")
+var authFile = flag.String("auth", "", "Define json file of client credentials, empty means no authentication")
+var shutdownTimeout = flag.Int("shutdown-timeout", 30, "Seconds to wait for running tasks when shutting down, default is 30")
 var logger = lib.GetLogger()
 
-func newHandler() http.Handler {
-	database.Init()
-	jobs.Init()
-
-	app := new(App)
+func newHandler(app *App) http.Handler {
 	mux := http.NewServeMux()
 	mux.Handle("/", app)
 	return mux
@@ -38,9 +55,118 @@ func main() {
 		os.Exit(0)
 	}
 
+	jobs.Margin = time.Duration(*margin) * time.Second
+	jobs.InvalidInterval = time.Duration(*invalidInterval) * time.Second
+	lib.DefaultScheduler = lib.NewScheduler(*workers)
+	jobs.NotifyScheduler = lib.NewScheduler(*notifyWorkers)
+
+	if u, err := url.Parse(*wechatAPI); err != nil || u.Scheme == "" || u.Host == "" {
+		log.Fatalln("微信接口地址不正确: " + *wechatAPI)
+	}
+	jobs.BaseURL = *wechatAPI
+
+	client, err := lib.NewHTTPClient(lib.HTTPConfig{
+		Timeout:      time.Duration(*httpTimeout) * time.Second,
+		MaxIdleConns: *httpMaxIdle,
+		Proxy:        *httpProxy,
+	})
+	if err != nil {
+		log.Fatalln(err)
+	}
+	lib.HTTPClient = client
+
+	overrides, err := jobs.ParseAPIOverrides(*wechatAPIOverride)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	jobs.APIOverrides = overrides
+
+	store, err := database.Open(*storeKind, *dataPath)
+	if err != nil {
+		log.Fatalln("打开存储失败: " + err.Error())
+	}
+
+	// 敏感字段加密保存
+	masterKey, err := database.LoadMasterKey(*masterKeyFile, database.MASTER_KEY_ENV)
+	if err != nil {
+		log.Fatalln("读取 master key 失败: " + err.Error())
+	}
+
+	oldKey, err := database.LoadMasterKey(*oldMasterKeyFile, database.OLD_MASTER_KEY_ENV)
+	if err != nil {
+		log.Fatalln("读取旧的 master key 失败: " + err.Error())
+	}
+
+	if oldKey != nil && masterKey == nil {
+		log.Fatalln("轮换 master key 时需要同时指定新的 master key")
+	}
+
+	if masterKey != nil {
+		olds := make([][]byte, 0)
+		if oldKey != nil {
+			olds = append(olds, oldKey)
+		}
+
+		c, err := database.NewCipher(masterKey, olds...)
+		if err != nil {
+			log.Fatalln("初始化加密失败: " + err.Error())
+		}
+
+		database.SetCipher(c)
+	}
+
+	if err := database.Init(store); err != nil {
+		log.Fatalln("初始化存储失败: " + err.Error())
+	}
+
+	reg := jobs.NewRegistry()
+
+	// 多实例共享存储时, 每个 appid 只由持有租约的实例运行
+	var elector *jobs.Elector
+	if *lease > 0 {
+		id := *instanceID
+		if id == "" {
+			host, _ := os.Hostname()
+			id = host + "-" + strconv.Itoa(os.Getpid())
+		}
+
+		elector = jobs.NewElector(reg, store, id, time.Duration(*lease)*time.Second)
+	}
+
+	jobs.Init(reg)
+
+	if elector != nil {
+		elector.Start()
+	}
+
+	app := NewApp(reg)
+
+	if *authFile != "" {
+		if app.Auth, err = lib.LoadAuthenticator(*authFile); err != nil {
+			log.Fatalln("读取访问凭证失败: " + err.Error())
+		}
+	}
+
 	addr := ":" + strconv.Itoa(*port)
-	serv := http.Server{Addr: addr, Handler: newHandler()}
+	l, err := listen(addr)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	serv := &http.Server{Addr: addr, Handler: newHandler(app)}
+	go func() {
+		if err := serv.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Fatalln(err)
+		}
+	}()
 
 	logger.Info("启动成功 http://" + addr)
-	log.Fatalln(serv.ListenAndServe())
+
+	// SIGINT, SIGTERM 平滑关闭; SIGHUP 平滑重启
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	s := <-sig
+
+	logger.Info("收到信号 " + s.String() + ", 开始关闭 ...")
+	shutdown(app, serv, l, store, elector, time.Duration(*shutdownTimeout)*time.Second, s == syscall.SIGHUP)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Route 路由定义
+type Route struct {
+	// Method 请求方式
+	Method string
+
+	// Pattern 路径, 支持 :name 形式的参数, 比如 /task/:appid/:type
+	Pattern string
+
+	// Permission 访问所需的权限
+	Permission string
+
+	// Handler 处理函数
+	Handler func(*Controller)
+
+	parts []string
+}
+
+// Router 简单的 http 路由
+type Router struct {
+	routes []*Route
+}
+
+// NewRouter 实例化路由
+func NewRouter() *Router {
+	return &Router{
+		routes: make([]*Route, 0),
+	}
+}
+
+// Handle 添加路由
+func (r *Router) Handle(method, pattern, perm string, handler func(*Controller)) {
+	r.routes = append(r.routes, &Route{
+		Method:     method,
+		Pattern:    pattern,
+		Permission: perm,
+		Handler:    handler,
+		parts:      splitPath(pattern),
+	})
+}
+
+// Match 依据请求方式及路径查找路由
+// 返回匹配的路由及路径参数; 找不到时返回 404, 路径存在但是请求方式不对时返回 405 及允许的方式
+func (r *Router) Match(method, path string) (*Route, map[string]string, int, []string) {
+	parts := splitPath(path)
+	allowed := make([]string, 0)
+
+	for _, rt := range r.routes {
+		params, ok := rt.match(parts)
+		if !ok {
+			continue
+		}
+
+		if rt.Method != method {
+			allowed = append(allowed, rt.Method)
+			continue
+		}
+
+		return rt, params, http.StatusOK, nil
+	}
+
+	if len(allowed) > 0 {
+		return nil, nil, http.StatusMethodNotAllowed, allowed
+	}
+
+	return nil, nil, http.StatusNotFound, nil
+}
+
+func (rt *Route) match(parts []string) (map[string]string, bool) {
+	if len(parts) != len(rt.parts) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, p := range rt.parts {
+		if strings.HasPrefix(p, ":") {
+			params[p[1:]] = parts[i]
+			continue
+		}
+
+		if p != parts[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+// splitPath 拆分路径, 忽略首尾的 /
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return []string{}
+	}
+
+	return strings.Split(path, "/")
+}
@@ -0,0 +1,395 @@
+// Package wechattest 模拟微信接口的测试服务
+// 可以签发 access_token, jsapi_ticket, 开放平台的 component_access_token 及 authorizer_access_token,
+// 可以注入错误, 并记录收到的请求, 用于在没有网络的情况下测试所有类型的任务
+//
+//	srv := wechattest.NewServer()
+//	defer srv.Close()
+//
+//	srv.AddApp("wx123456", "secret")
+//	jobs.BaseURL = srv.URL
+package wechattest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 模拟的接口名称, 与任务名称一致
+const (
+	API_ACCESS_TOKEN            = "access_token"
+	API_WEB_ACCESS_TOKEN        = "web_access_token"
+	API_JSAPI_TICKET            = "jsapi_ticket"
+	API_COMPONENT_ACCESS_TOKEN  = "component_access_token"
+	API_AUTHORIZER_ACCESS_TOKEN = "authorizer_access_token"
+)
+
+// 模拟的接口地址, 与微信一致
+var paths = map[string]string{
+	API_ACCESS_TOKEN:            "/cgi-bin/token",
+	API_WEB_ACCESS_TOKEN:        "/sns/oauth2/refresh_token",
+	API_JSAPI_TICKET:            "/cgi-bin/ticket/getticket",
+	API_COMPONENT_ACCESS_TOKEN:  "/cgi-bin/component/api_component_token",
+	API_AUTHORIZER_ACCESS_TOKEN: "/cgi-bin/component/api_authorizer_token",
+}
+
+// Server 模拟的微信接口服务
+type Server struct {
+	*httptest.Server
+
+	// ExpiresIn 签发的 token 及 ticket 的有效期(秒)
+	ExpiresIn int
+
+	mu  sync.Mutex
+	seq int
+
+	// apps 已知的 appid 及 appsecret
+	apps map[string]string
+
+	// tokens 每个 appid 最新的 access_token, 旧的 token 立即失效
+	tokens map[string]string
+
+	// componentTokens 每个第三方平台最新的 component_access_token
+	componentTokens map[string]string
+
+	// faults 注入的错误, 按照顺序返回
+	faults map[string][]int
+
+	// calls 各接口的调用次数
+	calls map[string]int
+
+	// requests 各接口收到的请求
+	requests map[string][]Request
+
+	// holds 被阻塞的接口, 关闭之后继续处理
+	holds map[string]chan struct{}
+}
+
+// Request 模拟服务收到的请求, 用于检查任务发送的内容
+type Request struct {
+	Method      string
+	ContentType string
+	Query       url.Values
+	Body        []byte
+}
+
+// NewServer 启动模拟服务, 使用之后需要调用 Close
+func NewServer() *Server {
+	s := &Server{
+		ExpiresIn:       7200,
+		apps:            make(map[string]string),
+		tokens:          make(map[string]string),
+		componentTokens: make(map[string]string),
+		faults:          make(map[string][]int),
+		calls:           make(map[string]int),
+		requests:        make(map[string][]Request),
+		holds:           make(map[string]chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(paths[API_ACCESS_TOKEN], s.handle(API_ACCESS_TOKEN, s.accessToken))
+	mux.HandleFunc(paths[API_WEB_ACCESS_TOKEN], s.handle(API_WEB_ACCESS_TOKEN, s.webAccessToken))
+	mux.HandleFunc(paths[API_JSAPI_TICKET], s.handle(API_JSAPI_TICKET, s.jsapiTicket))
+	mux.HandleFunc(paths[API_COMPONENT_ACCESS_TOKEN], s.handle(API_COMPONENT_ACCESS_TOKEN, s.componentAccessToken))
+	mux.HandleFunc(paths[API_AUTHORIZER_ACCESS_TOKEN], s.handle(API_AUTHORIZER_ACCESS_TOKEN, s.authorizerAccessToken))
+
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// AddApp 添加公众号或者第三方平台
+// 未添加的 appid 返回 40013, appsecret 不一致返回 40125
+func (s *Server) AddApp(appid, appsecret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.apps[appid] = appsecret
+}
+
+// Fail 接下来 times 次调用 api 时返回 errcode
+func (s *Server) Fail(api string, errcode int, times int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := 0; i < times; i++ {
+		s.faults[api] = append(s.faults[api], errcode)
+	}
+}
+
+// Calls api 被调用的次数, 包括返回错误的调用
+func (s *Server) Calls(api string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.calls[api]
+}
+
+// Hold 阻塞接下来对 api 的调用, 直到调用返回的 release
+// 用于构造并发的场景, 比如请求进行中时再次刷新
+func (s *Server) Hold(api string) (release func()) {
+	hold := make(chan struct{})
+
+	s.mu.Lock()
+	s.holds[api] = hold
+	s.mu.Unlock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.mu.Lock()
+			if s.holds[api] == hold {
+				delete(s.holds, api)
+			}
+			s.mu.Unlock()
+
+			close(hold)
+		})
+	}
+}
+
+// Requests api 收到的所有请求, 按照收到的顺序
+func (s *Server) Requests(api string) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests[api]...)
+}
+
+// AccessToken appid 当前有效的 access_token
+func (s *Server) AccessToken(appid string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.tokens[appid]
+}
+
+// Invalidate 使 appid 当前的 access_token 失效, 模拟在其他地方刷新了 token
+func (s *Server) Invalidate(appid string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.tokens, appid)
+}
+
+type handler func(r *http.Request) (map[string]interface{}, int)
+
+// handle 统计调用次数, 记录请求, 并优先返回注入的错误
+func (s *Server) handle(api string, h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		s.mu.Lock()
+		s.calls[api]++
+		s.requests[api] = append(s.requests[api], Request{
+			Method:      r.Method,
+			ContentType: r.Header.Get("Content-Type"),
+			Query:       r.URL.Query(),
+			Body:        body,
+		})
+
+		errcode := 0
+		if faults := s.faults[api]; len(faults) > 0 {
+			errcode = faults[0]
+			s.faults[api] = faults[1:]
+		}
+		hold := s.holds[api]
+		s.mu.Unlock()
+
+		if hold != nil {
+			<-hold
+		}
+
+		var res map[string]interface{}
+		if errcode == 0 {
+			res, errcode = h(r)
+		}
+
+		if errcode != 0 {
+			res = s.errorResult(errcode)
+		}
+
+		w.Header().Set("Content-Type", "application/json; encoding=utf-8")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+func (s *Server) errorResult(errcode int) map[string]interface{} {
+	return map[string]interface{}{
+		"errcode": errcode,
+		"errmsg":  "mock error rid: " + s.next("rid"),
+	}
+}
+
+// next 生成唯一的值
+// 调用方不能持有 s.mu
+func (s *Server) next(prefix string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.seq++
+	return prefix + "-" + strconv.Itoa(s.seq) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+}
+
+// checkApp 校验 appid 及 appsecret
+func (s *Server) checkApp(appid, appsecret string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	secret, ok := s.apps[appid]
+	if !ok {
+		return 40013
+	}
+
+	if appsecret != secret {
+		return 40125
+	}
+
+	return 0
+}
+
+// appOfToken 依据最新的 token 查找 appid, 找不到时返回空字符串
+func appOfToken(tokens map[string]string, token string) string {
+	if token == "" {
+		return ""
+	}
+
+	for appid, t := range tokens {
+		if t == token {
+			return appid
+		}
+	}
+
+	return ""
+}
+
+// GET /cgi-bin/token?grant_type=client_credential&appid=APPID&secret=APPSECRET
+func (s *Server) accessToken(r *http.Request) (map[string]interface{}, int) {
+	q := r.URL.Query()
+	if q.Get("grant_type") != "client_credential" {
+		return nil, 40002
+	}
+
+	appid := q.Get("appid")
+	if code := s.checkApp(appid, q.Get("secret")); code != 0 {
+		return nil, code
+	}
+
+	token := s.next("ACCESS_TOKEN")
+
+	s.mu.Lock()
+	s.tokens[appid] = token
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"access_token": token,
+		"expires_in":   s.ExpiresIn,
+	}, 0
+}
+
+// GET /sns/oauth2/refresh_token?appid=APPID&grant_type=refresh_token&refresh_token=REFRESH_TOKEN
+func (s *Server) webAccessToken(r *http.Request) (map[string]interface{}, int) {
+	q := r.URL.Query()
+	if q.Get("appid") == "" {
+		return nil, 41002
+	}
+
+	refresh := q.Get("refresh_token")
+	if refresh == "" || refresh == "REFRESH_TOKEN" {
+		return nil, 40030
+	}
+
+	return map[string]interface{}{
+		"access_token":  s.next("WEB_ACCESS_TOKEN"),
+		"expires_in":    s.ExpiresIn,
+		"refresh_token": refresh,
+		"openid":        "OPENID",
+		"scope":         "snsapi_userinfo",
+	}, 0
+}
+
+// GET /cgi-bin/ticket/getticket?access_token=ACCESS_TOKEN&type=jsapi
+func (s *Server) jsapiTicket(r *http.Request) (map[string]interface{}, int) {
+	q := r.URL.Query()
+
+	s.mu.Lock()
+	appid := appOfToken(s.tokens, q.Get("access_token"))
+	s.mu.Unlock()
+
+	if appid == "" {
+		return nil, 40001
+	}
+
+	return map[string]interface{}{
+		"errcode":    0,
+		"errmsg":     "ok",
+		"ticket":     s.next("JSAPI_TICKET"),
+		"expires_in": s.ExpiresIn,
+	}, 0
+}
+
+// POST /cgi-bin/component/api_component_token
+// { "component_appid": "", "component_appsecret": "", "component_verify_ticket": "" }
+func (s *Server) componentAccessToken(r *http.Request) (map[string]interface{}, int) {
+	body := map[string]string{}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		return nil, 47001
+	}
+
+	appid := body["component_appid"]
+	if code := s.checkApp(appid, body["component_appsecret"]); code != 0 {
+		return nil, code
+	}
+
+	if body["component_verify_ticket"] == "" {
+		return nil, 61006
+	}
+
+	token := s.next("COMPONENT_ACCESS_TOKEN")
+
+	s.mu.Lock()
+	s.componentTokens[appid] = token
+	s.mu.Unlock()
+
+	return map[string]interface{}{
+		"component_access_token": token,
+		"expires_in":             s.ExpiresIn,
+	}, 0
+}
+
+// POST /cgi-bin/component/api_authorizer_token?component_access_token=COMPONENT_ACCESS_TOKEN
+// { "component_appid": "", "authorizer_appid": "", "authorizer_refresh_token": "" }
+func (s *Server) authorizerAccessToken(r *http.Request) (map[string]interface{}, int) {
+	body := map[string]string{}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&body) != nil {
+		return nil, 47001
+	}
+
+	s.mu.Lock()
+	appid := appOfToken(s.componentTokens, r.URL.Query().Get("component_access_token"))
+	s.mu.Unlock()
+
+	if appid == "" {
+		return nil, 40001
+	}
+
+	if body["component_appid"] != appid || body["authorizer_appid"] == "" {
+		return nil, 40013
+	}
+
+	if body["authorizer_refresh_token"] == "" {
+		return nil, 61023
+	}
+
+	return map[string]interface{}{
+		"authorizer_access_token":  s.next("AUTHORIZER_ACCESS_TOKEN"),
+		"expires_in":               s.ExpiresIn,
+		"authorizer_refresh_token": body["authorizer_refresh_token"],
+	}, 0
+}